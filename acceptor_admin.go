@@ -1 +1,193 @@
 package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// adminAcceptor serves the admin http api. It listens on adminAddress,
+// which is separate from serverAddress and wsAddress.
+// Requests changing the state(kick and quit) MUST carry adminSecret in header adminSecretHeader,
+// and MUST NOT carry an Origin header, so neither other local users nor browser pages can send them.
+type adminAcceptor struct {
+}
+
+const adminSecretHeader = "X-Biblio-Admin-Secret"
+
+type adminClientInfo struct {
+	ID         int64  `json:"id"`
+	State      string `json:"state"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+type adminPlayerInfo struct {
+	UID   int64  `json:"uid"`
+	State string `json:"state"`
+}
+
+type httpResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func writeJSONResponse(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSONResponse(w, code, &httpResult{OK: false, Error: msg})
+}
+
+func (a *adminAcceptor) handleClients(w http.ResponseWriter, r *http.Request) {
+	clients := serverInst.clientList()
+	infos := make([]*adminClientInfo, 0, len(clients))
+	for _, c := range clients {
+		info := &adminClientInfo{
+			ID:    c.id,
+			State: c.stateName(),
+		}
+		if addr := c.getRemoteAddr(); addr != nil {
+			info.RemoteAddr = addr.String()
+		}
+		infos = append(infos, info)
+	}
+	writeJSONResponse(w, http.StatusOK, infos)
+}
+
+func (a *adminAcceptor) handlePlayers(w http.ResponseWriter, r *http.Request) {
+	players := serverInst.playerList()
+	infos := make([]*adminPlayerInfo, 0, len(players))
+	for _, p := range players {
+		infos = append(infos, &adminPlayerInfo{
+			UID:   p.uid(),
+			State: p.stateName(),
+		})
+	}
+	writeJSONResponse(w, http.StatusOK, infos)
+}
+
+func (a *adminAcceptor) handleCount(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, map[string]int{
+		"clientCount": serverInst.clientCount(),
+	})
+}
+
+func (a *adminAcceptor) handleAdmission(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"refused":           serverInst.admission.refuseCounts(),
+		"ipConnectionCount": serverInst.admission.ipConnectionCount(),
+	})
+}
+
+func (a *adminAcceptor) handleWSCompression(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, wsCompressStatsSnapshot())
+}
+
+func (a *adminAcceptor) handleAck(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, ackStatsSnapshot())
+}
+
+func (a *adminAcceptor) handleLoginQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, serverInst.loginQueue.stats())
+}
+
+// authorize writes an error and returns false if r may not change the state.
+func (a *adminAcceptor) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "POST required")
+		return false
+	}
+	if r.Header.Get("Origin") != "" {
+		writeJSONError(w, http.StatusForbidden, "cross-origin request")
+		return false
+	}
+	if adminSecret == "" {
+		writeJSONError(w, http.StatusForbidden, "adminSecret not configured")
+		return false
+	}
+	if !hmac.Equal([]byte(r.Header.Get(adminSecretHeader)), []byte(adminSecret)) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid admin secret")
+		return false
+	}
+	return true
+}
+
+func (a *adminAcceptor) handleKick(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
+	uid, err := strconv.ParseInt(r.FormValue("uid"), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid uid")
+		return
+	}
+
+	if !serverInst.kickPlayer(uid) {
+		writeJSONError(w, http.StatusNotFound, "player not found")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, &httpResult{OK: true})
+}
+
+func (a *adminAcceptor) handleQuit(w http.ResponseWriter, r *http.Request) {
+	if !a.authorize(w, r) {
+		return
+	}
+
+	log.Println("admin: quit requested from", r.RemoteAddr)
+	writeJSONResponse(w, http.StatusOK, &httpResult{OK: true})
+	setQuit()
+}
+
+func (a *adminAcceptor) start(b *Server) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/clients", a.handleClients)
+	mux.HandleFunc("/admin/players", a.handlePlayers)
+	mux.HandleFunc("/admin/count", a.handleCount)
+	mux.HandleFunc("/admin/admission", a.handleAdmission)
+	mux.HandleFunc("/admin/wscompression", a.handleWSCompression)
+	mux.HandleFunc("/admin/ack", a.handleAck)
+	mux.HandleFunc("/admin/loginqueue", a.handleLoginQueue)
+	mux.HandleFunc("/admin/kick", a.handleKick)
+	mux.HandleFunc("/admin/quit", a.handleQuit)
+
+	httpServer := &http.Server{Addr: adminAddress, Handler: mux}
+	if adminSecret == "" {
+		log.Println("admin: adminSecret is empty, kick and quit are disabled")
+	}
+
+	// The admin server is kept while draining, operators still kick players and watch them leave.
+	// It shares the inherited listener with the new process until this one quits.
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("admin server closer quit")
+
+		<-getQuit()
+		httpServer.Close()
+	}()
+
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("admin server quit")
+
+		ln, err := listenTCP(listenerAdmin, adminAddress)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if err := httpServer.Serve(ln); err != nil {
+			log.Println(err)
+			return
+		}
+	}()
+}
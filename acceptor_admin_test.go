@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdminKick(t *testing.T) {
+	const uid = 8801
+	serverInst.addPlayer(uid, newPlayer(nil, nil))
+	defer func() {
+		serverInst.muxp.Lock()
+		delete(serverInst.players, uid)
+		serverInst.muxp.Unlock()
+	}()
+
+	tests := []struct {
+		name    string
+		method  string
+		secret  string // configured
+		header  string // of the request
+		origin  string
+		uid     string
+		want    int
+		wantReq bool // an unbindReq of uid is added
+	}{
+		{"get", http.MethodGet, "s3cret", "s3cret", "", "8801", http.StatusMethodNotAllowed, false},
+		{"no secret configured", http.MethodPost, "", "", "", "8801", http.StatusForbidden, false},
+		{"no secret", http.MethodPost, "s3cret", "", "", "8801", http.StatusUnauthorized, false},
+		{"wrong secret", http.MethodPost, "s3cret", "s3cres", "", "8801", http.StatusUnauthorized, false},
+		{"origin", http.MethodPost, "s3cret", "s3cret", "http://evil.example.com", "8801", http.StatusForbidden, false},
+		{"invalid uid", http.MethodPost, "s3cret", "s3cret", "", "x", http.StatusBadRequest, false},
+		{"unknown uid", http.MethodPost, "s3cret", "s3cret", "", "8802", http.StatusNotFound, false},
+		{"ok", http.MethodPost, "s3cret", "s3cret", "", "8801", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				serverInst.muxx.Lock()
+				delete(serverInst.xBindReqs, uid)
+				delete(serverInst.xBindReqs, uid+1)
+				serverInst.muxx.Unlock()
+			}()
+
+			r := httptest.NewRequest(tt.method, "/admin/kick", strings.NewReader(url.Values{"uid": {tt.uid}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.header != "" {
+				r.Header.Set(adminSecretHeader, tt.header)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			setGlobal(t, &adminSecret, tt.secret)
+			w := httptest.NewRecorder()
+			(&adminAcceptor{}).handleKick(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %v, want %v: %s", w.Code, tt.want, w.Body)
+			}
+
+			serverInst.muxx.Lock()
+			_, added := serverInst.xBindReqs[uid].(*unbindReq)
+			n := len(serverInst.xBindReqs)
+			serverInst.muxx.Unlock()
+			if added != tt.wantReq {
+				t.Fatalf("unbindReq added %v, want %v", added, tt.wantReq)
+			}
+			if !tt.wantReq && n != 0 {
+				t.Fatalf("%v xBindReqs added", n)
+			}
+		})
+	}
+}
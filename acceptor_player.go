@@ -1,23 +1,32 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net"
 	"time"
 )
 
+// max time to read the PROXY protocol header and finish tls handshake
+var connPrepareTimeout = 5 * time.Second
+
 // playerAcceptor accepts connection requests from player-clients.
 type playerAcceptor struct {
+	tlsConfig *tls.Config // nil means plain tcp
 }
 
 func (a *playerAcceptor) start(b *Server) {
-	tcpaddr, err := net.ResolveTCPAddr("tcp", serverAddress)
-	if err != nil {
-		log.Println(err)
-		return
+	if serverCertFile != "" {
+		r, err := newCertReloader(serverCertFile, serverKeyFile)
+		if err != nil {
+			log.Println(err)
+			setQuit()
+			return
+		}
+		a.tlsConfig = r.tlsConfig()
 	}
 
-	ln, err := net.ListenTCP("tcp", tcpaddr)
+	ln, err := listenTCP(listenerPlayer, serverAddress)
 	if err != nil {
 		log.Println(err)
 		return
@@ -33,6 +42,9 @@ func (a *playerAcceptor) start(b *Server) {
 			case <-getQuit():
 				ln.Close()
 				return
+			case <-getDrain():
+				ln.Close()
+				return
 			}
 		}
 	}()
@@ -45,7 +57,7 @@ func (a *playerAcceptor) start(b *Server) {
 		for {
 			conn, err := ln.AcceptTCP()
 			if err != nil {
-				if needQuit() {
+				if needQuit() || needDrain() {
 					break
 				} else {
 					log.Println(err)
@@ -54,15 +66,71 @@ func (a *playerAcceptor) start(b *Server) {
 				}
 			}
 
-			if b.clientCount() >= maxConnectionCount {
+			if !b.admission.admitGlobal(b.clientCount()) {
 				conn.Close()
 				time.Sleep(50 * time.Millisecond)
+			} else if a.tlsConfig != nil || serverProxyProtocol {
+				b.admission.beginPrepare()
+				b.wgAddOne()
+				go a.prepare(b, conn)
 			} else {
-				client := newClient()
-				client.setConn(newTCPConnection(conn))
-				client.start()
-				b.addClient(client)
+				a.newClient(b, conn, conn.RemoteAddr())
 			}
 		}
 	}()
 }
+
+// prepare reads the PROXY protocol header and finishes tls handshake out of the accept loop,
+// so that a slow client could not block other clients.
+func (a *playerAcceptor) prepare(b *Server, tcpConn *net.TCPConn) {
+	defer b.wgDone()
+	defer b.admission.endPrepare()
+
+	var conn net.Conn = tcpConn
+	remote := conn.RemoteAddr()
+	conn.SetDeadline(time.Now().Add(connPrepareTimeout))
+
+	if serverProxyProtocol {
+		if !isTrustedProxy(addrIP(remote)) {
+			log.Println(errProxyNotTrusted, remote)
+			conn.Close()
+			return
+		}
+
+		addr, err := readProxyHeader(conn)
+		if err != nil {
+			log.Println(err)
+			conn.Close()
+			return
+		}
+		if addr != nil {
+			remote = addr
+		}
+	}
+
+	if a.tlsConfig != nil {
+		tlsConn := tls.Server(conn, a.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			log.Println(err)
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+
+	conn.SetDeadline(time.Time{})
+	a.newClient(b, conn, remote)
+}
+
+func (a *playerAcceptor) newClient(b *Server, conn net.Conn, remote net.Addr) {
+	if !b.admission.admitIP(addrIP(remote)) {
+		conn.Close()
+		return
+	}
+
+	client := newClient()
+	client.setRemoteAddr(remote)
+	client.setConn(newTCPConnection(conn))
+	b.addClient(client)
+	client.start()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const udpMaxDatagramSize = 64 * 1024
+
+// udpAcceptor accepts rudp sessions from player-clients.
+// One goroutine reads all datagrams and dispatches them to sessions by remote address,
+// another goroutine updates all sessions every rudpInterval.
+//
+// A datagram of another conv from the address of a session starts a pending session, as the
+// source address of a datagram could be forged. The session is replaced only after the pending
+// one is confirmed, when the peer acks data sent to the address(see rudpSession.confirmed).
+type udpAcceptor struct {
+	ln *net.UDPConn
+
+	mux      sync.Mutex
+	sessions map[string]*rudpSession
+	pending  map[string]*rudpSession // new sessions from addresses of sessions, not confirmed
+}
+
+func (a *udpAcceptor) start(b *Server) {
+	if udpAddress == "" {
+		return
+	}
+
+	var err error
+	a.ln, err = listenUDP(listenerUDP, udpAddress)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	a.sessions = make(map[string]*rudpSession, 100)
+	a.pending = make(map[string]*rudpSession)
+
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("udp listener closer quit")
+
+		for {
+			select {
+			case <-getQuit():
+				a.ln.Close()
+				return
+			case <-getDrain():
+				a.ln.Close()
+				return
+			}
+		}
+	}()
+
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("udp reader quit")
+
+		buf := make([]byte, udpMaxDatagramSize)
+		for {
+			n, addr, err := a.ln.ReadFromUDP(buf)
+			if err != nil {
+				if needQuit() || needDrain() {
+					break
+				} else {
+					log.Println(err)
+					setQuit()
+					break
+				}
+			}
+
+			a.dispatch(b, buf[:n], addr)
+		}
+	}()
+
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("udp session updater quit")
+
+		ticker := time.NewTicker(rudpInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				a.update()
+			case <-getQuit():
+				return
+			}
+		}
+	}()
+}
+
+func (a *udpAcceptor) output(b []byte, addr *net.UDPAddr) error {
+	_, err := a.ln.WriteToUDP(b, addr)
+	return err
+}
+
+func (a *udpAcceptor) dispatch(b *Server, data []byte, addr *net.UDPAddr) {
+	conv, cmd, sn, ok := rudpPeekHeader(data)
+	if !ok {
+		return
+	}
+
+	key := addr.String()
+
+	a.mux.Lock()
+	sess, ok := a.sessions[key]
+	live := ok
+	if ok && sess.conv != conv {
+		// the peer may have started a new session, or the datagram is forged
+		sess, ok = a.pending[key]
+		if ok && sess.conv != conv {
+			ok = false
+		}
+	}
+	if !ok {
+		// only the first segment of a session could create it
+		if cmd != rudpCmdPush || sn != 0 {
+			a.mux.Unlock()
+			return
+		}
+		if !b.admission.admitGlobal(b.clientCount()) || !b.admission.admitIP(addr.IP) {
+			a.mux.Unlock()
+			return
+		}
+		sess = newRUDPSession(conv, addr, a.output)
+		if live {
+			if old, ok := a.pending[key]; ok {
+				old.close()
+			}
+			a.pending[key] = sess
+		} else {
+			a.sessions[key] = sess
+		}
+		a.mux.Unlock()
+
+		client := newClient()
+		client.setRemoteAddr(addr)
+		client.setConn(newUDPConnection(sess))
+		b.addClient(client)
+		client.start()
+	} else {
+		a.mux.Unlock()
+	}
+
+	if err := sess.input(data, addr); err != nil {
+		log.Println(err)
+		sess.close()
+		return
+	}
+	if live && sess.confirmed() {
+		a.promote(key, sess)
+	}
+}
+
+// promote replaces the session of key by the pending one.
+func (a *udpAcceptor) promote(key string, sess *rudpSession) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.pending[key] != sess {
+		return
+	}
+	delete(a.pending, key)
+	if old, ok := a.sessions[key]; ok {
+		old.close()
+	}
+	a.sessions[key] = sess
+}
+
+type udpSessionRef struct {
+	key  string
+	sess *rudpSession
+}
+
+// update updates a snapshot of sessions, so that dispatch is not blocked by sending.
+func (a *udpAcceptor) update() {
+	a.mux.Lock()
+	refs := make([]udpSessionRef, 0, len(a.sessions)+len(a.pending))
+	for key, sess := range a.sessions {
+		refs = append(refs, udpSessionRef{key, sess})
+	}
+	for key, sess := range a.pending {
+		refs = append(refs, udpSessionRef{key, sess})
+	}
+	a.mux.Unlock()
+
+	var dead []udpSessionRef
+	for _, r := range refs {
+		if !r.sess.update() {
+			r.sess.sendFin()
+			dead = append(dead, r)
+		}
+	}
+	if len(dead) == 0 {
+		return
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for _, r := range dead {
+		if a.sessions[r.key] == r.sess {
+			delete(a.sessions, r.key)
+		}
+		if a.pending[r.key] == r.sess {
+			delete(a.pending, r.key)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// unixAcceptor accepts connections from a unix domain socket, for example
+// load-test bots and a local edge proxy on the same host.
+// Who may connect is controlled by permissions of the socket file.
+// A stale socket file is replaced on start(see listenUnix). The file is removed when the server
+// quits, but not when it drains, as the new process serves the same file.
+type unixAcceptor struct {
+}
+
+func (a *unixAcceptor) start(b *Server) {
+	if unixSocketPath == "" {
+		return
+	}
+
+	ln, err := listenUnix(listenerUnix, unixSocketPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.Chmod(unixSocketPath, unixSocketMode); err != nil {
+		log.Println(err)
+		ln.Close()
+		return
+	}
+
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("unix listener closer quit")
+
+		for {
+			select {
+			case <-getQuit():
+				ln.Close()
+				if err := os.Remove(unixSocketPath); err != nil {
+					log.Println(err)
+				}
+				return
+			case <-getDrain():
+				ln.Close()
+				return
+			}
+		}
+	}()
+
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("unix accepter quit")
+
+		for {
+			conn, err := ln.AcceptUnix()
+			if err != nil {
+				if needQuit() || needDrain() {
+					break
+				} else {
+					log.Println(err)
+					setQuit()
+					break
+				}
+			}
+
+			if !b.admission.admitGlobal(b.clientCount()) {
+				conn.Close()
+				time.Sleep(50 * time.Millisecond)
+			} else {
+				client := newClient()
+				client.setRemoteAddr(conn.RemoteAddr())
+				client.setConn(newTCPConnection(conn))
+				b.addClient(client)
+				client.start()
+			}
+		}
+	}()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"biblio/util"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixAcceptor(t *testing.T) {
+	oldPath := unixSocketPath
+	defer func() {
+		unixSocketPath = oldPath
+		initQuitAndDrain()
+	}()
+
+	tests := []struct {
+		name    string
+		stale   bool // a socket file is left by a dead process
+		stop    func()
+		removed bool
+	}{
+		{"quit", false, func() { setQuit() }, true},
+		{"stale socket file", true, func() { setQuit() }, true},
+		{"drain", false, func() { setDrain() }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initQuitAndDrain()
+			unixSocketPath = filepath.Join(t.TempDir(), "gateway.sock")
+			if tt.stale {
+				ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: unixSocketPath, Net: "unix"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ln.SetUnlinkOnClose(false)
+				ln.Close()
+			}
+
+			(&unixAcceptor{}).start(serverInst)
+			fi, err := os.Stat(unixSocketPath)
+			if err != nil || fi.Mode().Perm() != unixSocketMode {
+				t.Fatalf("socket file: %v", err)
+			}
+
+			conn, err := net.Dial("unix", unixSocketPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// goroutines of the server read the quit channel, which is replaced by the next case
+			defer serverInst.wg.Wait()
+			defer setQuit()
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte(handshakeMagic + "\x06\x02pb\x00")); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, handshakeReplyLen)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if string(reply[:len(handshakeMagic)]) != handshakeMagic || int8(reply[len(handshakeMagic)]) != util.InvalidReason {
+				t.Fatalf("handshake reply %q", reply)
+			}
+
+			tt.stop()
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				_, err := os.Stat(unixSocketPath)
+				if removed := os.IsNotExist(err); removed == tt.removed {
+					break
+				} else if time.Now().After(deadline) {
+					t.Fatalf("socket file removed %v, want %v", removed, tt.removed)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if !tt.removed {
+				// the listener is closed all the same
+				for time.Now().Before(deadline) {
+					c, err := net.Dial("unix", unixSocketPath)
+					if err != nil {
+						return
+					}
+					c.Close()
+					time.Sleep(time.Millisecond)
+				}
+				t.Fatal("listener not closed")
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	t.Setenv(listenFdsEnv, listenerWS) // the unix listener is not inherited
+	muxListeners.Lock()
+	old := listeners
+	muxListeners.Unlock()
+	defer func() {
+		muxListeners.Lock()
+		listeners = old
+		muxListeners.Unlock()
+	}()
+
+	tests := []struct {
+		name    string
+		stale   bool // a socket file is left by a dead process
+		regular bool // a regular file is at the path
+		wantErr bool
+	}{
+		{"new", false, false, false},
+		{"stale socket file", true, false, false},
+		{"regular file", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "gateway.sock")
+			if tt.stale {
+				ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ln.SetUnlinkOnClose(false)
+				ln.Close()
+			}
+			if tt.regular {
+				if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ln, err := listenUnix(listenerUnix, path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+
+			// the socket file is kept for a new process
+			ln.Close()
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("socket file removed on close: %v", err)
+			}
+		})
+	}
+}
@@ -1 +1,163 @@
 package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webMaxClockSkew is the max difference between the timestamp of
+// a web-server request and the local time.
+var webMaxClockSkew = 30 * time.Second
+
+// webAcceptor accepts requests from web-server(account server).
+// Web-server registers uid+token pairs here before the player-client
+// connects, so that C2SAuth can be checked by memoryAuthenticator.
+// A signed request is accepted only once: its sign is kept in nonces until ts is out of webMaxClockSkew.
+type webAcceptor struct {
+	nonces *nonceCache
+}
+
+func newWebAcceptor() *webAcceptor {
+	return &webAcceptor{
+		nonces: newNonceCache(),
+	}
+}
+
+type webTokenResult struct {
+	httpResult
+	Address   string `json:"address,omitempty"`   // tcp gateway address
+	WSAddress string `json:"wsAddress,omitempty"` // websocket gateway address
+	ServerID  string `json:"serverID,omitempty"`  // sid of signed login tokens
+
+	HandshakeKey string `json:"handshakeKey,omitempty"` // Ed25519 public key signing encrypted handshakes, base64
+}
+
+// webSign returns hex(HMAC-SHA256(webSecret, "uid|token|ts")), or
+// hex(HMAC-SHA256(webSecret, "uid|token|ts|vip")) if vip is given.
+func webSign(uid string, token string, ts string, vip string) string {
+	s := uid + "|" + token + "|" + ts
+	if vip != "" {
+		s += "|" + vip
+	}
+	mac := hmac.New(sha256.New, []byte(webSecret))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *webAcceptor) checkSign(uid string, token string, ts string, vip string, sign string) bool {
+	if webSecret == "" {
+		return false
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	d := time.Now().Sub(time.Unix(sec, 0))
+	if d > webMaxClockSkew || d < -webMaxClockSkew {
+		return false
+	}
+
+	sign = strings.ToLower(sign)
+	expected := webSign(uid, token, ts, vip)
+	if !hmac.Equal([]byte(expected), []byte(sign)) {
+		return false
+	}
+	return a.nonces.add(sign, time.Unix(sec, 0).Add(webMaxClockSkew))
+}
+
+func (a *webAcceptor) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "POST required")
+		return
+	}
+
+	uidStr := r.FormValue("uid")
+	token := r.FormValue("token")
+	ts := r.FormValue("ts")
+	vipStr := r.FormValue("vip") // optional, priority lane in the login queue
+	sign := r.FormValue("sign")
+
+	if !a.checkSign(uidStr, token, ts, vipStr, sign) {
+		log.Println("web: invalid sign from", r.RemoteAddr)
+		writeJSONError(w, http.StatusForbidden, "invalid sign")
+		return
+	}
+
+	uid, err := strconv.ParseInt(uidStr, 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid uid")
+		return
+	}
+	if token == "" {
+		writeJSONError(w, http.StatusBadRequest, "empty token")
+		return
+	}
+	var vip int
+	if vipStr != "" {
+		if vip, err = strconv.Atoi(vipStr); err != nil || vip < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid vip")
+			return
+		}
+	}
+
+	auther.addToken(uid, token, vip)
+
+	writeJSONResponse(w, http.StatusOK, &webTokenResult{
+		httpResult:   httpResult{OK: true},
+		Address:      gatewayAddress,
+		WSAddress:    gatewayWSAddress,
+		ServerID:     serverID,
+		HandshakeKey: handshakePublicKey(),
+	})
+}
+
+func (a *webAcceptor) start(b *Server) {
+	if webSecret == "" {
+		log.Println("web: webSecret is empty, all token requests will be rejected")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", a.handleToken)
+
+	httpServer := &http.Server{Addr: webAddress, Handler: mux}
+
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("web server closer quit")
+
+		for {
+			select {
+			case <-getQuit():
+				httpServer.Close()
+				return
+			case <-getDrain():
+				httpServer.Close()
+				return
+			}
+		}
+	}()
+
+	b.wgAddOne()
+	go func() {
+		defer b.wgDone()
+		defer log.Println("web server quit")
+
+		ln, err := listenTCP(listenerWeb, webAddress)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if err := httpServer.Serve(ln); err != nil {
+			log.Println(err)
+			return
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebToken(t *testing.T) {
+	setGlobal(t, &webSecret, "web-s3cret")
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		ts     int64
+		vip    string
+		sign   func(uid, token, ts, vip string) string
+		replay bool // the same request is sent again
+		want   int
+	}{
+		{"valid", now, "", webSign, false, http.StatusOK},
+		{"valid vip", now, "2", webSign, false, http.StatusOK},
+		{"upper case sign", now, "", func(uid, token, ts, vip string) string {
+			return strings.ToUpper(webSign(uid, token, ts, vip))
+		}, false, http.StatusOK},
+		{"bad sign", now, "", func(uid, token, ts, vip string) string {
+			return webSign(uid, token+"x", ts, vip)
+		}, false, http.StatusForbidden},
+		{"vip not signed", now, "2", func(uid, token, ts, vip string) string {
+			return webSign(uid, token, ts, "")
+		}, false, http.StatusForbidden},
+		{"stale ts", now - 60, "", webSign, false, http.StatusForbidden},
+		{"future ts", now + 60, "", webSign, false, http.StatusForbidden},
+		{"replayed", now, "", webSign, true, http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newWebAcceptor()
+			uid, token, ts := "1001", "token-"+strconv.Itoa(i), strconv.FormatInt(tt.ts, 10)
+			form := url.Values{"uid": {uid}, "token": {token}, "ts": {ts}, "sign": {tt.sign(uid, token, ts, tt.vip)}}
+			if tt.vip != "" {
+				form.Set("vip", tt.vip)
+			}
+
+			send := func() int {
+				r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				w := httptest.NewRecorder()
+				a.handleToken(w, r)
+				return w.Code
+			}
+			code := send()
+			if tt.replay {
+				if code != http.StatusOK {
+					t.Fatalf("first request: status %v", code)
+				}
+				code = send()
+			}
+			if code != tt.want {
+				t.Fatalf("status %v, want %v", code, tt.want)
+			}
+		})
+	}
+}
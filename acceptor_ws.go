@@ -1,34 +1,197 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	ws "github.com/gorilla/websocket"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// Websocket subprotocols are "biblio.<codec name>.v<protocol version>", for example "biblio.pb.v5".
+// Frames of protocol version 4 have the checksum wsFrameChecksum.
+const wsSubprotocolPrefix = "biblio."
+
+// wsSubprotocolsOf returns subprotocols of all supported protocol versions of codecs,
+// newer versions first, and codecs of the same version in the given order.
+func wsSubprotocolsOf(codecs []string) []string {
+	var list []string
+	for v := maxProtocolVersion; v >= minProtocolVersion; v-- {
+		for _, name := range codecs {
+			suite, err := getCodecSuite(name)
+			if err != nil || v < suite.minVersion || v > suite.maxVersion {
+				continue
+			}
+			list = append(list, fmt.Sprintf("%v%v.v%v", wsSubprotocolPrefix, name, v))
+		}
+	}
+	return list
+}
+
 type wsAcceptor struct {
 	upgrader ws.Upgrader
 }
 
+// checkOrigin allows requests without Origin(not from browsers),
+// and requests whose Origin is in wsAllowedOrigins. "*" allows any origin.
+func (a *wsAcceptor) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range wsAllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectCodecSuite returns codec suite and protocol version of the negotiated subprotocol.
+// JSON codec of protocol version 1 is used if the client requests no subprotocol.
+func (a *wsAcceptor) selectCodecSuite(subprotocol string) (*codecSuite, int, error) {
+	if subprotocol == "" {
+		return defaultCodecSuite, legacyProtocolVersion, nil
+	}
+
+	dot := strings.LastIndex(subprotocol, ".v")
+	if !strings.HasPrefix(subprotocol, wsSubprotocolPrefix) || dot < len(wsSubprotocolPrefix) {
+		return nil, 0, fmt.Errorf("subprotocol[%v] invalid", subprotocol)
+	}
+	version, err := strconv.Atoi(subprotocol[dot+2:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("subprotocol[%v] invalid", subprotocol)
+	}
+	suite, err := getCodecSuite(subprotocol[len(wsSubprotocolPrefix):dot])
+	if err != nil {
+		return nil, 0, err
+	}
+	if version < minProtocolVersion || version > maxProtocolVersion ||
+		version < suite.minVersion || version > suite.maxVersion {
+		return nil, 0, fmt.Errorf("subprotocol[%v] version not supported", subprotocol)
+	}
+	return suite, version, nil
+}
+
+// supportSubprotocol returns true if the client requests no subprotocol,
+// or one of the requested subprotocols is supported.
+func (a *wsAcceptor) supportSubprotocol(r *http.Request) bool {
+	requested := ws.Subprotocols(r)
+	if len(requested) == 0 {
+		return true
+	}
+	for _, p := range requested {
+		for _, sp := range a.upgrader.Subprotocols {
+			if p == sp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (a *wsAcceptor) doUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !serverInst.admission.admitGlobal(serverInst.clientCount()) {
+		http.Error(w, "server busy", http.StatusServiceUnavailable)
+		return
+	}
+	if !a.supportSubprotocol(r) {
+		http.Error(w, "subprotocol not supported", http.StatusBadRequest)
+		return
+	}
+	remote := forwardedAddr(r)
+	if !serverInst.admission.admitIP(addrIP(remote)) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
 	conn, err := a.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		serverInst.admission.releaseIP(addrIP(remote))
 		log.Println(err)
 		return
 	}
 
-	if serverInst.clientCount() >= maxConnectionCount {
+	suite, version, err := a.selectCodecSuite(conn.Subprotocol())
+	if err != nil {
+		serverInst.admission.releaseIP(addrIP(remote))
+		log.Println(err)
 		conn.Close()
-	} else {
-		client := newClient()
-		client.setConn(newWSConnection(conn))
-		client.start()
-		serverInst.addClient(client)
+		return
+	}
+
+	f := newFramer(frameVersionOf(version))
+	f.requireSeq = version >= seqProtocolVersion
+	f.sendSeq = version >= ackProtocolVersion
+	checksum, err := checksumOf(version, "", wsFrameChecksum)
+	if err != nil {
+		serverInst.admission.releaseIP(addrIP(remote))
+		log.Println(err)
+		conn.Close()
+		return
 	}
+	f.setChecksum(checksum)
+	wc := newWSConnection(conn, suite.newCodec(f))
+	if a.upgrader.EnableCompression && wsOffersDeflate(r) {
+		if err := conn.SetCompressionLevel(wsCompressionLevel); err != nil {
+			log.Println(err)
+		}
+		wc.compress = true
+	}
+
+	client := newClient()
+	client.setRemoteAddr(remote)
+	client.setCodecSuite(suite)
+	client.setProtocolVersion(version)
+	client.setReplayProtected(wsSecure(r))
+	client.setConn(wc)
+	serverInst.addClient(client)
+	client.start()
+}
+
+// wsSecure tells whether the request is over TLS, which may be terminated by a trusted proxy.
+func wsSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	return err == nil && isTrustedProxy(net.ParseIP(host)) &&
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// wsURL returns the url of the ws listener, which player-clients connect to.
+func wsURL(secure bool) string {
+	if secure {
+		return "wss://" + wsAddress + "/ws"
+	}
+	return "ws://" + wsAddress + "/ws"
 }
 
 func (a *wsAcceptor) start(b *Server) {
+	a.upgrader.Subprotocols = wsSubprotocols
+	a.upgrader.EnableCompression = wsCompression
+	if len(wsAllowedOrigins) > 0 {
+		a.upgrader.CheckOrigin = a.checkOrigin
+	}
+
+	if gatewayWSAddress == "" {
+		gatewayWSAddress = wsURL(wsCertFile != "")
+	}
+
 	httpServer := &http.Server{Addr: wsAddress, Handler: nil}
+	if wsCertFile != "" {
+		r, err := newCertReloader(wsCertFile, wsKeyFile)
+		if err != nil {
+			// clients would be told to connect to a listener never started
+			log.Println(err)
+			setQuit()
+			return
+		}
+		httpServer.TLSConfig = r.tlsConfig()
+	}
 
 	b.wgAddOne()
 	go func() {
@@ -40,6 +203,10 @@ func (a *wsAcceptor) start(b *Server) {
 			case <-getQuit():
 				httpServer.Close()
 				return
+			case <-getDrain():
+				// hijacked websocket connections are not closed
+				httpServer.Close()
+				return
 			}
 		}
 	}()
@@ -53,7 +220,17 @@ func (a *wsAcceptor) start(b *Server) {
 			a.doUpgrade(w, r)
 		})
 
-		if err := httpServer.ListenAndServe(); err != nil {
+		tcpln, err := listenTCP(listenerWS, wsAddress)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		// count bytes below tls, so that http.Server still sees *tls.Conn and sets r.TLS
+		var ln net.Listener = &countingListener{tcpln}
+		if httpServer.TLSConfig != nil {
+			ln = tls.NewListener(ln, httpServer.TLSConfig)
+		}
+		if err := httpServer.Serve(ln); err != nil {
 			log.Println(err)
 			return
 		}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestWSSubprotocolsOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		codecs []string
+		want   []string // must be in the list, in this order
+		count  int
+	}{
+		{"preference", []string{codecNamePB, codecNameMsgpack, codecNameJSON},
+			[]string{fmt.Sprintf("biblio.pb.v%v", maxProtocolVersion), "biblio.pb.v2", "biblio.msgpack.v2", "biblio.json.v2", "biblio.pb.v1", "biblio.json.v1"},
+			3 * (maxProtocolVersion - minProtocolVersion + 1)},
+		{"unknown codec", []string{"xml", codecNameJSON}, []string{"biblio.json.v2"}, maxProtocolVersion - minProtocolVersion + 1},
+		{"none", nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := wsSubprotocolsOf(tt.codecs)
+			if len(list) != tt.count {
+				t.Fatalf("%v subprotocols, want %v: %v", len(list), tt.count, list)
+			}
+			i := 0
+			for _, p := range list {
+				if i < len(tt.want) && p == tt.want[i] {
+					i++
+				}
+			}
+			if i != len(tt.want) {
+				t.Fatalf("%v not found in order in %v", tt.want[i], list)
+			}
+		})
+	}
+}
+
+// TestWSSubprotocolsSelectable checks that every subprotocol offered selects its codec and version.
+func TestWSSubprotocolsSelectable(t *testing.T) {
+	a := &wsAcceptor{}
+	for _, p := range wsSubprotocols {
+		t.Run(p, func(t *testing.T) {
+			suite, version, err := a.selectCodecSuite(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("%v%v.v%v", wsSubprotocolPrefix, suite.name, version); want != p {
+				t.Fatalf("selected %v", want)
+			}
+		})
+	}
+}
+
+// TestWSAcceptorCertFailure checks that the server quits if the certificate of the ws listener
+// fails to load, and web-server is never told an empty ws address.
+func TestWSAcceptorCertFailure(t *testing.T) {
+	oldCert, oldKey, oldGateway := wsCertFile, wsKeyFile, gatewayWSAddress
+	defer func() {
+		wsCertFile, wsKeyFile, gatewayWSAddress = oldCert, oldKey, oldGateway
+		initQuitAndDrain()
+	}()
+
+	tests := []struct {
+		name    string
+		gateway string // configured gatewayWSAddress
+		want    string
+	}{
+		{"derived", "", wsURL(true)},
+		{"configured", "wss://gw.example.com/ws", "wss://gw.example.com/ws"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initQuitAndDrain()
+			dir := t.TempDir()
+			wsCertFile, wsKeyFile = dir+"/cert.pem", dir+"/key.pem"
+			gatewayWSAddress = tt.gateway
+
+			(&wsAcceptor{}).start(serverInst)
+			if !needQuit() {
+				t.Fatal("server not quit")
+			}
+			if gatewayWSAddress != tt.want {
+				t.Fatalf("gatewayWSAddress %q, want %q", gatewayWSAddress, tt.want)
+			}
+		})
+	}
+}
+
+func TestWSSecure(t *testing.T) {
+	old := trustedProxies
+	defer func() {
+		trustedProxies = old
+		parseTrustedProxies()
+	}()
+	trustedProxies = []string{"10.0.0.0/8"}
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		tls    bool
+		proto  string // X-Forwarded-Proto
+		secure bool
+	}{
+		{"tls", "198.51.100.1:1234", true, "", true},
+		{"plain", "198.51.100.1:1234", false, "", false},
+		{"untrusted forwarder", "198.51.100.1:1234", false, "https", false},
+		{"trusted forwarder", "10.0.0.1:1234", false, "https", true},
+		{"trusted forwarder over http", "10.0.0.1:1234", false, "http", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if got := wsSecure(r); got != tt.secure {
+				t.Fatalf("got %v, want %v", got, tt.secure)
+			}
+		})
+	}
+}
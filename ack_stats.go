@@ -0,0 +1,58 @@
+package main
+
+import (
+	atom "sync/atomic"
+	"time"
+)
+
+// ackStats counts acked delivery of messages to clients(see replay_buffer.go).
+// latencyBuckets counts acks by the time from a message sent to it acked,
+// the upper bounds are ackLatencyBounds, the last one is unbounded.
+var ackStats struct {
+	acked           int64
+	latencySumMs    int64
+	latencyBuckets  [len(ackLatencyBounds) + 1]int64
+	retransmits     int64 // messages sent again to a resumed or binded client
+	windowOverflows int64 // messages pushed out of the window unacked
+	criticalDropped int64 // critical messages dropped unacked
+}
+
+var ackLatencyBounds = [...]time.Duration{
+	50 * time.Millisecond,
+	200 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+func addAckStats(counter *int64, n int) {
+	atom.AddInt64(counter, int64(n))
+}
+
+func observeAckLatency(d time.Duration) {
+	atom.AddInt64(&ackStats.acked, 1)
+	atom.AddInt64(&ackStats.latencySumMs, int64(d/time.Millisecond))
+	i := 0
+	for i < len(ackLatencyBounds) && d > ackLatencyBounds[i] {
+		i++
+	}
+	atom.AddInt64(&ackStats.latencyBuckets[i], 1)
+}
+
+func ackStatsSnapshot() map[string]interface{} {
+	buckets := make(map[string]int64, len(ackStats.latencyBuckets))
+	for i := range ackStats.latencyBuckets {
+		name := "+Inf"
+		if i < len(ackLatencyBounds) {
+			name = ackLatencyBounds[i].String()
+		}
+		buckets[name] = atom.LoadInt64(&ackStats.latencyBuckets[i])
+	}
+	return map[string]interface{}{
+		"acked":           atom.LoadInt64(&ackStats.acked),
+		"latencySumMs":    atom.LoadInt64(&ackStats.latencySumMs),
+		"latencyBuckets":  buckets,
+		"retransmits":     atom.LoadInt64(&ackStats.retransmits),
+		"windowOverflows": atom.LoadInt64(&ackStats.windowOverflows),
+		"criticalDropped": atom.LoadInt64(&ackStats.criticalDropped),
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net"
+	"sync"
+	atom "sync/atomic"
+	"time"
+)
+
+// Reasons of refusing a connection
+const (
+	refuseMaxConnection = iota // maxConnectionCount reached
+	refuseGlobalRate           // global accept rate exceeded
+	refuseIPRate               // accept rate of an ip exceeded
+	refuseIPConnection         // maxConnectionPerIP reached
+	refuseReasonCount
+)
+
+var refuseReasonNames = [refuseReasonCount]string{
+	"maxConnection",
+	"globalRate",
+	"ipRate",
+	"ipConnection",
+}
+
+var admissionSweepInterval = time.Minute
+
+// tokenBucket is a token bucket rate limiter. Zero or negative rate means no limit.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (t *tokenBucket) refill(now time.Time) {
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+}
+
+func (t *tokenBucket) take(now time.Time) bool {
+	if t.rate <= 0 {
+		return true
+	}
+	t.refill(now)
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+func (t *tokenBucket) isFull(now time.Time) bool {
+	t.refill(now)
+	return t.tokens >= t.burst
+}
+
+// admission decides whether a new connection is accepted.
+type admission struct {
+	mux        sync.Mutex
+	global     *tokenBucket
+	ipBuckets  map[string]*tokenBucket
+	ipConns    map[string]int
+	lastSweep  time.Time
+	refuseCnts [refuseReasonCount]int64
+	preparing  int64 // connections being prepared, not clients yet
+}
+
+func newAdmission() *admission {
+	now := time.Now()
+	return &admission{
+		global:    newTokenBucket(acceptRateGlobal, acceptBurstGlobal, now),
+		ipBuckets: make(map[string]*tokenBucket, 100),
+		ipConns:   make(map[string]int, 100),
+		lastSweep: now,
+	}
+}
+
+func (a *admission) refuse(reason int) bool {
+	atom.AddInt64(&a.refuseCnts[reason], 1)
+	return false
+}
+
+// admitGlobal checks limits which have nothing to do with the remote address.
+// Connections being prepared count against maxConnectionCount too.
+func (a *admission) admitGlobal(clientCount int) bool {
+	if clientCount+int(atom.LoadInt64(&a.preparing)) >= maxConnectionCount {
+		return a.refuse(refuseMaxConnection)
+	}
+
+	a.mux.Lock()
+	ok := a.global.take(time.Now())
+	a.mux.Unlock()
+	if !ok {
+		return a.refuse(refuseGlobalRate)
+	}
+	return true
+}
+
+// admitIP checks limits of an ip. If it returns true, releaseIP MUST be called
+// when the connection is closed.
+// A connection without ip(for example unix socket) is always admitted.
+func (a *admission) admitIP(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	key := ip.String()
+	now := time.Now()
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	a.sweep(now)
+
+	if maxConnectionPerIP > 0 && a.ipConns[key] >= maxConnectionPerIP {
+		return a.refuse(refuseIPConnection)
+	}
+
+	t, ok := a.ipBuckets[key]
+	if !ok {
+		t = newTokenBucket(acceptRatePerIP, acceptBurstPerIP, now)
+		a.ipBuckets[key] = t
+	}
+	if !t.take(now) {
+		return a.refuse(refuseIPRate)
+	}
+
+	a.ipConns[key]++
+	return true
+}
+
+// beginPrepare counts a connection admitted by admitGlobal, which is prepared(for example
+// tls handshake) before it becomes a client. endPrepare MUST be called after it is prepared.
+func (a *admission) beginPrepare() {
+	atom.AddInt64(&a.preparing, 1)
+}
+
+func (a *admission) endPrepare() {
+	atom.AddInt64(&a.preparing, -1)
+}
+
+func (a *admission) releaseIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if n := a.ipConns[key]; n > 1 {
+		a.ipConns[key] = n - 1
+	} else {
+		delete(a.ipConns, key)
+	}
+}
+
+// sweep removes buckets which are full, they are the same as new buckets.
+func (a *admission) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < admissionSweepInterval {
+		return
+	}
+	a.lastSweep = now
+
+	for k, t := range a.ipBuckets {
+		if t.isFull(now) {
+			delete(a.ipBuckets, k)
+		}
+	}
+}
+
+// refuseCounts returns count of refused connections by reason.
+func (a *admission) refuseCounts() map[string]int64 {
+	m := make(map[string]int64, refuseReasonCount)
+	for i, name := range refuseReasonNames {
+		m[name] = atom.LoadInt64(&a.refuseCnts[i])
+	}
+	return m
+}
+
+// ipConnectionCount returns count of ips which have connections.
+func (a *admission) ipConnectionCount() int {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return len(a.ipConns)
+}
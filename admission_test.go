@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		takes []time.Duration // since start
+		want  []bool
+	}{
+		{"burst", 1, 3, []time.Duration{0, 0, 0, 0}, []bool{true, true, true, false}},
+		{"refill", 2, 1, []time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond}, []bool{true, false, false, true}},
+		{"refill up to burst", 10, 2, []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, []bool{true, true, true, true, false}},
+		{"no limit", 0, 0, []time.Duration{0, 0, 0}, []bool{true, true, true}},
+		{"negative rate", -1, 0, []time.Duration{0}, []bool{true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst, start)
+			for i, d := range tt.takes {
+				if got := b.take(start.Add(d)); got != tt.want[i] {
+					t.Fatalf("take %v at %v: got %v, want %v", i, d, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionIP(t *testing.T) {
+	a1 := net.ParseIP("192.0.2.1")
+	a2 := net.ParseIP("192.0.2.2")
+	tests := []struct {
+		name      string
+		maxPerIP  int
+		burst     int
+		admits    []net.IP
+		want      []bool
+		refuseKey string
+	}{
+		{"per ip connections", 2, 100, []net.IP{a1, a1, a1, a2}, []bool{true, true, false, true}, "ipConnection"},
+		{"per ip rate", 0, 2, []net.IP{a1, a1, a1, a2}, []bool{true, true, false, true}, "ipRate"},
+		{"no ip", 1, 1, []net.IP{nil, nil, nil}, []bool{true, true, true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &maxConnectionCount, 100)
+			setGlobal(t, &maxConnectionPerIP, tt.maxPerIP)
+			setGlobal(t, &acceptRatePerIP, 0.001)
+			setGlobal(t, &acceptBurstPerIP, tt.burst)
+			a := newAdmission()
+			for i, ip := range tt.admits {
+				if got := a.admitIP(ip); got != tt.want[i] {
+					t.Fatalf("admit %v(%v): got %v, want %v", i, ip, got, tt.want[i])
+				}
+			}
+			refused := int64(0)
+			for _, ok := range tt.want {
+				if !ok {
+					refused++
+				}
+			}
+			if tt.refuseKey != "" && a.refuseCounts()[tt.refuseKey] != refused {
+				t.Fatalf("refuse counts %v", a.refuseCounts())
+			}
+		})
+	}
+}
+
+func TestAdmissionReleaseIP(t *testing.T) {
+	setGlobal(t, &maxConnectionCount, 100)
+	setGlobal(t, &maxConnectionPerIP, 1)
+	setGlobal(t, &acceptRatePerIP, 0)
+	setGlobal(t, &acceptBurstPerIP, 0)
+	a := newAdmission()
+	ip := net.ParseIP("192.0.2.1")
+	if !a.admitIP(ip) || a.admitIP(ip) {
+		t.Fatal("maxConnectionPerIP 1 not applied")
+	}
+	if a.ipConnectionCount() != 1 {
+		t.Fatalf("ipConnectionCount %v, want 1", a.ipConnectionCount())
+	}
+	a.releaseIP(ip)
+	if a.ipConnectionCount() != 0 {
+		t.Fatal("ip not released")
+	}
+	if !a.admitIP(ip) {
+		t.Fatal("ip refused after release")
+	}
+	a.releaseIP(nil)
+}
+
+func TestAdmissionGlobal(t *testing.T) {
+	setGlobal(t, &maxConnectionCount, 2)
+	setGlobal(t, &maxConnectionPerIP, 0)
+	setGlobal(t, &acceptRatePerIP, 0)
+	setGlobal(t, &acceptBurstPerIP, 0)
+	a := newAdmission()
+	a.global = newTokenBucket(1, 1, time.Now())
+
+	if a.admitGlobal(2) {
+		t.Fatal("admitted beyond maxConnectionCount")
+	}
+	if !a.admitGlobal(1) {
+		t.Fatal("refused below limits")
+	}
+	if a.admitGlobal(1) {
+		t.Fatal("admitted beyond global rate")
+	}
+	counts := a.refuseCounts()
+	if counts["maxConnection"] != 1 || counts["globalRate"] != 1 {
+		t.Fatalf("refuse counts %v", counts)
+	}
+}
+
+func TestAdmissionPreparing(t *testing.T) {
+	setGlobal(t, &maxConnectionCount, 2)
+	setGlobal(t, &maxConnectionPerIP, 0)
+	setGlobal(t, &acceptRatePerIP, 0)
+	setGlobal(t, &acceptBurstPerIP, 0)
+	a := newAdmission()
+
+	if !a.admitGlobal(0) {
+		t.Fatal("refused below limits")
+	}
+	a.beginPrepare()
+	a.beginPrepare()
+	if a.admitGlobal(0) {
+		t.Fatal("connections being prepared not counted")
+	}
+	a.endPrepare()
+	if !a.admitGlobal(0) {
+		t.Fatal("prepared connection still counted")
+	}
+}
+
+func TestAdmissionSweep(t *testing.T) {
+	setGlobal(t, &maxConnectionCount, 100)
+	setGlobal(t, &maxConnectionPerIP, 0)
+	setGlobal(t, &acceptRatePerIP, 1)
+	setGlobal(t, &acceptBurstPerIP, 1)
+	a := newAdmission()
+	ip := net.ParseIP("192.0.2.1")
+	a.admitIP(ip)
+	a.releaseIP(ip)
+
+	now := time.Now()
+	a.sweep(now.Add(admissionSweepInterval / 2))
+	if len(a.ipBuckets) != 1 {
+		t.Fatal("swept before admissionSweepInterval")
+	}
+	a.sweep(now.Add(admissionSweepInterval))
+	if len(a.ipBuckets) != 0 {
+		t.Fatal("full bucket not swept")
+	}
+}
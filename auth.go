@@ -1,6 +1,8 @@
 package main
 
 import (
+	protojson "biblio/protocol/json"
+	protopb "biblio/protocol/pb"
 	"errors"
 	twmm "github.com/ZhangGuangxu/timingwheelmm"
 	"log"
@@ -20,14 +22,19 @@ func (item authItem) Release() {
 
 type auth struct {
 	mux    sync.Mutex
-	tokens map[int64]string
+	tokens map[int64]authToken
 
 	tw *twmm.TimingWheel
 }
 
+type authToken struct {
+	token string
+	vip   int
+}
+
 func newAuth() (*auth, error) {
 	a := &auth{
-		tokens: make(map[int64]string, 100),
+		tokens: make(map[int64]authToken, 100),
 	}
 	var err error
 	a.tw, err = twmm.NewTimingWheel(itemLifetime, 120)
@@ -35,23 +42,24 @@ func newAuth() (*auth, error) {
 }
 
 // @public
-func (a *auth) addToken(uid int64, token string) {
+func (a *auth) addToken(uid int64, token string, vip int) {
 	a.tw.AddItem(authItem(uid))
 
 	a.mux.Lock()
 	defer a.mux.Unlock()
-	a.tokens[uid] = token
+	a.tokens[uid] = authToken{token: token, vip: vip}
 }
 
 // @public
-func (a *auth) checkToken(uid int64, token string) (bool, error) {
+// checkToken returns vip of the token too.
+func (a *auth) checkToken(uid int64, token string) (bool, int, error) {
 	a.mux.Lock()
 	t, ok := a.tokens[uid]
 	a.mux.Unlock()
 	if ok {
-		return t == token, nil
+		return t.token == token, t.vip, nil
 	}
-	return false, errNoToken
+	return false, 0, errNoToken
 }
 
 // @public
@@ -61,6 +69,17 @@ func (a *auth) delToken(uid int64) {
 	delete(a.tokens, uid)
 }
 
+// authRequest extracts uid and token from C2SAuth of any codec.
+func authRequest(proto interface{}) (uid int64, token string, ok bool) {
+	switch req := proto.(type) {
+	case *protojson.C2SAuth:
+		return req.UID, req.Token, true
+	case *protopb.C2SAuth:
+		return req.UID, req.Token, true
+	}
+	return 0, "", false
+}
+
 // @public
 func (a *auth) startTimingWheel() {
 	serverInst.wgAddOne()
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Names of authenticators, see authMethod.
+const (
+	authMethodMemory = "memory" // tokens registered by web-server, see acceptor_web.go
+	authMethodSigned = "signed" // tokens signed by web-server, checked without registration
+	authMethodHTTP   = "http"   // asks the account service for each C2SAuth
+)
+
+type authResult int
+
+const (
+	authPassed   authResult = iota
+	authRejected            // S2CAuth(false) is sent before the client is closed
+	authFailed              // the request can not be checked, the client is closed without reply
+)
+
+// authMeta is what an Authenticator knows about the connection of C2SAuth.
+type authMeta struct {
+	remoteAddr      net.Addr
+	transport       string // "tcp", "tls", "unix", "ws" or "rudp"
+	codec           string
+	protocolVersion int
+}
+
+// Authenticator checks C2SAuth of any codec.
+// It is called in the 'handleRead' goroutine of the client, and may block for a while.
+// vip is the priority lane of the player in the login queue(see login_queue.go), 0 is the normal one.
+// reason tells why the request is not passed, it is only logged.
+type Authenticator interface {
+	Authenticate(uid int64, token string, meta *authMeta) (authUID int64, vip int, result authResult, reason string)
+}
+
+func newAuthenticator(method string) (Authenticator, error) {
+	switch method {
+	case authMethodMemory:
+		return &memoryAuthenticator{tokens: auther}, nil
+	case authMethodSigned:
+		return newSignedAuthenticator()
+	case authMethodHTTP:
+		return newHTTPAuthenticator()
+	}
+	return nil, fmt.Errorf("auth method[%v] not found", method)
+}
+
+// memoryAuthenticator checks tokens registered in auther. A token is used only once.
+type memoryAuthenticator struct {
+	tokens *auth
+}
+
+func (a *memoryAuthenticator) Authenticate(uid int64, token string, meta *authMeta) (int64, int, authResult, string) {
+	same, vip, err := a.tokens.checkToken(uid, token)
+	if err != nil {
+		return uid, 0, authFailed, err.Error()
+	}
+
+	a.tokens.delToken(uid)
+	if !same {
+		return uid, 0, authRejected, "token not match"
+	}
+	return uid, vip, authPassed, ""
+}
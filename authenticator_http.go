@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpAuthenticator posts each C2SAuth to authHTTPURL of the account service:
+//
+//	{"uid":1001,"token":"...","remoteAddr":"1.2.3.4:5678","transport":"tcp","codec":"pb","protocolVersion":4}
+//
+// with header X-Biblio-Ts(unix time in seconds) and X-Biblio-Sign, which is
+// hex(HMAC-SHA256(authHTTPSecret, ts + "|" + body)). The account service replies:
+//
+//	{"passed":true,"uid":1001,"vip":0,"reason":""}
+//
+// with header X-Biblio-Sign, which is hex(HMAC-SHA256(authHTTPSecret, sign of request + "|" + body)),
+// so that a reply can be neither forged nor replayed for another request.
+// uid of the reply is the uid to bind, 0 means the uid of the request, which must be positive.
+// vip is optional. The client is closed without reply if the account service is not available,
+// or its reply is not signed.
+type httpAuthenticator struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+type httpAuthRequest struct {
+	UID             int64  `json:"uid"`
+	Token           string `json:"token"`
+	RemoteAddr      string `json:"remoteAddr"`
+	Transport       string `json:"transport"`
+	Codec           string `json:"codec"`
+	ProtocolVersion int    `json:"protocolVersion"`
+}
+
+type httpAuthReply struct {
+	Passed bool   `json:"passed"`
+	UID    int64  `json:"uid"`
+	VIP    int    `json:"vip"`
+	Reason string `json:"reason"`
+}
+
+// httpAuthMaxReplyLen is the max length of a reply of the account service.
+const httpAuthMaxReplyLen = 4096
+
+var errHTTPAuthReplySign = errors.New("auth service reply not signed")
+var errHTTPAuthReplyTooLong = errors.New("auth service reply too long")
+
+// httpAuthSign returns hex(HMAC-SHA256(secret, prefix + "|" + body)).
+func httpAuthSign(secret []byte, prefix string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(prefix + "|"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newHTTPAuthenticator() (*httpAuthenticator, error) {
+	if authHTTPURL == "" {
+		return nil, errors.New("authHTTPURL is empty")
+	}
+	if authHTTPSecret == "" {
+		return nil, errors.New("authHTTPSecret is empty")
+	}
+	return &httpAuthenticator{
+		url:    authHTTPURL,
+		secret: []byte(authHTTPSecret),
+		client: &http.Client{Timeout: authHTTPTimeout},
+	}, nil
+}
+
+func (a *httpAuthenticator) Authenticate(uid int64, token string, meta *authMeta) (int64, int, authResult, string) {
+	req := &httpAuthRequest{
+		UID:             uid,
+		Token:           token,
+		Transport:       meta.transport,
+		Codec:           meta.codec,
+		ProtocolVersion: meta.protocolVersion,
+	}
+	if meta.remoteAddr != nil {
+		req.RemoteAddr = meta.remoteAddr.String()
+	}
+
+	reply, err := a.post(req)
+	if err != nil {
+		return uid, 0, authFailed, err.Error()
+	}
+	if reply.UID != 0 {
+		uid = reply.UID
+	}
+	if uid <= 0 {
+		return uid, 0, authRejected, "invalid uid"
+	}
+	if !reply.Passed {
+		return uid, 0, authRejected, reply.Reason
+	}
+	return uid, reply.VIP, authPassed, ""
+}
+
+func (a *httpAuthenticator) post(req *httpAuthRequest) (*httpAuthReply, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sign := httpAuthSign(a.secret, ts, body)
+
+	r, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Biblio-Ts", ts)
+	r.Header.Set("X-Biblio-Sign", sign)
+
+	resp, err := a.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth service returns status[%v]", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, httpAuthMaxReplyLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > httpAuthMaxReplyLen {
+		return nil, errHTTPAuthReplyTooLong
+	}
+	want := httpAuthSign(a.secret, sign, data)
+	if !hmac.Equal([]byte(strings.ToLower(resp.Header.Get("X-Biblio-Sign"))), []byte(want)) {
+		return nil, errHTTPAuthReplySign
+	}
+
+	reply := &httpAuthReply{}
+	if err := json.Unmarshal(data, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
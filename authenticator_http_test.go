@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewHTTPAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		secret  string
+		wantErr bool
+	}{
+		{"ok", "http://127.0.0.1/auth", "s3cret", false},
+		{"no url", "", "s3cret", true},
+		{"no secret", "http://127.0.0.1/auth", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &authHTTPURL, tt.url)
+			setGlobal(t, &authHTTPSecret, tt.secret)
+			_, err := newHTTPAuthenticator()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPAuthenticatorSign(t *testing.T) {
+	const secret = "auth-http-secret"
+	var replySign func(requestSign string, body []byte) string // of the account service
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sign := r.Header.Get("X-Biblio-Sign")
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(r.Header.Get("X-Biblio-Ts") + "|"))
+		mac.Write(body)
+		if sign != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		req := &httpAuthRequest{}
+		json.Unmarshal(body, req)
+		reply := &httpAuthReply{Passed: req.Token != "bad", VIP: 1}
+		if req.Token == "negative" {
+			reply.UID = -1
+		}
+		data, _ := json.Marshal(reply)
+		w.Header().Set("X-Biblio-Sign", replySign(sign, data))
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	signed := func(requestSign string, body []byte) string {
+		return httpAuthSign([]byte(secret), requestSign, body)
+	}
+	tests := []struct {
+		name      string
+		secret    string
+		uid       int64
+		token     string
+		replySign func(string, []byte) string
+		want      authResult
+		wantVIP   int
+	}{
+		{"passed", secret, 1001, "good", signed, authPassed, 1},
+		{"rejected", secret, 1001, "bad", signed, authRejected, 0},
+		{"wrong secret", "web-secret", 1001, "good", signed, authFailed, 0},
+		{"reply not signed", secret, 1001, "good", func(string, []byte) string { return "" }, authFailed, 0},
+		{"reply of another request", secret, 1001, "good", func(_ string, body []byte) string {
+			return httpAuthSign([]byte(secret), "another", body)
+		}, authFailed, 0},
+		{"negative uid", secret, 1001, "negative", signed, authRejected, 0},
+		{"no uid", secret, 0, "good", signed, authRejected, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &authHTTPURL, srv.URL)
+			setGlobal(t, &authHTTPSecret, tt.secret)
+			replySign = tt.replySign
+			a, err := newHTTPAuthenticator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			uid, vip, result, reason := a.Authenticate(tt.uid, tt.token, &authMeta{transport: "tcp"})
+			if (result == authPassed && uid != tt.uid) || vip != tt.wantVIP || result != tt.want {
+				t.Fatalf("got %v %v %q, want %v %v", vip, result, reason, tt.want, tt.wantVIP)
+			}
+		})
+	}
+}
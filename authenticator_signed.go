@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signedAuthenticator checks login tokens signed by web-server, so that any gateway can check
+// them by itself. A token is "<payload>.<sign>", both are base64url without padding:
+//
+//	payload: {"uid":1001,"exp":1700000000,"sid":"gateway-1","nonce":"...","vip":0}
+//	sign: HMAC-SHA256(authSecret, payload) if authTokenAlg is "hmac-sha256",
+//	      or Ed25519 signature of payload by the private key of authPublicKey if "ed25519".
+//
+// exp is a unix time in seconds, and is not later than authTokenMaxLifetime from now.
+// uid MUST be positive. sid MUST be serverID. uid of C2SAuth is ignored if it is 0, otherwise it MUST be uid.
+// A nonce is used only once, see nonceCache. vip is optional.
+type signedAuthenticator struct {
+	verify func(payload []byte, sign []byte) bool
+	nonces *nonceCache
+}
+
+// Algorithms of signed tokens
+const (
+	authTokenAlgHMAC    = "hmac-sha256"
+	authTokenAlgEd25519 = "ed25519"
+)
+
+const authTokenMaxNonceLen = 64
+
+type signedToken struct {
+	UID   int64  `json:"uid"`
+	Exp   int64  `json:"exp"`
+	SID   string `json:"sid"`
+	Nonce string `json:"nonce"`
+	VIP   int    `json:"vip"`
+}
+
+func newSignedAuthenticator() (*signedAuthenticator, error) {
+	a := &signedAuthenticator{nonces: newNonceCache()}
+	switch authTokenAlg {
+	case authTokenAlgHMAC:
+		if authSecret == "" {
+			return nil, errors.New("authSecret is empty")
+		}
+		secret := []byte(authSecret)
+		a.verify = func(payload []byte, sign []byte) bool {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(payload)
+			return hmac.Equal(mac.Sum(nil), sign)
+		}
+	case authTokenAlgEd25519:
+		key, err := base64.StdEncoding.DecodeString(authPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid authPublicKey")
+		}
+		a.verify = func(payload []byte, sign []byte) bool {
+			return ed25519.Verify(ed25519.PublicKey(key), payload, sign)
+		}
+	default:
+		return nil, fmt.Errorf("auth token alg[%v] not found", authTokenAlg)
+	}
+	return a, nil
+}
+
+func (a *signedAuthenticator) Authenticate(uid int64, token string, meta *authMeta) (int64, int, authResult, string) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return uid, 0, authRejected, "invalid token"
+	}
+	payload := []byte(token[:dot])
+	sign, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil {
+		return uid, 0, authRejected, "invalid sign"
+	}
+	if !a.verify(payload, sign) {
+		return uid, 0, authRejected, "invalid sign"
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(token[:dot])
+	if err != nil {
+		return uid, 0, authRejected, "invalid payload"
+	}
+	t := &signedToken{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return uid, 0, authRejected, "invalid payload"
+	}
+
+	if t.UID <= 0 {
+		return uid, 0, authRejected, "invalid uid"
+	}
+	if uid != 0 && uid != t.UID {
+		return uid, 0, authRejected, "uid not match"
+	}
+	if t.SID != serverID {
+		return t.UID, 0, authRejected, "server id not match"
+	}
+	now := time.Now()
+	exp := time.Unix(t.Exp, 0)
+	if now.After(exp) {
+		return t.UID, 0, authRejected, "token expired"
+	}
+	if exp.Sub(now) > authTokenMaxLifetime {
+		return t.UID, 0, authRejected, "token lifetime too long"
+	}
+	if t.Nonce == "" || len(t.Nonce) > authTokenMaxNonceLen {
+		return t.UID, 0, authRejected, "invalid nonce"
+	}
+	if !a.nonces.add(t.Nonce, exp) {
+		return t.UID, 0, authRejected, "token used"
+	}
+	return t.UID, t.VIP, authPassed, ""
+}
+
+// nonceCache remembers nonces of tokens until the tokens expire.
+// Expired nonces are swept when a nonce is added, at most once per nonceSweepInterval.
+type nonceCache struct {
+	mux       sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+const nonceSweepInterval = 10 * time.Second
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{
+		nonces:    make(map[string]time.Time, 100),
+		lastSweep: time.Now(),
+	}
+}
+
+// add returns false if nonce is in the cache.
+func (c *nonceCache) add(nonce string, expire time.Time) bool {
+	now := time.Now()
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if now.Sub(c.lastSweep) >= nonceSweepInterval {
+		for n, e := range c.nonces {
+			if now.After(e) {
+				delete(c.nonces, n)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if e, ok := c.nonces[nonce]; ok && !now.After(e) {
+		return false
+	}
+	c.nonces[nonce] = expire
+	return true
+}
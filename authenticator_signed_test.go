@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func signTestToken(t *testing.T, tok *signedToken, sign func(payload []byte) []byte) string {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(payload)))
+}
+
+func hmacTestSign(secret string) func([]byte) []byte {
+	return func(payload []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		return mac.Sum(nil)
+	}
+}
+
+func TestSignedAuthenticator(t *testing.T) {
+	setGlobal(t, &authTokenAlg, authTokenAlgHMAC)
+	setGlobal(t, &authSecret, "secret")
+	setGlobal(t, &authPublicKey, "")
+	setGlobal(t, &serverID, "gateway-1")
+	a, err := newSignedAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := hmacTestSign("secret")
+	exp := time.Now().Add(time.Minute).Unix()
+
+	tests := []struct {
+		name   string
+		uid    int64 // of C2SAuth
+		tok    *signedToken
+		sign   func([]byte) []byte
+		result authResult
+		reason string
+	}{
+		{"passed", 1001, &signedToken{UID: 1001, Exp: exp, SID: "gateway-1", Nonce: "n1", VIP: 2}, sign, authPassed, ""},
+		{"uid from token", 0, &signedToken{UID: 1001, Exp: exp, SID: "gateway-1", Nonce: "n2"}, sign, authPassed, ""},
+		{"zero uid", 0, &signedToken{UID: 0, Exp: exp, SID: "gateway-1", Nonce: "n3"}, sign, authRejected, "invalid uid"},
+		{"negative uid", -1, &signedToken{UID: -1, Exp: exp, SID: "gateway-1", Nonce: "n4"}, sign, authRejected, "invalid uid"},
+		{"uid not match", 1002, &signedToken{UID: 1001, Exp: exp, SID: "gateway-1", Nonce: "n5"}, sign, authRejected, "uid not match"},
+		{"other server", 1001, &signedToken{UID: 1001, Exp: exp, SID: "gateway-2", Nonce: "n6"}, sign, authRejected, "server id not match"},
+		{"no server", 1001, &signedToken{UID: 1001, Exp: exp, Nonce: "n7"}, sign, authRejected, "server id not match"},
+		{"expired", 1001, &signedToken{UID: 1001, Exp: time.Now().Add(-time.Second).Unix(), SID: "gateway-1", Nonce: "n8"}, sign, authRejected, "token expired"},
+		{"lifetime too long", 1001, &signedToken{UID: 1001, Exp: time.Now().Add(authTokenMaxLifetime + time.Minute).Unix(), SID: "gateway-1", Nonce: "n9"}, sign, authRejected, "token lifetime too long"},
+		{"no nonce", 1001, &signedToken{UID: 1001, Exp: exp, SID: "gateway-1"}, sign, authRejected, "invalid nonce"},
+		{"nonce reused", 1001, &signedToken{UID: 1001, Exp: exp, SID: "gateway-1", Nonce: "n1"}, sign, authRejected, "token used"},
+		{"other secret", 1001, &signedToken{UID: 1001, Exp: exp, SID: "gateway-1", Nonce: "n10"}, hmacTestSign("other"), authRejected, "invalid sign"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, vip, result, reason := a.Authenticate(tt.uid, signTestToken(t, tt.tok, tt.sign), &authMeta{})
+			if result != tt.result || reason != tt.reason {
+				t.Fatalf("got %v %q, want %v %q", result, reason, tt.result, tt.reason)
+			}
+			if result == authPassed && (uid != tt.tok.UID || vip != tt.tok.VIP) {
+				t.Fatalf("got uid %v vip %v", uid, vip)
+			}
+		})
+	}
+}
+
+func TestSignedAuthenticatorMalformed(t *testing.T) {
+	setGlobal(t, &authTokenAlg, authTokenAlgHMAC)
+	setGlobal(t, &authSecret, "secret")
+	setGlobal(t, &authPublicKey, "")
+	setGlobal(t, &serverID, "gateway-1")
+	a, err := newSignedAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte("not json"))
+	notJSON := payload + "." + base64.RawURLEncoding.EncodeToString(hmacTestSign("secret")([]byte(payload)))
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{"no dot", "abc", "invalid token"},
+		{"bad sign encoding", "abc.!!", "invalid sign"},
+		{"not json", notJSON, "invalid payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, result, reason := a.Authenticate(1001, tt.token, &authMeta{}); result != authRejected || reason != tt.reason {
+				t.Fatalf("got %v %q, want %q", result, reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestSignedAuthenticatorEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	setGlobal(t, &authTokenAlg, authTokenAlgEd25519)
+	setGlobal(t, &authSecret, "")
+	setGlobal(t, &authPublicKey, base64.StdEncoding.EncodeToString(pub))
+	setGlobal(t, &serverID, "gateway-1")
+	a, err := newSignedAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok := &signedToken{UID: 1001, Exp: time.Now().Add(time.Minute).Unix(), SID: "gateway-1", Nonce: "n1"}
+	forged := signTestToken(t, tok, func(p []byte) []byte { return ed25519.Sign(other, p) })
+	if _, _, result, _ := a.Authenticate(1001, forged, &authMeta{}); result != authRejected {
+		t.Fatal("token signed by other key passed")
+	}
+	signed := signTestToken(t, tok, func(p []byte) []byte { return ed25519.Sign(priv, p) })
+	if _, _, result, reason := a.Authenticate(1001, signed, &authMeta{}); result != authPassed {
+		t.Fatalf("rejected: %v", reason)
+	}
+}
+
+func TestNewSignedAuthenticatorConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		alg       string
+		secret    string
+		publicKey string
+	}{
+		{"empty secret", authTokenAlgHMAC, "", ""},
+		{"invalid public key", authTokenAlgEd25519, "", "!!"},
+		{"short public key", authTokenAlgEd25519, "", base64.StdEncoding.EncodeToString(make([]byte, 16))},
+		{"unknown alg", "rsa", "secret", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &authTokenAlg, tt.alg)
+			setGlobal(t, &authSecret, tt.secret)
+			setGlobal(t, &authPublicKey, tt.publicKey)
+			setGlobal(t, &serverID, "gateway-1")
+			if _, err := newSignedAuthenticator(); err == nil {
+				t.Fatal("invalid config accepted")
+			}
+		})
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache()
+	now := time.Now()
+	if !c.add("a", now.Add(time.Minute)) || c.add("a", now.Add(time.Minute)) {
+		t.Fatal("nonce reused")
+	}
+	// an expired nonce could be used again, its token is rejected as expired anyway
+	if !c.add("b", now.Add(-time.Second)) || !c.add("b", now.Add(time.Minute)) {
+		t.Fatal("expired nonce not replaced")
+	}
+
+	c.lastSweep = now.Add(-nonceSweepInterval)
+	c.nonces["c"] = now.Add(-time.Second)
+	c.add("d", now.Add(time.Minute))
+	if _, ok := c.nonces["c"]; ok {
+		t.Fatal("expired nonce not swept")
+	}
+	if _, ok := c.nonces["a"]; !ok {
+		t.Fatal("nonce swept before it expires")
+	}
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	proto "biblio/protocol"
+	"biblio/util"
 	"errors"
 	ccq "github.com/ZhangGuangxu/circularqueue"
+	"log"
+	"net"
 	"sync"
 	atom "sync/atomic"
 )
 
 var selfHandleMsgs = map[int16]bool{
-	proto.C2SAuthID: true,
+	proto.C2SAuthID:   true,
+	proto.C2SResumeID: true,
 }
 
 func isSelfHandleMsgs(protoID int16) bool {
@@ -17,9 +21,22 @@ func isSelfHandleMsgs(protoID int16) bool {
 	return ok
 }
 
+// idempotentMsgs can be sent to player on connections open to replay(see replayProtectionRequired).
+var idempotentMsgs = map[int16]bool{
+	proto.C2SHeartbeatID: true,
+	proto.C2SAckID:       true,
+}
+
+func isResumeMsg(protoID int16) bool {
+	return protoID == proto.C2SResumeID
+}
+
 var mapProtocol2ClientHandler = map[int16](func(*Client, *message)){
 	proto.C2SAuthID: func(c *Client, msg *message) {
-		c.conn.handleAuth(msg)
+		c.handleAuth(msg)
+	},
+	proto.C2SResumeID: func(c *Client, msg *message) {
+		c.handleResume(msg)
 	},
 }
 
@@ -29,13 +46,37 @@ func dispatchMessageToClient(c *Client, msg *message) {
 	}
 }
 
+var clientIDGen int64
+
 // Client wraps communication with tcp client.
 type Client struct {
+	id int64 // 仅用于标识client，如admin接口中的展示
+
 	muxState sync.Mutex
 	state    clientState
 
 	conn connection
 
+	// codec suite of conn, messages to this client are created by suite.creater
+	suite           *codecSuite
+	protocolVersion int
+
+	// 序号检查：收到的消息序号必须是lastSeq+1。序号未经认证，只在replayProtected时才能防止重放(见frame.go)。
+	// 只由'handleRead' goroutine访问
+	lastSeq uint32
+	// 连接是TLS或加密的，帧无法被重放或篡改
+	replayProtected bool
+
+	resumeToken string // sent in S2CAuth, handed to the player when binded
+	resuming    bool   // C2SResume is received and not handled, only accessed by 'handleRead' goroutine
+
+	// 登录队列(see login_queue.go)，由loginQueue.mux保护
+	slot       bool          // a slot of playerCapacity is taken
+	queueEntry *queuedClient // waiting in the login queue
+
+	// 客户端的真实地址，在负载均衡之后时取自PROXY protocol或X-Forwarded-For
+	remoteAddr net.Addr
+
 	// Client自己处理的消息
 	selfHandleMsgs *ccq.CircularQueue
 
@@ -48,15 +89,92 @@ type Client struct {
 
 func newClient() *Client {
 	client := &Client{
-		selfHandleMsgs: ccq.NewCircularQueue(),
-		sender:         newMessageChannel(),
-		recver:         newMessageChannel(),
-		routineCnt:     2,
+		id:              atom.AddInt64(&clientIDGen, 1),
+		suite:           defaultCodecSuite,
+		protocolVersion: legacyProtocolVersion,
+		selfHandleMsgs:  ccq.NewCircularQueue(),
+		sender:          newMessageChannel(),
+		recver:          newMessageChannel(),
+		routineCnt:      2,
 	}
 	client.setState(newClientStateNotbinded(client))
 	return client
 }
 
+func (c *Client) setRemoteAddr(addr net.Addr) {
+	c.remoteAddr = addr
+}
+
+// @public
+func (c *Client) getRemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *Client) setCodecSuite(s *codecSuite) {
+	c.suite = s
+}
+
+func (c *Client) setProtocolVersion(v int) {
+	c.protocolVersion = v
+}
+
+func (c *Client) setReplayProtected(b bool) {
+	c.replayProtected = b
+}
+
+// handleAuth checks C2SAuth by the authenticator of server, and binds the client if passed.
+func (c *Client) handleAuth(msg *message) {
+	uid, token, ok := authRequest(msg.proto)
+	if !ok {
+		c.close()
+		return
+	}
+
+	meta := &authMeta{
+		remoteAddr:      c.remoteAddr,
+		transport:       c.conn.transport(),
+		codec:           c.suite.name,
+		protocolVersion: c.protocolVersion,
+	}
+	uid, vip, result, reason := serverInst.authenticator.Authenticate(uid, token, meta)
+	if result == authFailed {
+		log.Printf("client[%v] uid[%v] auth failed: %v\n", c.id, uid, reason)
+		c.close()
+		return
+	}
+
+	if result != authPassed {
+		log.Printf("client[%v] uid[%v] auth rejected: %v\n", c.id, uid, reason)
+		c.onBind()
+		c.sender.notifyClose()
+		c.recver.addMessage(c.suite.creater.createS2CAuth(false, "", 0))
+		c.recver.notifyClose()
+		return
+	}
+
+	c.resumeToken = newResumeToken()
+	c.onQueue()
+	if c.needClose() {
+		return
+	}
+	admitted, position, wait := serverInst.loginQueue.enter(c, uid, vip, serverInst.isPlayerOnline(uid))
+	if admitted {
+		c.onAdmit()
+		c.bind(uid)
+		return
+	}
+	log.Printf("client[%v] uid[%v] vip[%v] queued at %v\n", c.id, uid, vip, position)
+	if position > 0 && c.protocolVersion >= queueProtocolVersion {
+		c.recver.addMessage(c.suite.creater.createS2CQueuePosition(position, wait))
+	}
+}
+
+// bind sends S2CAuth passed, and binds the client to the player of uid.
+func (c *Client) bind(uid int64) {
+	c.recver.addMessage(c.suite.creater.createS2CAuth(true, c.resumeToken, 0))
+	serverInst.reqBind(uid, c)
+}
+
 func (c *Client) setConn(conn connection) {
 	c.conn = conn
 	c.conn.setParent(c)
@@ -80,6 +198,20 @@ func (c *Client) onBind() {
 	c.state.onBind()
 }
 
+// @public
+func (c *Client) onQueue() {
+	c.muxState.Lock()
+	defer c.muxState.Unlock()
+	c.state.onQueue()
+}
+
+// @public
+func (c *Client) onAdmit() {
+	c.muxState.Lock()
+	defer c.muxState.Unlock()
+	c.state.onAdmit()
+}
+
 // @public
 func (c *Client) onBindSuccess() {
 	c.muxState.Lock()
@@ -101,6 +233,13 @@ func (c *Client) onNewMessageToPlayer() {
 	c.state.onNewMessageToPlayer()
 }
 
+// @public
+func (c *Client) stateName() string {
+	c.muxState.Lock()
+	defer c.muxState.Unlock()
+	return c.state.name()
+}
+
 func (c *Client) close() {
 	atom.StoreInt32(&c.toClose, 1)
 }
@@ -139,13 +278,59 @@ func (c *Client) handleMsgs() error {
 	return nil
 }
 
-func (c *Client) addIncomingMessage(protoID int16, proto interface{}) {
-	msg := &message{protoID, proto}
+// acceptSeq accepts seq if it follows the last accepted one, 0 means the frame is not numbered.
+// Otherwise the client is closed with reason util.InvalidSequence, and false is returned.
+// The seq is not authenticated, so it stops replay only if c.replayProtected, see frame.go.
+func (c *Client) acceptSeq(seq uint32) bool {
+	if seq == 0 || seq != c.lastSeq+1 {
+		c.closeWithReason(util.InvalidSequence)
+		return false
+	}
+	c.lastSeq = seq
+	return true
+}
+
+// closeWithReason sends S2CClose of reason, and closes the client after it is sent.
+func (c *Client) closeWithReason(reason int8) {
+	c.sender.notifyClose()
+	c.recver.addMessage(c.suite.creater.createS2CClose(reason))
+	c.recver.notifyClose()
+}
+
+// messageBudget returns the max bytes of a fragmented or compressed message in current state.
+func (c *Client) messageBudget() int {
+	c.muxState.Lock()
+	defer c.muxState.Unlock()
+	return c.state.messageBudget()
+}
+
+// setLastSeq makes the client continue the sequence numbers of a resumed session.
+// It MUST be called by 'handleRead' goroutine, before later frames are unpacked.
+func (c *Client) setLastSeq(seq uint32) {
+	c.lastSeq = seq
+}
+
+func (c *Client) addIncomingMessage(protoID int16, proto interface{}, seq uint32) {
+	msg := &message{protoID: protoID, proto: proto, seq: seq}
+	if c.resuming {
+		// nothing is allowed before the session is resumed
+		c.close()
+		return
+	}
+	if isResumeMsg(protoID) {
+		c.resuming = true
+	}
 	if isSelfHandleMsgs(protoID) {
 		c.selfHandleMsgs.Push(msg)
 		return
 	}
 
+	if replayProtectionRequired && !c.replayProtected && !idempotentMsgs[protoID] {
+		// a captured frame could be sent again, even in another connection
+		c.closeWithReason(util.ReplayProtectionRequired)
+		return
+	}
+
 	c.onNewMessageToPlayer()
 	c.sender.addMessage(msg)
 }
@@ -2,9 +2,15 @@ package main
 
 type clientState interface {
 	onBind()
+	onQueue()
+	onAdmit()
 	onBindSuccess()
 	onTimeout()
 	onNewMessageToPlayer()
+	// messageBudget returns the max bytes of a fragmented or compressed message from client,
+	// after reassembly and decompression. 0 means such messages are not accepted.
+	messageBudget() int
+	name() string
 }
 
 // clientStateNotbinded
@@ -29,11 +35,60 @@ func (s *clientStateNotbinded) onBind() {
 
 	s.client.setState(newClientStateBinding(s.client))
 }
+func (s *clientStateNotbinded) onQueue() {
+	// 取消等待auth消息接收超时，改为等待登录队列超时
+	serverInst.stopWaitAuth(s.item)
+
+	s.client.setState(newClientStateQueued(s.client))
+}
+func (s *clientStateNotbinded) onAdmit()       {}
 func (s *clientStateNotbinded) onBindSuccess() {}
 func (s *clientStateNotbinded) onTimeout() {
 	s.client.close()
 }
 func (s *clientStateNotbinded) onNewMessageToPlayer() {}
+func (s *clientStateNotbinded) messageBudget() int    { return 0 }
+func (s *clientStateNotbinded) name() string          { return "notbinded" }
+
+// clientStateQueued: auth passed, waiting in the login queue(see login_queue.go)
+type clientStateQueued struct {
+	client *Client
+	item   *clientQueuedTimeoutItem
+}
+
+func newClientStateQueued(c *Client) *clientStateQueued {
+	s := &clientStateQueued{
+		client: c,
+	}
+	s.item = &clientQueuedTimeoutItem{c}
+	// 等待登录队列超时，超时后client被关闭，并离开队列
+	serverInst.waitInQueue(s.item)
+	return s
+}
+
+func (s *clientStateQueued) onBind() {
+	serverInst.stopWaitInQueue(s.item)
+
+	s.client.close()
+}
+func (s *clientStateQueued) onQueue() {
+	serverInst.stopWaitInQueue(s.item)
+
+	s.client.close()
+}
+func (s *clientStateQueued) onAdmit() {
+	// 取消等待登录队列超时
+	serverInst.stopWaitInQueue(s.item)
+
+	s.client.setState(newClientStateBinding(s.client))
+}
+func (s *clientStateQueued) onBindSuccess() {}
+func (s *clientStateQueued) onTimeout() {
+	s.client.close()
+}
+func (s *clientStateQueued) onNewMessageToPlayer() {}
+func (s *clientStateQueued) messageBudget() int    { return 0 }
+func (s *clientStateQueued) name() string          { return "queued" }
 
 // clientStateBinding
 type clientStateBinding struct {
@@ -54,6 +109,10 @@ func newClientStateBinding(c *Client) *clientStateBinding {
 func (s *clientStateBinding) onBind() {
 	s.client.close()
 }
+func (s *clientStateBinding) onQueue() {
+	s.client.close()
+}
+func (s *clientStateBinding) onAdmit() {}
 func (s *clientStateBinding) onBindSuccess() {
 	// 取消等待binding超时
 	serverInst.stopWaitClientBinding(s.item)
@@ -64,6 +123,8 @@ func (s *clientStateBinding) onTimeout() {
 	s.client.close()
 }
 func (s *clientStateBinding) onNewMessageToPlayer() {}
+func (s *clientStateBinding) messageBudget() int    { return 0 }
+func (s *clientStateBinding) name() string          { return "binding" }
 
 // clientStateBinded
 type clientStateBinded struct {
@@ -87,6 +148,12 @@ func (s *clientStateBinded) onBind() {
 
 	s.client.close()
 }
+func (s *clientStateBinded) onQueue() {
+	serverInst.stopWaitClientTimeout(s.item)
+
+	s.client.close()
+}
+func (s *clientStateBinded) onAdmit()       {}
 func (s *clientStateBinded) onBindSuccess() {}
 func (s *clientStateBinded) onTimeout() {
 	s.client.close()
@@ -95,3 +162,5 @@ func (s *clientStateBinded) onNewMessageToPlayer() {
 	// 等待“长时间未收到客户端消息”的情况(更新timingwheel)。
 	serverInst.waitClientTimeout(s.item)
 }
+func (s *clientStateBinded) messageBudget() int { return messageBudgetBinded }
+func (s *clientStateBinded) name() string       { return "binded" }
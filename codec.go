@@ -1,21 +1,86 @@
 package main
 
 import (
+	proto "biblio/protocol"
+	protojson "biblio/protocol/json"
+	protopb "biblio/protocol/pb"
+	"errors"
+	"fmt"
 	"github.com/ZhangGuangxu/netbuffer"
 )
 
+var errInvalidMsgLength = errors.New("invalid message length")
+var errChecksumNotMatch = errors.New("checksum not match")
+
 const (
-	headerByteCount   = 4
-	protoIDByteCount  = 2
-	maxDataLen        = 64 * 1024 * 1024
-	checkSumByteCount = 4
-	minDataLen        = protoIDByteCount + checkSumByteCount
+	headerByteCount  = 4
+	protoIDByteCount = 2
+	maxFrameLen      = 16 * 1024       // of frames from client, see frame.go
+	maxMessageLen    = 4 * 1024 * 1024 // of messages reassembled or decompressed
 )
 
 // Codec is a interface that groups Encode,Decode methods and so on.
 type Codec interface {
 	Unpack(buf *netbuffer.Buffer, client *Client) error
 	Pack(msg *message) ([]byte, error)
+	PackBatch(msgs []*message) ([]byte, error)
 	Decode(protoID int16, data []byte) (proto interface{}, err error)
 	Encode(proto interface{}) (data []byte, err error)
 }
+
+// Names of codecs
+const (
+	codecNameJSON    = "json"
+	codecNamePB      = "pb"
+	codecNameMsgpack = "msgpack"
+)
+
+// codecSuite groups a codec with the ProtoFactory and MessageCreater of its protocols.
+// Protocol instances decoded by the codec MUST be released to factory,
+// and messages sent by the codec MUST be created by creater.
+type codecSuite struct {
+	name       string
+	newCodec   func(f *framer) Codec
+	factory    proto.ProtoFactory
+	creater    MessageCreater
+	minVersion int // supported protocol versions
+	maxVersion int
+}
+
+var codecSuites = map[string]*codecSuite{
+	codecNameJSON: &codecSuite{
+		name:       codecNameJSON,
+		newCodec:   func(f *framer) Codec { return newJSONCodec(f) },
+		factory:    protojson.ProtoFactory,
+		creater:    jsonCreater,
+		minVersion: 1,
+		maxVersion: proto.Version,
+	},
+	codecNamePB: &codecSuite{
+		name:       codecNamePB,
+		newCodec:   func(f *framer) Codec { return newPBCodec(f) },
+		factory:    protopb.ProtoFactory,
+		creater:    pbCreater,
+		minVersion: 1,
+		maxVersion: proto.Version,
+	},
+	// msgpack shares protocols with json
+	codecNameMsgpack: &codecSuite{
+		name:       codecNameMsgpack,
+		newCodec:   func(f *framer) Codec { return newMsgpackCodec(f) },
+		factory:    protojson.ProtoFactory,
+		creater:    jsonCreater,
+		minVersion: 1,
+		maxVersion: proto.Version,
+	},
+}
+
+var defaultCodecSuite = codecSuites[codecNameJSON]
+
+// getCodecSuite returns a codec suite by name.
+func getCodecSuite(name string) (*codecSuite, error) {
+	if s, ok := codecSuites[name]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("codec[%v] not supported", name)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	proto "biblio/protocol"
+	protojson "biblio/protocol/json"
+	protopb "biblio/protocol/pb"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestCodecWire encodes protocols to known bytes of each codec, and decodes them back.
+func TestCodecWire(t *testing.T) {
+	tests := []struct {
+		codec   string
+		protoID int16
+		proto   interface{}
+		wire    []byte
+	}{
+		{codecNameJSON, proto.C2SAuthID, &protojson.C2SAuth{UID: 1001, Token: "abc"},
+			[]byte(`{"uid":1001,"token":"abc"}`)},
+		{codecNameJSON, proto.S2CCloseID, &protojson.S2CClose{Reason: 3},
+			[]byte(`{"reason":3}`)},
+		{codecNamePB, proto.C2SAuthID, &protopb.C2SAuth{UID: 1001, Token: "abc"},
+			[]byte{0x08, 0xe9, 0x07, 0x12, 0x03, 'a', 'b', 'c'}},
+		{codecNamePB, proto.S2CCloseID, &protopb.S2CClose{Reason: 3},
+			[]byte{0x08, 0x03}},
+		{codecNamePB, proto.C2SHeartbeatID, &protopb.C2SHeartbeat{}, nil},
+		// fixmap of 2: fixstr "uid", uint16 1001, fixstr "token", fixstr "abc"
+		{codecNameMsgpack, proto.C2SAuthID, &protojson.C2SAuth{UID: 1001, Token: "abc"},
+			[]byte{0x82, 0xa3, 'u', 'i', 'd', 0xcd, 0x03, 0xe9, 0xa5, 't', 'o', 'k', 'e', 'n', 0xa3, 'a', 'b', 'c'}},
+		{codecNameMsgpack, proto.S2CCloseID, &protojson.S2CClose{Reason: 3},
+			[]byte{0x81, 0xa6, 'r', 'e', 'a', 's', 'o', 'n', 0x03}},
+		{codecNameMsgpack, proto.C2SHeartbeatID, &protojson.C2SHeartbeat{}, []byte{0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec+"/"+reflect.TypeOf(tt.proto).Elem().Name(), func(t *testing.T) {
+			suite, err := getCodecSuite(tt.codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			codec := suite.newCodec(newFramer(frameV2))
+
+			data, err := codec.Encode(tt.proto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.wire) {
+				t.Fatalf("encoded % x, want % x", data, tt.wire)
+			}
+			got, err := codec.Decode(tt.protoID, tt.wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.proto) {
+				t.Fatalf("decoded %+v, want %+v", got, tt.proto)
+			}
+		})
+	}
+}
+
+func TestCodecDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		codec   string
+		protoID int16
+		data    []byte
+	}{
+		{codecNameJSON, proto.C2SAuthID, []byte(`{"uid":`)},
+		{codecNameJSON, 9999, []byte(`{}`)},
+		{codecNamePB, proto.C2SAuthID, []byte{0x12, 0x05, 'a'}},
+		{codecNamePB, 9999, nil},
+		{codecNameMsgpack, proto.C2SAuthID, []byte(`{"uid":1001,"token":"abc"}`)},
+		{codecNameMsgpack, proto.C2SAuthID, []byte{0x82, 0xa3, 'u'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			suite, _ := getCodecSuite(tt.codec)
+			if _, err := suite.newCodec(newFramer(frameV2)).Decode(tt.protoID, tt.data); err == nil {
+				t.Fatalf("% x decoded", tt.data)
+			}
+		})
+	}
+}
@@ -4,5 +4,5 @@ type connection interface {
 	setParent(interface{})
 	handleRead()
 	handleWrite()
-	handleAuth(*message)
+	transport() string // name of the transport, see authMeta
 }
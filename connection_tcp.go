@@ -1,11 +1,12 @@
 package main
 
 import (
-	protojson "biblio/protocol/json"
+	"crypto/tls"
 	"github.com/ZhangGuangxu/netbuffer"
 	"io"
 	"log"
 	"net"
+	"sync"
 	atom "sync/atomic"
 	"time"
 )
@@ -15,28 +16,56 @@ const (
 	takeMsgDuration           = 5 * time.Millisecond
 	handleOutgoingMsgDuration = 50 * time.Millisecond
 	writeDataDuration         = 50 * time.Millisecond
+	tlsWriteDataDuration      = 5 * time.Second
 	tryTakeAllMsgDuration     = 2 * time.Second
 	tryWriteAllDataDuration   = 5 * time.Second
+
+	readBufferSize = maxFrameLen
 )
 
+// readBufPool holds buffers for reading when incoming is full,
+// so connections do not keep a big buffer each.
+var readBufPool = sync.Pool{New: func() interface{} { return make([]byte, readBufferSize) }}
+
+// closeReader is implemented by *net.TCPConn, *net.UnixConn.
+type closeReader interface {
+	CloseRead() error
+}
+
+// closeWriter is implemented by *net.TCPConn, *net.UnixConn, *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// tcpConnection is a connection over a byte stream, for example
+// *net.TCPConn or *tls.Conn.
 type tcpConnection struct {
-	conn *net.TCPConn
+	conn net.Conn
+
+	// After a Write has timed out, the state of a *tls.Conn is corrupt.
+	// So tls connection writes with a long deadline, and timeout is an error.
+	secure bool
+
+	halfClosed int32 // read/write halves closed, close conn when both closed
 
 	client *Client
 
-	codec Codec
+	// Codec chosen by the handshake, stored by 'handleRead' goroutine and loaded by 'handleWrite' goroutine
+	codec atom.Value
 
 	incoming *netbuffer.Buffer // 接收网络数据的缓冲区
 	outgoing *netbuffer.Buffer // 将要发送的网络数据的缓冲区
+	batch    outBatch
 
 	timer               *time.Timer
 	handleOutgoingTimer *time.Timer
 }
 
-func newTCPConnection(c *net.TCPConn) *tcpConnection {
+func newTCPConnection(c net.Conn) *tcpConnection {
+	_, secure := c.(*tls.Conn)
 	return &tcpConnection{
 		conn:                c,
-		codec:               newJSONCodec(),
+		secure:              secure,
 		incoming:            netbuffer.NewBuffer(),
 		outgoing:            netbuffer.NewBuffer(),
 		timer:               time.NewTimer(0 * time.Second),
@@ -50,20 +79,49 @@ func (t *tcpConnection) setParent(parent interface{}) {
 	}
 }
 
+func (t *tcpConnection) transport() string {
+	if t.secure {
+		return "tls"
+	}
+	if _, ok := t.conn.(*net.UnixConn); ok {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (t *tcpConnection) closeRead() {
+	if c, ok := t.conn.(closeReader); ok {
+		c.CloseRead()
+	}
+	t.closeHalf()
+}
+
+func (t *tcpConnection) closeWrite() {
+	if c, ok := t.conn.(closeWriter); ok {
+		c.CloseWrite()
+	}
+	t.closeHalf()
+}
+
+func (t *tcpConnection) closeHalf() {
+	if atom.AddInt32(&t.halfClosed, 1) == 2 {
+		t.conn.Close()
+	}
+}
+
 func (t *tcpConnection) handleRead() {
 	client := t.client
 	conn := t.conn
 	incoming := t.incoming
-	codec := t.codec
 
 	defer serverInst.wgDone()
 	defer serverInst.removeClient(client)
 	defer atom.AddInt32(&client.routineCnt, -1)
-	defer conn.CloseRead()
+	defer t.closeRead()
 	defer client.sender.notifyClientReadClosed()
 
-	tmpBuf := make([]byte, maxDataLen)
 	var eof bool
+	var codec Codec
 
 	for {
 		if needQuit() {
@@ -81,13 +139,18 @@ func (t *tcpConnection) handleRead() {
 		if incoming.WritableBytes() > 0 {
 			buf = incoming.WritableByteSlice()
 		} else {
-			buf = tmpBuf
+			buf = readBufPool.Get().([]byte)
 			useTmpBuf = true
 		}
 
 		conn.SetReadDeadline(time.Now().Add(readDuration))
 		n, err := conn.Read(buf)
 		conn.SetReadDeadline(time.Time{})
+		if useTmpBuf {
+			// ATTENTION: MUST specify the end index(here is n) of 'buf'!
+			incoming.Append(buf[:n])
+			readBufPool.Put(buf)
+		}
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 				// nothing to do
@@ -100,17 +163,31 @@ func (t *tcpConnection) handleRead() {
 			}
 		}
 		if n > 0 {
-			if useTmpBuf {
-				// ATTENTION: MUST specify the end index(here is n) of 'buf'!
-				incoming.Append(buf[:n])
+			if codec == nil {
+				c, done, err := handleHandshake(client, incoming, t.secure)
+				if err == errHandshakeRejected {
+					break
+				} else if err != nil {
+					client.close()
+					log.Println(err)
+					break
+				}
+				if done {
+					codec = c
+					t.codec.Store(codec)
+				}
 			}
-			if err := codec.Unpack(incoming, client); err != nil {
-				client.close()
-				log.Println(err)
-				break
-			}
-			if err := client.handleMsgs(); err != nil {
-				break
+			if codec != nil {
+				if err := codec.Unpack(incoming, client); err == errSequenceRejected {
+					break
+				} else if err != nil {
+					client.close()
+					log.Println(err)
+					break
+				}
+				if err := client.handleMsgs(); err != nil {
+					break
+				}
 			}
 		}
 		if eof {
@@ -120,41 +197,13 @@ func (t *tcpConnection) handleRead() {
 	}
 }
 
-func (t *tcpConnection) handleAuth(msg *message) {
-	c := t.client
-
-	req, ok := msg.proto.(*protojson.C2SAuth)
-	if !ok {
-		c.close()
-		return
-	}
-
-	same, err := auther.checkToken(req.UID, req.Token)
-	if err != nil {
-		c.close()
-		return
-	}
-
-	auther.delToken(req.UID)
-	c.onBind()
-	if same {
-		c.recver.addMessage(messageCreater.createS2CAuth(true))
-		serverInst.reqBind(req.UID, c)
-	} else {
-		c.sender.notifyClose()
-		c.recver.addMessage(messageCreater.createS2CAuth(false))
-		c.recver.notifyClose()
-	}
-}
-
 func (t *tcpConnection) handleWrite() {
 	client := t.client
-	conn := t.conn
 
 	defer serverInst.wgDone()
 	defer serverInst.removeClient(client)
 	defer atom.AddInt32(&client.routineCnt, -1)
-	defer conn.CloseWrite()
+	defer t.closeWrite()
 	defer client.recver.notifyClientWriteClosed()
 
 	for {
@@ -177,7 +226,11 @@ func (t *tcpConnection) handleWrite() {
 			break
 		}
 
-		if err := t.tryWrite(writeDataDuration); err != nil {
+		d := writeDataDuration
+		if t.secure {
+			d = tlsWriteDataDuration
+		}
+		if err := t.tryWrite(d); err != nil {
 			break
 		}
 	}
@@ -193,7 +246,6 @@ func (t *tcpConnection) tryWriteAllLeftData() error {
 
 func (t *tcpConnection) handleOutgoingMessage(d time.Duration) error {
 	client := t.client
-	codec := t.codec
 	outgoing := t.outgoing
 	handleTimer := t.handleOutgoingTimer
 	handleTimer.Reset(d)
@@ -203,22 +255,48 @@ func (t *tcpConnection) handleOutgoingMessage(d time.Duration) error {
 		timer.Reset(takeMsgDuration)
 		msg := client.recver.takeMessage(timer)
 		if msg != nil {
-			data, err := codec.Pack(msg)
-			if err != nil {
-				client.close()
-				return err
+			if raw, ok := msg.proto.(rawFrame); ok {
+				if err := t.flushBatch(); err != nil {
+					return err
+				}
+				outgoing.Append(raw)
+			} else {
+				t.batch.add(msg)
 			}
-			outgoing.Append(data)
+		}
+		if t.batch.isFull() {
+			stopTimer(handleTimer)
+			return t.flushBatch()
 		}
 
 		select {
 		case <-handleTimer.C:
-			return nil
+			return t.flushBatch()
 		default:
 		}
 	}
 }
 
+// flushBatch packs the batch into outgoing.
+func (t *tcpConnection) flushBatch() error {
+	if t.batch.isEmpty() {
+		return nil
+	}
+	codec, _ := t.codec.Load().(Codec)
+	if codec == nil {
+		// only S2CClose could be sent before the handshake, the client can not decode it anyway
+		t.batch.drop()
+		return nil
+	}
+	data, err := t.batch.pack(codec)
+	if err != nil {
+		t.client.close()
+		return err
+	}
+	t.outgoing.Append(data)
+	return nil
+}
+
 func (t *tcpConnection) tryWrite(d time.Duration) error {
 	if t.outgoing.ReadableBytes() <= 0 {
 		return nil
@@ -232,7 +310,7 @@ func (t *tcpConnection) tryWrite(d time.Duration) error {
 	n, err := conn.Write(outgoing.PeekAllAsByteSlice())
 	conn.SetWriteDeadline(time.Time{})
 	if err != nil {
-		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() && !t.secure {
 			// nothing to do
 		} else {
 			client.close()
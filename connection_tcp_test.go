@@ -0,0 +1,28 @@
+package main
+
+import (
+	"biblio/util"
+	"net"
+	"testing"
+)
+
+func TestTCPConnectionFlushBatch(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	conn := newTCPConnection(s)
+	client := newClient()
+	conn.setParent(client)
+
+	// before the handshake, there is no codec to pack messages
+	conn.batch.add(client.suite.creater.createS2CClose(util.ServerClosed))
+	if err := conn.flushBatch(); err != nil || !conn.batch.isEmpty() || conn.outgoing.ReadableBytes() != 0 {
+		t.Fatal("batch packed before the handshake")
+	}
+
+	conn.codec.Store(client.suite.newCodec(newFramer(frameV2)))
+	conn.batch.add(client.suite.creater.createS2CClose(util.ServerClosed))
+	if err := conn.flushBatch(); err != nil || conn.outgoing.ReadableBytes() == 0 {
+		t.Fatalf("batch not packed: %v", err)
+	}
+}
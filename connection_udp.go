@@ -0,0 +1,231 @@
+package main
+
+import (
+	"github.com/ZhangGuangxu/netbuffer"
+	"log"
+	atom "sync/atomic"
+	"time"
+)
+
+const (
+	udpReadBufferSize = 64 * 1024
+)
+
+// udpConnection is a connection over a rudp session.
+type udpConnection struct {
+	sess *rudpSession
+
+	halfClosed int32 // read/write halves closed, close session when both closed
+
+	client *Client
+
+	// Codec chosen by the handshake, stored by 'handleRead' goroutine and loaded by 'handleWrite' goroutine
+	codec atom.Value
+
+	incoming *netbuffer.Buffer // 接收网络数据的缓冲区
+	batch    outBatch
+
+	timer               *time.Timer
+	handleOutgoingTimer *time.Timer
+}
+
+func newUDPConnection(s *rudpSession) *udpConnection {
+	return &udpConnection{
+		sess:                s,
+		incoming:            netbuffer.NewBuffer(),
+		timer:               time.NewTimer(0 * time.Second),
+		handleOutgoingTimer: time.NewTimer(0 * time.Second),
+	}
+}
+
+func (u *udpConnection) setParent(parent interface{}) {
+	if p, ok := parent.(*Client); ok {
+		u.client = p
+	}
+}
+
+func (u *udpConnection) transport() string {
+	return "rudp"
+}
+
+func (u *udpConnection) closeHalf() {
+	if atom.AddInt32(&u.halfClosed, 1) == 2 {
+		u.sess.close()
+	}
+}
+
+func (u *udpConnection) handleRead() {
+	client := u.client
+	sess := u.sess
+	incoming := u.incoming
+
+	defer serverInst.wgDone()
+	defer serverInst.removeClient(client)
+	defer atom.AddInt32(&client.routineCnt, -1)
+	defer u.closeHalf()
+	defer client.sender.notifyClientReadClosed()
+
+	buf := make([]byte, udpReadBufferSize)
+	t := time.NewTimer(0 * time.Second)
+	var codec Codec
+
+	for {
+		if needQuit() {
+			break
+		}
+		if client.needClose() {
+			break
+		}
+		if client.sender.shouldClose() {
+			break
+		}
+
+		t.Reset(readDuration)
+		n, err := sess.read(buf, t)
+		if err != nil {
+			client.close()
+			break
+		}
+		if n > 0 {
+			incoming.Append(buf[:n])
+			if codec == nil {
+				c, done, err := handleHandshake(client, incoming, false)
+				if err == errHandshakeRejected {
+					break
+				} else if err != nil {
+					client.close()
+					log.Println(err)
+					break
+				}
+				if done {
+					codec = c
+					u.codec.Store(codec)
+				}
+			}
+			if codec != nil {
+				if err := codec.Unpack(incoming, client); err == errSequenceRejected {
+					break
+				} else if err != nil {
+					client.close()
+					log.Println(err)
+					break
+				}
+				if err := client.handleMsgs(); err != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (u *udpConnection) handleWrite() {
+	client := u.client
+
+	defer serverInst.wgDone()
+	defer serverInst.removeClient(client)
+	defer atom.AddInt32(&client.routineCnt, -1)
+	defer u.closeHalf()
+	defer client.recver.notifyClientWriteClosed()
+
+	for {
+		if needQuit() {
+			break
+		}
+		if client.needClose() {
+			break
+		}
+		if client.recver.shouldClose() {
+			u.tryWriteAllLeftData()
+			break
+		}
+
+		if client.recver.isBindSuccess() {
+			client.onBindSuccess()
+		}
+
+		if err := u.handleOutgoingMessage(handleOutgoingMsgDuration); err != nil {
+			break
+		}
+	}
+}
+
+// tryWriteAllLeftData waits until the peer acknowledges all data, or timeout.
+func (u *udpConnection) tryWriteAllLeftData() error {
+	if err := u.handleOutgoingMessage(tryTakeAllMsgDuration); err != nil {
+		return err
+	}
+
+	t := u.handleOutgoingTimer
+	t.Reset(tryWriteAllDataDuration)
+	for u.sess.pendingBytes() > 0 && !u.sess.isClosed() {
+		select {
+		case <-t.C:
+			return nil
+		case <-time.After(rudpInterval):
+		}
+	}
+	return nil
+}
+
+// handleOutgoingMessage packs messages and hands them to the session,
+// which sends them in the session update goroutine.
+func (u *udpConnection) handleOutgoingMessage(d time.Duration) error {
+	client := u.client
+	sess := u.sess
+	handleTimer := u.handleOutgoingTimer
+	handleTimer.Reset(d)
+	timer := u.timer
+
+	for {
+		timer.Reset(takeMsgDuration)
+		msg := client.recver.takeMessage(timer)
+		if msg != nil {
+			if raw, ok := msg.proto.(rawFrame); ok {
+				if err := u.flushBatch(); err != nil {
+					return err
+				}
+				if err := sess.write(raw); err != nil {
+					client.close()
+					log.Println(err)
+					return err
+				}
+			} else {
+				u.batch.add(msg)
+			}
+		}
+		if u.batch.isFull() {
+			stopTimer(handleTimer)
+			return u.flushBatch()
+		}
+
+		select {
+		case <-handleTimer.C:
+			return u.flushBatch()
+		default:
+		}
+	}
+}
+
+// flushBatch packs the batch and hands it to the session.
+func (u *udpConnection) flushBatch() error {
+	if u.batch.isEmpty() {
+		return nil
+	}
+	codec, _ := u.codec.Load().(Codec)
+	if codec == nil {
+		// only S2CClose could be sent before the handshake, the client can not decode it anyway
+		u.batch.drop()
+		return nil
+	}
+	data, err := u.batch.pack(codec)
+	if err != nil {
+		u.client.close()
+		return err
+	}
+	if err := u.sess.write(data); err != nil {
+		u.client.close()
+		log.Println(err)
+		return err
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	protojson "biblio/protocol/json"
 	ccq "github.com/ZhangGuangxu/circularqueue"
 	"github.com/ZhangGuangxu/netbuffer"
 	ws "github.com/gorilla/websocket"
@@ -34,18 +33,23 @@ type wsConnection struct {
 
 	codec Codec
 
+	// permessage-deflate is negotiated, messages not smaller than
+	// wsCompressionThreshold are compressed.
+	compress bool
+
 	incoming *netbuffer.Buffer // 接收网络数据的缓冲区
 	outgoing *ccq.CircularQueue
+	batch    outBatch // packed in one websocket message
 
 	ticker    *time.Ticker
 	timer     *time.Timer
 	loopTimer *time.Timer
 }
 
-func newWSConnection(c *ws.Conn) *wsConnection {
+func newWSConnection(c *ws.Conn, codec Codec) *wsConnection {
 	return &wsConnection{
 		conn:      c,
-		codec:     newJSONCodec(),
+		codec:     codec,
 		incoming:  netbuffer.NewBuffer(),
 		outgoing:  ccq.NewCircularQueue(),
 		ticker:    time.NewTicker(pingPeriod),
@@ -60,6 +64,10 @@ func (w *wsConnection) setParent(parent interface{}) {
 	}
 }
 
+func (w *wsConnection) transport() string {
+	return "ws"
+}
+
 func (w *wsConnection) handleRead() {
 	client := w.client
 	conn := w.conn
@@ -82,7 +90,7 @@ func (w *wsConnection) handleRead() {
 		return false
 	}
 
-	conn.SetReadLimit(maxDataLen)
+	conn.SetReadLimit(maxFrameLen)
 	conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.SetPongHandler(func(string) error {
 		if shouldQuit() {
@@ -115,7 +123,9 @@ func (w *wsConnection) handleRead() {
 		}
 		incoming.Append(data)
 
-		if err := codec.Unpack(incoming, client); err != nil {
+		if err := codec.Unpack(incoming, client); err == errSequenceRejected {
+			break
+		} else if err != nil {
 			client.close()
 			log.Println(err)
 			break
@@ -126,33 +136,6 @@ func (w *wsConnection) handleRead() {
 	}
 }
 
-func (w *wsConnection) handleAuth(msg *message) {
-	c := w.client
-
-	req, ok := msg.proto.(*protojson.C2SAuth)
-	if !ok {
-		c.close()
-		return
-	}
-
-	same, err := auther.checkToken(req.UID, req.Token)
-	if err != nil {
-		c.close()
-		return
-	}
-
-	auther.delToken(req.UID)
-	c.onBind()
-	if same {
-		c.recver.addMessage(messageCreater.createS2CAuth(true))
-		serverInst.reqBind(req.UID, c)
-	} else {
-		c.sender.notifyClose()
-		c.recver.addMessage(messageCreater.createS2CAuth(false))
-		c.recver.notifyClose()
-	}
-}
-
 func (w *wsConnection) handleWrite() {
 	client := w.client
 	conn := w.conn
@@ -201,6 +184,9 @@ func (w *wsConnection) tryWriteAllLeftData() error {
 		if err := w.handleOneMessage(); err != nil {
 			return err
 		}
+		if err := w.flushBatch(); err != nil {
+			return err
+		}
 
 		if err := w.writeOnce(); err != nil {
 			return err
@@ -222,10 +208,14 @@ func (w *wsConnection) handleOutgoingMessage() error {
 		if err := w.handleOneMessage(); err != nil {
 			return err
 		}
+		if w.batch.isFull() {
+			stopTimer(t)
+			return w.flushBatch()
+		}
 
 		select {
 		case <-t.C:
-			return nil
+			return w.flushBatch()
 		default:
 		}
 	}
@@ -233,8 +223,6 @@ func (w *wsConnection) handleOutgoingMessage() error {
 
 func (w *wsConnection) handleOneMessage() error {
 	client := w.client
-	codec := w.codec
-	outgoing := w.outgoing
 	timer := w.timer
 	timer.Reset(wsTakeMsgDuration)
 
@@ -243,12 +231,22 @@ func (w *wsConnection) handleOneMessage() error {
 		return nil
 	}
 
-	data, err := codec.Pack(msg)
+	w.batch.add(msg)
+	return nil
+}
+
+// flushBatch packs the batch into a websocket message.
+func (w *wsConnection) flushBatch() error {
+	if w.batch.isEmpty() {
+		return nil
+	}
+	data, err := w.batch.pack(w.codec)
 	if err != nil {
-		client.close()
+		w.client.close()
 		return err
 	}
-	outgoing.Push(data)
+	// data is valid until the next pack, so copy it
+	w.outgoing.Push(append([]byte(nil), data...))
 	return nil
 }
 
@@ -284,21 +282,30 @@ func (w *wsConnection) writeOnce() error {
 
 	client := w.client
 	conn := w.conn
-	conn.SetWriteDeadline(time.Now().Add(writeWait))
-	writer, err := conn.NextWriter(ws.BinaryMessage)
+	data, err := outgoing.Peek()
 	if err != nil {
 		log.Println(err)
 		client.close()
 		return err
 	}
-	data, err := outgoing.Peek()
-	if err != nil {
+	s, ok := data.([]byte)
+	if !ok {
 		log.Println(err)
 		client.close()
 		return err
 	}
-	s, ok := data.([]byte)
-	if !ok {
+
+	compress := w.compress && len(s) >= wsCompressionThreshold
+	conn.EnableWriteCompression(compress)
+	cc := countingConnOf(conn.UnderlyingConn())
+	var written int64
+	if compress && cc != nil {
+		written = cc.writtenBytes()
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	writer, err := conn.NextWriter(ws.BinaryMessage)
+	if err != nil {
 		log.Println(err)
 		client.close()
 		return err
@@ -314,6 +321,10 @@ func (w *wsConnection) writeOnce() error {
 		return err
 	}
 	outgoing.Retrieve()
+
+	if compress && cc != nil {
+		addWSCompressStats(len(s), cc.writtenBytes()-written)
+	}
 	return nil
 }
 
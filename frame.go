@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"github.com/ZhangGuangxu/netbuffer"
+	"github.com/golang/snappy"
+	"io"
+)
+
+// Frame formats:
+// v1: [int32 length][int16 protoID][payload][checksum of protoID and payload]
+// v2: [uint8 frameMark|2][uint8 flags][int32 length][uint32 seq if frameFlagSeq][int16 protoID][payload][checksum]
+// The checksum of v2 frames is of all after length. It is 4 bytes adler32 unless the client
+// chooses another one, see frame_checksum.go.
+//
+// The first byte of a v1 frame is the high byte of length, which is never bigger than
+// maxMessageLen>>24, so frames of both versions are accepted from any client.
+// Frames to a client are v2 only if its protocol version is not less than 2.
+//
+// In v2 frames, flags tells how the payload is compressed, the checksum is of the payload on wire.
+// Payloads not smaller than frameCompressThreshold are compressed by frameCompressAlgo,
+// unless compressing does not make them smaller.
+//
+// frameFlagSeq tells the frame has a sequence number. Frames from a client MUST be numbered
+// from 1 one by one, if the client numbers any frame or its protocol version is not less than
+// seqProtocolVersion, see Client.acceptSeq.
+// The seq is not a MAC, it is covered only by the checksum, which anyone on the path can compute.
+// So frames are protected against replay only over TLS, or in sealed sessions whose nonce is the
+// count of frames(see frame_cipher.go). On other connections a captured frame could be sent again
+// in a new session, so only idempotentMsgs are sent to player, see replayProtectionRequired.
+// Frames to a client of protocol version not less than ackProtocolVersion are numbered by message
+// instead: seq is the number of the message given by the player(see replay_buffer.go), all fragments
+// of a message have the same seq, and messages not from the player are not numbered. A numbered
+// batch frame has the seq of its first message, and the others follow one by one.
+//
+// Frames from client are not longer than maxFrameLen. A bigger message is sent in v2 frames
+// with the same protoID one after another, all but the last have frameFlagMore. Fragments are
+// reassembled and the message is decompressed within the budget of the client state(see
+// Client.messageBudget), so a client not binded can send neither fragmented nor compressed
+// messages. The message is compressed as a whole, so all fragments have the same compression flag.
+// Messages to a client of frame version 2 are fragmented the same way, v1 frames to a client are
+// up to maxMessageLen.
+//
+// A batch frame is a v2 frame with frameFlagBatch and protoID batchProtoID, its payload is
+// [int16 protoID][int32 n][n bytes payload] of each message. The batch is compressed as a whole.
+// See framer.packBatch.
+//
+// If the session is encrypted, frames are sealed instead, see frame_cipher.go.
+
+const (
+	frameV1 = 1
+	frameV2 = 2
+
+	frameMark           = 0x80
+	frameV2HeadCount    = 2
+	frameFlagFlate      = 0x01
+	frameFlagSnappy     = 0x02
+	frameFlagCompressed = frameFlagFlate | frameFlagSnappy
+	frameFlagSeq        = 0x04
+	frameFlagMore       = 0x08 // more fragments of the message follow
+	frameFlagBatch      = 0x10 // the payload is a batch of messages
+	frameFlagAll        = frameFlagCompressed | frameFlagSeq | frameFlagMore | frameFlagBatch
+
+	batchProtoID        int16 = 0
+	batchEntryHeadCount       = protoIDByteCount + 4
+
+	seqByteCount       = 4
+	seqProtocolVersion = 3
+
+	maxFragmentLen = maxFrameLen - 64 // leaves room for the head, protoID and checksum or tag
+	fragBufKeepCap = 4 * maxFrameLen
+)
+
+// Names of compression algorithms
+const (
+	compressFlate  = "flate"
+	compressSnappy = "snappy"
+)
+
+var errInvalidFrameVersion = errors.New("invalid frame version")
+var errInvalidFrameFlags = errors.New("invalid frame flags")
+var errDecompressedTooLarge = errors.New("decompressed payload too large")
+var errSequenceRejected = errors.New("sequence rejected")
+var errInvalidFragment = errors.New("invalid fragment")
+var errMessageBudget = errors.New("message exceeds budget")
+var errInvalidBatch = errors.New("invalid batch")
+
+// frameVersionOf returns the version of frames to a client of protocol version v.
+func frameVersionOf(v int) int {
+	if v >= 2 {
+		return frameV2
+	}
+	return frameV1
+}
+
+// framer packs and unpacks frames for a codec.
+type framer struct {
+	version    int  // version of frames packed
+	requireSeq bool // frames from client must be numbered
+	sendSeq    bool // frames to client are numbered by message
+
+	tmpBuf   *netbuffer.Buffer
+	checksum *frameChecksum
+	sumBuf   [maxChecksumByteCount]byte
+
+	compressBuf   bytes.Buffer
+	flateWriter   *flate.Writer
+	snappyEncBuf  []byte
+	decompressBuf bytes.Buffer
+	flateReader   io.ReadCloser
+	snappyDecBuf  []byte
+
+	cipher   *frameCipher
+	plainBuf []byte
+	sealBuf  []byte
+
+	// reassembly of fragments from client
+	fragging    bool
+	fragProtoID int16
+	fragFlags   byte
+	fragBuf     []byte
+
+	batchBuf []byte
+	batchOut []byte
+}
+
+func newFramer(version int) *framer {
+	return &framer{
+		version:  version,
+		tmpBuf:   netbuffer.NewBuffer(),
+		checksum: frameChecksums[checksumAdler32],
+	}
+}
+
+// setChecksum MUST be called before the first pack or unpack.
+func (f *framer) setChecksum(c *frameChecksum) {
+	f.checksum = c
+}
+
+// setCipher MUST be called before the first pack or unpack.
+func (f *framer) setCipher(c *frameCipher) {
+	f.cipher = c
+}
+
+func checkFrameFlags(flags byte) error {
+	if flags&^frameFlagAll != 0 || flags&frameFlagCompressed == frameFlagCompressed {
+		return errInvalidFrameFlags
+	}
+	return nil
+}
+
+// checkSeq returns errSequenceRejected if the frame should be numbered but is not,
+// or seq is rejected by client.
+func (f *framer) checkSeq(client *Client, flags byte, seq uint32) (uint32, error) {
+	if flags&frameFlagSeq == 0 {
+		if !f.requireSeq {
+			return 0, nil
+		}
+		seq = 0
+	}
+	if !client.acceptSeq(seq) {
+		return 0, errSequenceRejected
+	}
+	return seq, nil
+}
+
+func seqLenOf(flags byte) int {
+	if flags&frameFlagSeq != 0 {
+		return seqByteCount
+	}
+	return 0
+}
+
+// unpack unpacks all whole frames in buf, and adds messages to client.
+func (f *framer) unpack(buf *netbuffer.Buffer, client *Client, decode func(int16, []byte) (interface{}, error)) error {
+	if f.cipher != nil {
+		return f.unpackSealed(buf, client, decode)
+	}
+
+	minDataLen := protoIDByteCount + f.checksum.size
+	for buf.ReadableBytes() > 0 {
+		var flags byte
+		headCount := 0
+		if mark := buf.PeekAsByteSlice(1)[0]; mark&frameMark != 0 {
+			if mark != frameMark|frameV2 {
+				return errInvalidFrameVersion
+			}
+			if buf.ReadableBytes() < frameV2HeadCount {
+				break
+			}
+			flags = buf.PeekAsByteSlice(frameV2HeadCount)[1]
+			if err := checkFrameFlags(flags); err != nil {
+				return err
+			}
+			headCount = frameV2HeadCount
+		}
+		if buf.ReadableBytes() < headCount+headerByteCount+minDataLen {
+			break
+		}
+
+		head := buf.PeekAsByteSlice(headCount + headerByteCount)
+		length := int(int32(binary.BigEndian.Uint32(head[headCount:])))
+		seqLen := seqLenOf(flags)
+		if length > maxFrameLen || length < seqLen+minDataLen {
+			return errInvalidMsgLength
+		} else if buf.ReadableBytes() < headCount+headerByteCount+length {
+			break
+		}
+		buf.Retrieve(headCount)
+		buf.RetrieveInt32()
+
+		sumLen := length - f.checksum.size
+		s := buf.PeekAsByteSlice(length)
+		if !f.checksum.verify(s[:sumLen], s[sumLen:]) {
+			return errChecksumNotMatch
+		}
+
+		var seq uint32
+		if seqLen > 0 {
+			seq = uint32(buf.ReadInt32())
+		}
+		protoID := buf.ReadInt16()
+
+		dataLen := sumLen - seqLen - protoIDByteCount
+		err := f.handlePayload(client, flags, seq, protoID, buf.PeekAsByteSlice(dataLen), decode)
+		buf.Retrieve(dataLen + f.checksum.size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unpackSealed opens all whole sealed frames in buf, and adds messages to client.
+func (f *framer) unpackSealed(buf *netbuffer.Buffer, client *Client, decode func(int16, []byte) (interface{}, error)) error {
+	minLen := 1 + protoIDByteCount + f.cipher.overhead()
+	for buf.ReadableBytes() >= headerByteCount+minLen {
+		length := int(buf.PeekInt32())
+		if length > maxFrameLen || length < minLen {
+			return errInvalidMsgLength
+		} else if buf.ReadableBytes() < headerByteCount+length {
+			break
+		}
+
+		frame := buf.PeekAsByteSlice(headerByteCount + length)
+		plaintext, err := f.cipher.open(frame[headerByteCount:], frame[:headerByteCount])
+		if err != nil {
+			return err
+		}
+		flags := plaintext[0]
+		if err := checkFrameFlags(flags); err != nil {
+			return err
+		}
+		seqLen := seqLenOf(flags)
+		if len(plaintext) < 1+seqLen+protoIDByteCount {
+			return errInvalidMsgLength
+		}
+		var seq uint32
+		if seqLen > 0 {
+			seq = binary.BigEndian.Uint32(plaintext[1:])
+		}
+		protoID := int16(binary.BigEndian.Uint16(plaintext[1+seqLen:]))
+
+		err = f.handlePayload(client, flags, seq, protoID, plaintext[1+seqLen+protoIDByteCount:], decode)
+		buf.Retrieve(headerByteCount + length)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handlePayload checks seq, reassembles fragments, decompresses and decodes the payload of a frame,
+// and adds the message to client when it is whole. data is valid only in this call.
+func (f *framer) handlePayload(client *Client, flags byte, seq uint32, protoID int16, data []byte,
+	decode func(int16, []byte) (interface{}, error)) error {
+	seq, err := f.checkSeq(client, flags, seq)
+	if err != nil {
+		return err
+	}
+
+	if flags&frameFlagMore != 0 || f.fragging {
+		if !f.fragging {
+			f.fragging = true
+			f.fragProtoID = protoID
+			f.fragFlags = flags & (frameFlagCompressed | frameFlagBatch)
+		} else if protoID != f.fragProtoID || flags&(frameFlagCompressed|frameFlagBatch) != f.fragFlags {
+			return errInvalidFragment
+		}
+		if len(f.fragBuf)+len(data) > client.messageBudget() {
+			return errMessageBudget
+		}
+		f.fragBuf = append(f.fragBuf, data...)
+		if flags&frameFlagMore != 0 {
+			return nil
+		}
+
+		data = f.fragBuf
+		f.fragging = false
+		defer f.resetFragBuf()
+	}
+
+	if flags&frameFlagCompressed != 0 {
+		defer f.resetDecompressBuf()
+		data, err = f.decompress(flags, data, client.messageBudget())
+		if err != nil {
+			return err
+		}
+	}
+	if flags&frameFlagBatch != 0 {
+		return unpackBatch(client, seq, data, decode)
+	}
+	proto, err := decode(protoID, data)
+	if err != nil {
+		return err
+	}
+
+	client.addIncomingMessage(protoID, proto, seq)
+	return nil
+}
+
+// unpackBatch decodes messages in the payload of a batch frame.
+func unpackBatch(client *Client, seq uint32, data []byte, decode func(int16, []byte) (interface{}, error)) error {
+	for len(data) > 0 {
+		if len(data) < batchEntryHeadCount {
+			return errInvalidBatch
+		}
+		protoID := int16(binary.BigEndian.Uint16(data))
+		n := int(binary.BigEndian.Uint32(data[protoIDByteCount:]))
+		data = data[batchEntryHeadCount:]
+		if n < 0 || n > len(data) {
+			return errInvalidBatch
+		}
+
+		proto, err := decode(protoID, data[:n])
+		if err != nil {
+			return err
+		}
+		client.addIncomingMessage(protoID, proto, seq)
+		data = data[n:]
+	}
+	return nil
+}
+
+// resetFragBuf keeps a small buffer for later fragments, and frees a big one.
+func (f *framer) resetFragBuf() {
+	if cap(f.fragBuf) > fragBufKeepCap {
+		f.fragBuf = nil
+	} else {
+		f.fragBuf = f.fragBuf[:0]
+	}
+}
+
+// resetDecompressBuf keeps small buffers for later compressed messages, and frees big ones.
+func (f *framer) resetDecompressBuf() {
+	if f.decompressBuf.Cap() > fragBufKeepCap {
+		f.decompressBuf = bytes.Buffer{}
+	}
+	if cap(f.snappyDecBuf) > fragBufKeepCap {
+		f.snappyDecBuf = nil
+	}
+}
+
+// pack packs a message numbered seq(0 means not numbered), and returns the frames.
+// A message bigger than maxFragmentLen is packed in fragments if the frame version is 2.
+// The frames are valid until the next pack.
+func (f *framer) pack(seq uint32, protoID int16, data []byte) ([]byte, error) {
+	return f.packWith(0, seq, protoID, data)
+}
+
+// packBatch packs msgs, and returns the frames. encode encodes a message and releases its proto.
+// For frame version 2, messages are packed in batch frames whose payload is up to batchMaxBytes,
+// a bigger message is packed alone. For frame version 1, frames of msgs are concatenated.
+// The frames are valid until the next pack.
+func (f *framer) packBatch(msgs []*message, encode func(*message) ([]byte, error)) ([]byte, error) {
+	out := f.batchOut[:0]
+	batch := f.batchBuf[:0]
+	count := 0
+	var lastProtoID int16
+	var firstSeq uint32
+
+	flush := func() error {
+		var frames []byte
+		var err error
+		switch count {
+		case 0:
+			return nil
+		case 1:
+			frames, err = f.pack(firstSeq, lastProtoID, batch[batchEntryHeadCount:])
+		default:
+			frames, err = f.packWith(frameFlagBatch, firstSeq, batchProtoID, batch)
+		}
+		if err != nil {
+			return err
+		}
+		out = append(out, frames...)
+		batch = batch[:0]
+		count = 0
+		return nil
+	}
+
+	for _, msg := range msgs {
+		seq := msg.seq
+		if !f.sendSeq {
+			seq = 0
+		}
+		data, err := encode(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		if f.version != frameV2 || batchEntryHeadCount+len(data) > batchMaxBytes {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			frames, err := f.pack(seq, msg.protoID, data)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, frames...)
+			continue
+		}
+
+		// messages of a batch are all not numbered, or numbered one by one
+		follows := (firstSeq == 0 && seq == 0) || (firstSeq != 0 && seq == firstSeq+uint32(count))
+		if count > 0 && (!follows || len(batch)+batchEntryHeadCount+len(data) > batchMaxBytes) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		if count == 0 {
+			firstSeq = seq
+		}
+		batch = append(batch, byte(msg.protoID>>8), byte(msg.protoID), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(batch[len(batch)-4:], uint32(len(data)))
+		batch = append(batch, data...)
+		lastProtoID = msg.protoID
+		count++
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	f.batchOut = out
+	f.batchBuf = batch
+	return out, nil
+}
+
+// packWith packs a message with flags.
+func (f *framer) packWith(flags byte, seq uint32, protoID int16, data []byte) ([]byte, error) {
+	if f.version == frameV2 {
+		compressFlags, payload, err := f.compress(data)
+		if err != nil {
+			return nil, err
+		}
+		flags |= compressFlags
+		data = payload
+	}
+	if len(data) > maxMessageLen {
+		return nil, errInvalidMsgLength
+	}
+	if f.sendSeq && seq != 0 {
+		flags |= frameFlagSeq
+	}
+
+	f.tmpBuf.RetrieveAll()
+	f.sealBuf = f.sealBuf[:0]
+	for {
+		chunk := data
+		chunkFlags := flags
+		if f.version == frameV2 && len(chunk) > maxFragmentLen {
+			chunk = data[:maxFragmentLen]
+			chunkFlags |= frameFlagMore
+		}
+		if f.cipher != nil {
+			f.packSealed(chunkFlags, seq, protoID, chunk)
+		} else {
+			f.packPlain(chunkFlags, seq, protoID, chunk)
+		}
+
+		data = data[len(chunk):]
+		if len(data) == 0 {
+			break
+		}
+	}
+
+	if f.cipher != nil {
+		return f.sealBuf, nil
+	}
+	return f.tmpBuf.PeekAllAsByteSlice(), nil
+}
+
+// packPlain appends a frame to tmpBuf.
+func (f *framer) packPlain(flags byte, seq uint32, protoID int16, data []byte) {
+	tmpBuf := f.tmpBuf
+	start := tmpBuf.ReadableBytes()
+
+	if f.version == frameV2 {
+		tmpBuf.Append([]byte{frameMark | frameV2, flags})
+	}
+	headCount := tmpBuf.ReadableBytes() - start
+
+	seqLen := seqLenOf(flags)
+	sumLen := seqLen + protoIDByteCount + len(data)
+	msgLen := sumLen + f.checksum.size
+
+	tmpBuf.AppendInt32(int32(msgLen))
+	if seqLen > 0 {
+		tmpBuf.AppendInt32(int32(seq))
+	}
+	tmpBuf.AppendInt16(protoID)
+	tmpBuf.Append(data)
+
+	s := tmpBuf.PeekAllAsByteSlice()[start+headCount+headerByteCount:]
+	tmpBuf.Append(f.checksum.put(f.sumBuf[:], s))
+}
+
+// packSealed appends a sealed frame to sealBuf.
+func (f *framer) packSealed(flags byte, seq uint32, protoID int16, data []byte) {
+	seqLen := seqLenOf(flags)
+	plainLen := 1 + seqLen + protoIDByteCount + len(data)
+	msgLen := plainLen + f.cipher.overhead()
+
+	plain := append(f.plainBuf[:0], flags)
+	if seqLen > 0 {
+		plain = append(plain, byte(seq>>24), byte(seq>>16), byte(seq>>8), byte(seq))
+	}
+	plain = append(plain, byte(protoID>>8), byte(protoID))
+	plain = append(plain, data...)
+	f.plainBuf = plain
+
+	out := f.sealBuf
+	start := len(out)
+	out = append(out, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(out[start:], uint32(msgLen))
+	out = f.cipher.seal(out, plain, out[start:start+headerByteCount])
+	f.sealBuf = out
+}
+
+// compress returns the flags and the payload to send.
+func (f *framer) compress(data []byte) (byte, []byte, error) {
+	if frameCompressThreshold <= 0 || len(data) < frameCompressThreshold {
+		return 0, data, nil
+	}
+
+	var flags byte
+	var out []byte
+	switch frameCompressAlgo {
+	case compressFlate:
+		f.compressBuf.Reset()
+		if f.flateWriter == nil {
+			w, err := flate.NewWriter(&f.compressBuf, flate.BestSpeed)
+			if err != nil {
+				return 0, nil, err
+			}
+			f.flateWriter = w
+		} else {
+			f.flateWriter.Reset(&f.compressBuf)
+		}
+		if _, err := f.flateWriter.Write(data); err != nil {
+			return 0, nil, err
+		}
+		if err := f.flateWriter.Close(); err != nil {
+			return 0, nil, err
+		}
+		flags, out = frameFlagFlate, f.compressBuf.Bytes()
+	case compressSnappy:
+		f.snappyEncBuf = snappy.Encode(f.snappyEncBuf[:cap(f.snappyEncBuf)], data)
+		flags, out = frameFlagSnappy, f.snappyEncBuf
+	default:
+		return 0, data, nil
+	}
+
+	if len(out) >= len(data) {
+		return 0, data, nil
+	}
+	return flags, out, nil
+}
+
+// decompress returns the payload decompressed by flags, which is not longer than budget.
+// The result is valid until the next decompress or resetDecompressBuf.
+func (f *framer) decompress(flags byte, data []byte, budget int) ([]byte, error) {
+	if budget > maxMessageLen {
+		budget = maxMessageLen
+	}
+	if budget <= 0 {
+		return nil, errMessageBudget
+	}
+
+	switch flags & frameFlagCompressed {
+	case frameFlagFlate:
+		if f.flateReader == nil {
+			f.flateReader = flate.NewReader(bytes.NewReader(data))
+		} else if err := f.flateReader.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+			return nil, err
+		}
+		f.decompressBuf.Reset()
+		n, err := f.decompressBuf.ReadFrom(io.LimitReader(f.flateReader, int64(budget)+1))
+		if err != nil {
+			return nil, err
+		}
+		if n > int64(budget) {
+			return nil, errDecompressedTooLarge
+		}
+		return f.decompressBuf.Bytes(), nil
+	case frameFlagSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > budget {
+			return nil, errDecompressedTooLarge
+		}
+		f.snappyDecBuf, err = snappy.Decode(f.snappyDecBuf[:cap(f.snappyDecBuf)], data)
+		if err != nil {
+			return nil, err
+		}
+		return f.snappyDecBuf, nil
+	}
+	return data, nil
+}
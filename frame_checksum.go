@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cespare/xxhash"
+	"hash/adler32"
+	"hash/crc32"
+)
+
+// Checksum of plain frames(see frame.go), chosen per connection.
+// Clients of protocol version less than checksumProtocolVersion use adler32.
+// Others choose one in the handshake, or get the default of the listener:
+// frameChecksumDefault for tcp, unix and rudp, frameChecksumTLS for tls, wsFrameChecksum for websocket.
+// TLS authenticates every record, and websocket relies on its transport, so their defaults are none.
+
+// Names of frame checksums
+const (
+	checksumAdler32  = "adler32"
+	checksumCRC32C   = "crc32c" // hardware accelerated on amd64 and arm64
+	checksumXXHash64 = "xxhash64"
+	checksumNone     = "none"
+)
+
+const (
+	checksumProtocolVersion = 4
+	maxChecksumByteCount    = 8
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type frameChecksum struct {
+	name string
+	size int // bytes on wire, the low bytes of sum in big endian
+	sum  func(data []byte) uint64
+}
+
+var frameChecksums = map[string]*frameChecksum{
+	checksumAdler32: {
+		name: checksumAdler32,
+		size: 4,
+		sum:  func(data []byte) uint64 { return uint64(adler32.Checksum(data)) },
+	},
+	checksumCRC32C: {
+		name: checksumCRC32C,
+		size: 4,
+		sum:  func(data []byte) uint64 { return uint64(crc32.Checksum(data, crc32cTable)) },
+	},
+	checksumXXHash64: {
+		name: checksumXXHash64,
+		size: 8,
+		sum:  xxhash.Sum64,
+	},
+	checksumNone: {
+		name: checksumNone,
+		size: 0,
+		sum:  func(data []byte) uint64 { return 0 },
+	},
+}
+
+func getFrameChecksum(name string) (*frameChecksum, error) {
+	c, ok := frameChecksums[name]
+	if !ok {
+		return nil, fmt.Errorf("checksum[%v] not found", name)
+	}
+	return c, nil
+}
+
+// checksumOf returns the checksum of a client of protocol version v.
+// name is the one chosen in the handshake, empty means listenerDefault.
+func checksumOf(v int, name string, listenerDefault string) (*frameChecksum, error) {
+	if v < checksumProtocolVersion {
+		return frameChecksums[checksumAdler32], nil
+	}
+	if name == "" {
+		name = listenerDefault
+	}
+	return getFrameChecksum(name)
+}
+
+// put writes the checksum of data to b, and returns the written bytes.
+func (c *frameChecksum) put(b []byte, data []byte) []byte {
+	if c.size == 0 {
+		return b[:0]
+	}
+	v := c.sum(data)
+	for i := c.size - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return b[:c.size]
+}
+
+// verify returns true if sum is the checksum of data.
+func (c *frameChecksum) verify(data []byte, sum []byte) bool {
+	if c.size == 0 {
+		return true
+	}
+	v := c.sum(data)
+	for i := c.size - 1; i >= 0; i-- {
+		if sum[i] != byte(v) {
+			return false
+		}
+		v >>= 8
+	}
+	return true
+}
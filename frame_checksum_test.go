@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestFrameChecksumVerify(t *testing.T) {
+	data := []byte("\x00\x01hello")
+	for name, c := range frameChecksums {
+		t.Run(name, func(t *testing.T) {
+			var b [maxChecksumByteCount]byte
+			sum := c.put(b[:], data)
+			if len(sum) != c.size {
+				t.Fatalf("put %v bytes, want %v", len(sum), c.size)
+			}
+			if !c.verify(data, sum) {
+				t.Fatal("checksum of data not verified")
+			}
+			if c.size == 0 {
+				return
+			}
+			sum[0] ^= 1
+			if c.verify(data, sum) {
+				t.Fatal("wrong checksum verified")
+			}
+		})
+	}
+}
+
+// sizes of protoID and payload of frames the server sends and receives
+var checksumBenchSizes = []struct {
+	name string
+	size int
+}{
+	{"heartbeat", 2 + 4},
+	{"auth", 2 + 48},
+	{"small", 2 + 200},
+	{"compressThreshold", 2 + 1024},
+	{"batch", 2 + 8*1024},
+	{"maxFrame", maxFrameLen - 4 - 4},
+}
+
+var checksumBenchSink uint64
+
+func benchmarkChecksum(b *testing.B, name string) {
+	c := frameChecksums[name]
+	for _, s := range checksumBenchSizes {
+		data := make([]byte, s.size)
+		rand.Read(data)
+		b.Run(s.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				checksumBenchSink += c.sum(data)
+			}
+		})
+	}
+}
+
+func BenchmarkChecksumAdler32(b *testing.B)  { benchmarkChecksum(b, checksumAdler32) }
+func BenchmarkChecksumCRC32C(b *testing.B)   { benchmarkChecksum(b, checksumCRC32C) }
+func BenchmarkChecksumXXHash64(b *testing.B) { benchmarkChecksum(b, checksumXXHash64) }
+func BenchmarkChecksumNone(b *testing.B)     { benchmarkChecksum(b, checksumNone) }
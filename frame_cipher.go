@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+// Encrypted session:
+// The client asks for it in the handshake(see handshake.go) with its X25519 public key,
+// and the server replies with its own ephemeral public key and an Ed25519 signature of
+// handshakeSignContext + SHA-256(transcript). The transcript is the whole handshake request,
+// from the magic to the public key of client, followed by the public key of server.
+// The signing key is handshakeKey, clients pin its public key(or get it from web-server, see
+// acceptor_web.go), and MUST close the connection if the signature does not verify, so that
+// neither the keys nor the options of the handshake can be replaced by a man in the middle.
+// Both sides derive a key for each direction from the shared secret, salted by the transcript
+// hash, and every later frame in both directions is sealed by AES-256-GCM:
+// [int32 length][sealed [uint8 flags][int16 protoID][payload]][16 bytes tag]
+// The nonce of a frame is the count of frames sealed before it in the same direction,
+// it is not sent. So a replayed, dropped, reordered or modified frame fails to open,
+// and the connection is closed. The length is authenticated as additional data.
+// Sealed frames have no checksum, and flags is 0 if the frame version of the client is 1.
+
+const (
+	cipherPublicKeyLen = 32
+	cipherSignatureLen = ed25519.SignatureSize
+
+	handshakeSignContext = "biblio handshake v1"
+
+	keyInfoC2S = "biblio c2s"
+	keyInfoS2C = "biblio s2c"
+)
+
+var errFrameOpenFailed = errors.New("frame open failed")
+
+// handshakeSigner signs key exchanges, nil if handshakeKey is not configured.
+var handshakeSigner ed25519.PrivateKey
+
+// loadHandshakeKey parses handshakeKey, base64 of an Ed25519 seed(32 bytes) or private key(64 bytes).
+func loadHandshakeKey() error {
+	if handshakeKey == "" {
+		handshakeSigner = nil
+		return nil
+	}
+	b, err := base64.StdEncoding.DecodeString(handshakeKey)
+	if err != nil {
+		return err
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		handshakeSigner = ed25519.NewKeyFromSeed(b)
+	case ed25519.PrivateKeySize:
+		handshakeSigner = ed25519.PrivateKey(b)
+	default:
+		return errors.New("invalid handshakeKey")
+	}
+	return nil
+}
+
+// handshakePublicKey returns base64 of the public key of handshakeSigner, which clients pin.
+func handshakePublicKey() string {
+	if handshakeSigner == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(handshakeSigner.Public().(ed25519.PublicKey))
+}
+
+// frameCipher seals outgoing frames and opens incoming frames of a connection.
+// seal is called by the write goroutine and open by the read goroutine.
+type frameCipher struct {
+	sealer  cipher.AEAD
+	opener  cipher.AEAD
+	sealSeq uint64
+	openSeq uint64
+
+	sealNonce []byte
+	openNonce []byte
+}
+
+// newServerFrameCipher does the server side of key exchange with the public key of client.
+// request is the whole handshake request, which ends with clientPublic.
+// It returns the public key of server followed by the signature of the transcript.
+func newServerFrameCipher(signer ed25519.PrivateKey, request []byte, clientPublic []byte) (*frameCipher, []byte, error) {
+	if signer == nil {
+		return nil, nil, errors.New("handshakeKey is not configured")
+	}
+	curve := ecdh.X25519()
+	peer, err := curve.NewPublicKey(clientPublic)
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverPublic := priv.PublicKey().Bytes()
+
+	// the transcript hash is the salt, so keys of every session are different,
+	// and are bound to the options of the handshake
+	h := sha256.New()
+	h.Write(request)
+	h.Write(serverPublic)
+	transcript := h.Sum(nil)
+	prk := hmacSHA256(transcript, shared)
+
+	reply := make([]byte, 0, cipherPublicKeyLen+cipherSignatureLen)
+	reply = append(reply, serverPublic...)
+	reply = append(reply, ed25519.Sign(signer, handshakeSignMessage(transcript))...)
+
+	opener, err := newGCM(hmacSHA256(prk, []byte(keyInfoC2S), []byte{1}))
+	if err != nil {
+		return nil, nil, err
+	}
+	sealer, err := newGCM(hmacSHA256(prk, []byte(keyInfoS2C), []byte{1}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &frameCipher{
+		sealer:    sealer,
+		opener:    opener,
+		sealNonce: make([]byte, sealer.NonceSize()),
+		openNonce: make([]byte, opener.NonceSize()),
+	}, reply, nil
+}
+
+func handshakeSignMessage(transcript []byte) []byte {
+	m := make([]byte, 0, len(handshakeSignContext)+len(transcript))
+	m = append(m, handshakeSignContext...)
+	return append(m, transcript...)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func (c *frameCipher) overhead() int {
+	return c.sealer.Overhead()
+}
+
+// seal appends the sealed plaintext to dst. ad is the length of frame.
+func (c *frameCipher) seal(dst, plaintext, ad []byte) []byte {
+	binary.BigEndian.PutUint64(c.sealNonce[len(c.sealNonce)-8:], c.sealSeq)
+	c.sealSeq++
+	return c.sealer.Seal(dst, c.sealNonce, plaintext, ad)
+}
+
+// open opens sealed in place, and returns the plaintext.
+func (c *frameCipher) open(sealed, ad []byte) ([]byte, error) {
+	binary.BigEndian.PutUint64(c.openNonce[len(c.openNonce)-8:], c.openSeq)
+	plaintext, err := c.opener.Open(sealed[:0], c.openNonce, sealed, ad)
+	if err != nil {
+		return nil, errFrameOpenFailed
+	}
+	c.openSeq++
+	return plaintext, nil
+}
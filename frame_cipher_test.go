@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+)
+
+// testHandshakeClient is the client side of the key exchange.
+type testHandshakeClient struct {
+	priv    *ecdh.PrivateKey
+	request []byte
+}
+
+func newTestHandshakeClient(t *testing.T, options string) *testHandshakeClient {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := append([]byte(handshakeMagicEncrypt+options), priv.PublicKey().Bytes()...)
+	return &testHandshakeClient{priv: priv, request: request}
+}
+
+func (c *testHandshakeClient) publicKey() []byte {
+	return c.request[len(c.request)-cipherPublicKeyLen:]
+}
+
+// finish verifies the reply of server, and returns the cipher of client, whose sealer is of c2s.
+func (c *testHandshakeClient) finish(pinned ed25519.PublicKey, reply []byte) (*frameCipher, bool) {
+	serverPublic, sign := reply[:cipherPublicKeyLen], reply[cipherPublicKeyLen:]
+	h := sha256.New()
+	h.Write(c.request)
+	h.Write(serverPublic)
+	transcript := h.Sum(nil)
+	if !ed25519.Verify(pinned, handshakeSignMessage(transcript), sign) {
+		return nil, false
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(serverPublic)
+	if err != nil {
+		return nil, false
+	}
+	shared, err := c.priv.ECDH(peer)
+	if err != nil {
+		return nil, false
+	}
+	prk := hmacSHA256(transcript, shared)
+	sealer, _ := newGCM(hmacSHA256(prk, []byte(keyInfoC2S), []byte{1}))
+	opener, _ := newGCM(hmacSHA256(prk, []byte(keyInfoS2C), []byte{1}))
+	return &frameCipher{
+		sealer:    sealer,
+		opener:    opener,
+		sealNonce: make([]byte, sealer.NonceSize()),
+		openNonce: make([]byte, opener.NonceSize()),
+	}, true
+}
+
+func TestFrameCipherSignedExchange(t *testing.T) {
+	pub, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name   string
+		signer ed25519.PrivateKey
+		tamper func(request []byte) []byte // by a man in the middle before the server
+		verify bool
+	}{
+		{"pinned key", signer, nil, true},
+		{"other key", other, nil, false},
+		{"downgraded version", signer, func(r []byte) []byte {
+			r = append([]byte(nil), r...)
+			r[len(handshakeMagic)] = 1
+			return r
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestHandshakeClient(t, "\x06\x02pb\x00")
+			request := c.request
+			if tt.tamper != nil {
+				request = tt.tamper(request)
+			}
+			server, reply, err := newServerFrameCipher(tt.signer, request, c.publicKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reply) != cipherPublicKeyLen+cipherSignatureLen {
+				t.Fatalf("reply length %v", len(reply))
+			}
+			client, ok := c.finish(pub, reply)
+			if ok != tt.verify {
+				t.Fatalf("verified %v, want %v", ok, tt.verify)
+			}
+			if !ok {
+				return
+			}
+
+			ad := []byte{0, 0, 0, 9}
+			sealed := client.seal(nil, []byte("hello"), ad)
+			plain, err := server.open(sealed, ad)
+			if err != nil || !bytes.Equal(plain, []byte("hello")) {
+				t.Fatalf("open %q %v", plain, err)
+			}
+		})
+	}
+}
+
+func TestFrameCipherNoSigner(t *testing.T) {
+	c := newTestHandshakeClient(t, "\x06\x02pb\x00")
+	if _, _, err := newServerFrameCipher(nil, c.request, c.publicKey()); err == nil {
+		t.Fatal("key exchange without handshakeKey")
+	}
+}
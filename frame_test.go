@@ -0,0 +1,525 @@
+package main
+
+import (
+	proto "biblio/protocol"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/ZhangGuangxu/netbuffer"
+	mrand "math/rand"
+	"testing"
+)
+
+// testFrameSink collects messages decoded by framer.unpack.
+type testFrameSink struct {
+	protoIDs []int16
+	payloads [][]byte
+}
+
+func (s *testFrameSink) decode(protoID int16, data []byte) (interface{}, error) {
+	s.protoIDs = append(s.protoIDs, protoID)
+	s.payloads = append(s.payloads, append([]byte(nil), data...))
+	return nil, nil
+}
+
+func newTestBindedClient() *Client {
+	c := newClient()
+	c.setState(newClientStateBinded(c))
+	return c
+}
+
+// newTestFramers returns the framer of client and of server.
+// Frames packed by client are unpacked by server, and if sealed, they share a key exchange.
+func newTestFramers(t *testing.T, version int, checksum string, sealed bool) (client *framer, server *framer) {
+	client, server = newFramer(version), newFramer(version)
+	client.setChecksum(frameChecksums[checksum])
+	server.setChecksum(frameChecksums[checksum])
+	if sealed {
+		pub, signer, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hc := newTestHandshakeClient(t, "\x06\x02pb\x00")
+		sc, reply, err := newServerFrameCipher(signer, hc.request, hc.publicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc, ok := hc.finish(pub, reply)
+		if !ok {
+			t.Fatal("handshake not verified")
+		}
+		client.setCipher(cc)
+		server.setCipher(sc)
+	}
+	return client, server
+}
+
+// testPayload returns n bytes which do not compress.
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	mrand.New(mrand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func testUnpack(f *framer, client *Client, frames []byte) (*testFrameSink, error) {
+	sink := &testFrameSink{}
+	buf := netbuffer.NewBuffer()
+	buf.Append(frames)
+	err := f.unpack(buf, client, sink.decode)
+	return sink, err
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte("biblio frame "), 2000)
+	tests := []struct {
+		name     string
+		version  int
+		checksum string
+		sealed   bool
+		compress string
+		seq      bool
+		data     []byte
+		frames   int // frames packed, 0 means not checked
+	}{
+		{"v1", frameV1, checksumAdler32, false, "", false, []byte("hello"), 1},
+		{"v1 empty", frameV1, checksumAdler32, false, "", false, nil, 1},
+		{"v1 crc32c", frameV1, checksumCRC32C, false, "", false, testPayload(1000), 1},
+		{"v1 sealed", frameV1, checksumAdler32, true, "", false, testPayload(1000), 1},
+		{"v2", frameV2, checksumAdler32, false, "", false, []byte("hello"), 1},
+		{"v2 xxhash64", frameV2, checksumXXHash64, false, "", false, testPayload(1000), 1},
+		{"v2 no checksum", frameV2, checksumNone, false, "", false, testPayload(1000), 1},
+		{"v2 seq", frameV2, checksumAdler32, false, "", true, []byte("hello"), 1},
+		{"v2 snappy", frameV2, checksumAdler32, false, compressSnappy, false, compressible, 1},
+		{"v2 flate", frameV2, checksumCRC32C, false, compressFlate, false, compressible, 1},
+		{"v2 incompressible", frameV2, checksumAdler32, false, compressSnappy, false, testPayload(4096), 1},
+		{"v2 fragmented", frameV2, checksumAdler32, false, "", false, testPayload(3*maxFragmentLen + 5), 4},
+		{"v2 fragmented flate", frameV2, checksumAdler32, false, compressFlate, false, testPayload(2 * maxFragmentLen), 0},
+		{"v2 sealed", frameV2, checksumAdler32, true, compressSnappy, true, compressible, 1},
+		{"v2 sealed fragmented", frameV2, checksumAdler32, true, "", false, testPayload(2*maxFragmentLen + 1), 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &frameCompressAlgo, tt.compress)
+			setGlobal(t, &frameCompressThreshold, 1024)
+			cf, sf := newTestFramers(t, tt.version, tt.checksum, tt.sealed)
+			cf.sendSeq = tt.seq
+			sf.requireSeq = tt.seq
+			client := newTestBindedClient()
+
+			var all []byte
+			for seq := uint32(1); seq <= 2; seq++ {
+				frames, err := cf.pack(seq, 1001, tt.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := len(frameSeqs(t, cf, frames)); seq == 1 && tt.frames > 0 && n != tt.frames {
+					t.Fatalf("packed %v frames, want %v", n, tt.frames)
+				}
+				all = append(all, frames...)
+			}
+
+			sink, err := testUnpack(sf, client, all)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sink.payloads) != 2 {
+				t.Fatalf("unpacked %v messages, want 2", len(sink.payloads))
+			}
+			for i := range sink.payloads {
+				if sink.protoIDs[i] != 1001 || !bytes.Equal(sink.payloads[i], tt.data) {
+					t.Fatalf("message %v not match", i)
+				}
+			}
+		})
+	}
+}
+
+func equalSeqs(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// frameSeqs returns the seq of each frame packed by f, 0 if not numbered.
+// The seq of sealed frames is not read.
+func frameSeqs(t *testing.T, f *framer, frames []byte) []uint32 {
+	var seqs []uint32
+	for len(frames) > 0 {
+		head := 0
+		if f.version == frameV2 && f.cipher == nil {
+			head = frameV2HeadCount
+		}
+		length := int(binary.BigEndian.Uint32(frames[head:]))
+		if head+headerByteCount+length > len(frames) {
+			t.Fatal("invalid frames")
+		}
+		var seq uint32
+		if head > 0 && frames[1]&frameFlagSeq != 0 {
+			seq = binary.BigEndian.Uint32(frames[head+headerByteCount:])
+		}
+		seqs = append(seqs, seq)
+		frames = frames[head+headerByteCount+length:]
+	}
+	return seqs
+}
+
+func TestFrameTruncated(t *testing.T) {
+	for _, version := range []int{frameV1, frameV2} {
+		cf, sf := newTestFramers(t, version, checksumAdler32, false)
+		client := newTestBindedClient()
+		data := testPayload(100)
+		frames, err := cf.pack(0, 1001, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append([]byte(nil), frames...)
+
+		buf := netbuffer.NewBuffer()
+		sink := &testFrameSink{}
+		for _, cut := range []int{1, frameV2HeadCount + 1, len(frames) / 2, len(frames) - 1} {
+			buf.Append(frames[buf.ReadableBytes():cut])
+			if err := sf.unpack(buf, client, sink.decode); err != nil {
+				t.Fatalf("v%v cut at %v: %v", version, cut, err)
+			}
+			if len(sink.payloads) != 0 || buf.ReadableBytes() != cut {
+				t.Fatalf("v%v cut at %v: truncated frame unpacked", version, cut)
+			}
+		}
+		buf.Append(frames[buf.ReadableBytes():])
+		if err := sf.unpack(buf, client, sink.decode); err != nil {
+			t.Fatal(err)
+		}
+		if len(sink.payloads) != 1 || !bytes.Equal(sink.payloads[0], data) || buf.ReadableBytes() != 0 {
+			t.Fatalf("v%v: whole frame not unpacked", version)
+		}
+	}
+}
+
+func TestFrameInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		sealed  bool
+		data    []byte
+		tamper  func(frames []byte)
+		err     error
+	}{
+		{"v1 bad checksum", frameV1, false, []byte("hello"), func(b []byte) { b[headerByteCount+protoIDByteCount] ^= 1 }, errChecksumNotMatch},
+		{"v2 bad checksum", frameV2, false, []byte("hello"), func(b []byte) { b[len(b)-1] ^= 1 }, errChecksumNotMatch},
+		{"v2 bad protoID", frameV2, false, []byte("hello"), func(b []byte) { b[frameV2HeadCount+headerByteCount] ^= 1 }, errChecksumNotMatch},
+		{"v1 oversize", frameV1, false, testPayload(maxFrameLen), nil, errInvalidMsgLength},
+		{"v1 too short", frameV1, false, nil, func(b []byte) { b[3] = 1 }, errInvalidMsgLength},
+		{"v2 invalid version", frameV2, false, []byte("hello"), func(b []byte) { b[0] = frameMark | 3 }, errInvalidFrameVersion},
+		{"v2 invalid flags", frameV2, false, []byte("hello"), func(b []byte) { b[1] = frameFlagCompressed }, errInvalidFrameFlags},
+		{"v2 unknown flag", frameV2, false, []byte("hello"), func(b []byte) { b[1] = 0x40 }, errInvalidFrameFlags},
+		{"sealed tampered payload", frameV2, true, []byte("hello"), func(b []byte) { b[headerByteCount+3] ^= 1 }, errFrameOpenFailed},
+		{"sealed tampered tag", frameV2, true, []byte("hello"), func(b []byte) { b[len(b)-1] ^= 1 }, errFrameOpenFailed},
+		{"sealed tampered length", frameV1, true, []byte("hello"), func(b []byte) { b[3]-- }, errFrameOpenFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf, sf := newTestFramers(t, tt.version, checksumAdler32, tt.sealed)
+			frames, err := cf.pack(0, 1001, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames = append([]byte(nil), frames...)
+			if tt.tamper != nil {
+				tt.tamper(frames)
+			}
+			sink, err := testUnpack(sf, newTestBindedClient(), frames)
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if len(sink.payloads) != 0 {
+				t.Fatal("invalid frame unpacked")
+			}
+		})
+	}
+}
+
+func TestFrameSealedReplay(t *testing.T) {
+	cf, sf := newTestFramers(t, frameV2, checksumAdler32, true)
+	client := newTestBindedClient()
+	frames, err := cf.pack(0, 1001, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames = append([]byte(nil), frames...)
+	if _, err := testUnpack(sf, client, frames); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testUnpack(sf, client, frames); err != errFrameOpenFailed {
+		t.Fatalf("replayed frame: got %v, want %v", err, errFrameOpenFailed)
+	}
+}
+
+func TestFrameSeq(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint32 // 0 means not numbered
+		ok   int      // messages accepted before the rejected one
+	}{
+		{"in order", []uint32{1, 2, 3}, 3},
+		{"skipped", []uint32{1, 3}, 1},
+		{"replayed", []uint32{1, 2, 2}, 2},
+		{"reordered", []uint32{2, 1}, 0},
+		{"not numbered", []uint32{1, 0}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf, sf := newTestFramers(t, frameV2, checksumAdler32, false)
+			cf.sendSeq = true
+			sf.requireSeq = true
+			var all []byte
+			for _, seq := range tt.seqs {
+				frames, err := cf.pack(seq, 1001, []byte{byte(seq)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				all = append(all, frames...)
+			}
+
+			sink, err := testUnpack(sf, newTestBindedClient(), all)
+			want := error(nil)
+			if tt.ok < len(tt.seqs) {
+				want = errSequenceRejected
+			}
+			if err != want || len(sink.payloads) != tt.ok {
+				t.Fatalf("got %v and %v messages, want %v and %v", err, len(sink.payloads), want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+
+	const purchaseID = 1001 // a message to player, not idempotent
+	tests := []struct {
+		name      string
+		required  bool
+		protected bool
+		protoID   int16
+		forwarded bool
+	}{
+		{"protected", true, true, purchaseID, true},
+		{"open to replay", true, false, purchaseID, false},
+		{"idempotent", true, false, proto.C2SHeartbeatID, true},
+		{"not required", false, false, purchaseID, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &replayProtectionRequired, tt.required)
+			client := newTestBindedClient()
+			client.setReplayProtected(tt.protected)
+			client.addIncomingMessage(tt.protoID, nil, 1)
+
+			if forwarded := len(client.sender.(*messageChannel).inCh) == 1; forwarded != tt.forwarded {
+				t.Fatalf("forwarded %v, want %v", forwarded, tt.forwarded)
+			}
+			if tt.forwarded {
+				return
+			}
+			msg := <-client.recver.(*messageChannel).inCh
+			if msg.protoID != proto.S2CCloseID || !client.sender.shouldClose() {
+				t.Fatalf("got %+v, want S2CClose", msg)
+			}
+		})
+	}
+}
+
+func TestFrameFragments(t *testing.T) {
+	data := testPayload(3 * maxFragmentLen)
+	tests := []struct {
+		name   string
+		client *Client
+		tamper func(cf *framer, frames []byte) []byte
+		err    error
+	}{
+		{"binded", newTestBindedClient(), nil, nil},
+		{"over budget", newClient(), nil, errMessageBudget},
+		{"protoID changed", newTestBindedClient(), func(cf *framer, frames []byte) []byte {
+			first := frames[:frameV2HeadCount+headerByteCount+maxFragmentLen+protoIDByteCount+4]
+			other, _ := cf.pack(0, 1002, testPayload(10))
+			return append(append([]byte(nil), first...), other...)
+		}, errInvalidFragment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf, sf := newTestFramers(t, frameV2, checksumAdler32, false)
+			frames, err := cf.pack(0, 1001, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames = append([]byte(nil), frames...)
+			if tt.tamper != nil {
+				frames = tt.tamper(cf, frames)
+			}
+			sink, err := testUnpack(sf, tt.client, frames)
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && (len(sink.payloads) != 1 || !bytes.Equal(sink.payloads[0], data)) {
+				t.Fatal("fragments not reassembled")
+			}
+		})
+	}
+}
+
+// TestFrameDecompressBudget sends messages of high compression ratio, whose size after
+// decompression is limited by the budget of the client state.
+func TestFrameDecompressBudget(t *testing.T) {
+	tests := []struct {
+		name   string
+		algo   string
+		size   int // of zeros
+		binded bool
+		err    error
+	}{
+		{"notbinded flate", compressFlate, maxMessageLen, false, errMessageBudget},
+		{"notbinded snappy", compressSnappy, 1024, false, errMessageBudget},
+		{"notbinded not compressed", compressFlate, 16, false, nil},
+		{"binded flate", compressFlate, messageBudgetBinded, true, nil},
+		{"binded snappy", compressSnappy, messageBudgetBinded, true, nil},
+		{"binded flate over budget", compressFlate, messageBudgetBinded + 1, true, errDecompressedTooLarge},
+		{"binded snappy over budget", compressSnappy, messageBudgetBinded + 1, true, errDecompressedTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &frameCompressAlgo, tt.algo)
+			setGlobal(t, &frameCompressThreshold, 64)
+			cf, sf := newTestFramers(t, frameV2, checksumAdler32, false)
+			data := make([]byte, tt.size)
+			frames, err := cf.pack(0, 1001, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.size > 64 && len(frames) >= tt.size/8 {
+				t.Fatalf("%v bytes packed in %v", tt.size, len(frames))
+			}
+
+			client := newClient()
+			if tt.binded {
+				client = newTestBindedClient()
+			}
+			sink, err := testUnpack(sf, client, frames)
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && (len(sink.payloads) != 1 || !bytes.Equal(sink.payloads[0], data)) {
+				t.Fatal("payload not match")
+			}
+			if sf.decompressBuf.Cap() > fragBufKeepCap || cap(sf.snappyDecBuf) > fragBufKeepCap {
+				t.Fatal("decompression buffer kept")
+			}
+		})
+	}
+}
+
+func TestFramePackTooLarge(t *testing.T) {
+	for _, version := range []int{frameV1, frameV2} {
+		f := newFramer(version)
+		if _, err := f.pack(0, 1001, testPayload(maxMessageLen+1)); err != errInvalidMsgLength {
+			t.Fatalf("v%v: got %v, want %v", version, err, errInvalidMsgLength)
+		}
+	}
+}
+
+func TestFramePackBatch(t *testing.T) {
+	big := testPayload(batchMaxBytes)
+	tests := []struct {
+		name     string
+		version  int
+		compress string
+		sizes    []int
+		seqs     []uint32
+		frames   []uint32 // seq of each frame
+	}{
+		{"v1", frameV1, "", []int{10, 20, 30}, nil, []uint32{0, 0, 0}},
+		{"v2 one batch", frameV2, "", []int{10, 20, 30}, nil, []uint32{0}},
+		{"v2 single", frameV2, "", []int{10}, nil, []uint32{0}},
+		{"v2 big alone", frameV2, "", []int{10, -1, 20}, nil, []uint32{0, 0, 0}},
+		{"v2 full", frameV2, "", []int{batchMaxBytes / 2, batchMaxBytes / 2}, nil, []uint32{0, 0}},
+		{"v2 compressed", frameV2, compressSnappy, []int{1000, 1000, 1000}, nil, []uint32{0}},
+		{"v2 numbered", frameV2, "", []int{10, 20, 30}, []uint32{5, 6, 7}, []uint32{5}},
+		{"v2 not following", frameV2, "", []int{10, 20, 30}, []uint32{5, 7, 8}, []uint32{5, 7}},
+		{"v2 partly numbered", frameV2, "", []int{10, 20, 30}, []uint32{0, 0, 3}, []uint32{0, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &frameCompressAlgo, tt.compress)
+			setGlobal(t, &frameCompressThreshold, 1024)
+			sf, cf := newTestFramers(t, tt.version, checksumAdler32, false)
+			sf.sendSeq = tt.seqs != nil
+			var msgs []*message
+			var want [][]byte
+			for i, size := range tt.sizes {
+				data := big
+				if size >= 0 {
+					data = bytes.Repeat([]byte{byte(i + 1)}, size)
+				}
+				msg := &message{protoID: int16(1001 + i), proto: data}
+				if tt.seqs != nil {
+					msg.seq = tt.seqs[i]
+				}
+				msgs = append(msgs, msg)
+				want = append(want, data)
+			}
+
+			frames, err := sf.packBatch(msgs, func(m *message) ([]byte, error) { return m.proto.([]byte), nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seqs := frameSeqs(t, sf, frames); !equalSeqs(seqs, tt.frames) {
+				t.Fatalf("packed frames of seq %v, want %v", seqs, tt.frames)
+			}
+			if tt.seqs != nil {
+				// numbered by message, which Client.acceptSeq of server does not take
+				return
+			}
+
+			sink, err := testUnpack(cf, newTestBindedClient(), frames)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sink.payloads) != len(want) {
+				t.Fatalf("unpacked %v messages, want %v", len(sink.payloads), len(want))
+			}
+			for i := range want {
+				if sink.protoIDs[i] != int16(1001+i) || !bytes.Equal(sink.payloads[i], want[i]) {
+					t.Fatalf("message %v not match", i)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameInvalidBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"short entry", []byte{0x03, 0xe9, 0, 0}},
+		{"entry beyond payload", []byte{0x03, 0xe9, 0, 0, 0, 9, 1, 2}},
+		{"negative length", []byte{0x03, 0xe9, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf, sf := newTestFramers(t, frameV2, checksumAdler32, false)
+			frames, err := cf.packWith(frameFlagBatch, 0, batchProtoID, tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := testUnpack(sf, newTestBindedClient(), frames); err != errInvalidBatch {
+				t.Fatalf("got %v, want %v", err, errInvalidBatch)
+			}
+		})
+	}
+}
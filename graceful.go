@@ -0,0 +1,379 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	atom "sync/atomic"
+	"time"
+)
+
+// Zero-downtime restart:
+// On SIGUSR2 the running process starts a new process of the same binary, passing
+// its listeners as extra files. The names of the listeners are passed by the environment
+// variable listenFdsEnv, the first one is fd 3. The write end of a pipe follows the listeners,
+// its fd is passed by readyFdEnv. The new process writes a byte to it when all the listeners
+// it inherits are listening again. Then the old process stops accepting, waits until all clients
+// disconnect or drainMaxTime passes, and quits. If the new process exits or is not ready in
+// readyMaxTime, it is killed, and the old process keeps serving.
+//
+// rudp sessions are not drained, datagrams of old sessions go to the new process,
+// which ignores them, so these clients reconnect.
+
+const (
+	listenFdsEnv = "BIBLIO_LISTEN_FDS"
+	readyFdEnv   = "BIBLIO_READY_FD"
+)
+
+// Names of listeners
+const (
+	listenerPlayer = "player"
+	listenerWS     = "ws"
+	listenerUDP    = "udp"
+	listenerUnix   = "unix"
+	listenerAdmin  = "admin"
+	listenerWeb    = "web"
+)
+
+var drainMaxTime = 10 * time.Minute
+var readyMaxTime = time.Minute
+
+var errListenerNotInherited = errors.New("listener not inherited")
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+type namedListener struct {
+	name string
+	ln   filer
+}
+
+var muxListeners sync.Mutex
+var listeners []*namedListener
+var readyReported bool // guarded by muxListeners
+
+var restartGuard int32
+
+func registerListener(name string, ln filer) {
+	muxListeners.Lock()
+	defer muxListeners.Unlock()
+	listeners = append(listeners, &namedListener{name, ln})
+	reportReadyLocked()
+}
+
+// inheritedListenersRegistered returns true if all listeners passed by the parent process
+// are registered. muxListeners MUST be locked.
+func inheritedListenersRegistered() bool {
+	names := os.Getenv(listenFdsEnv)
+	if names == "" {
+		return true
+	}
+	for _, n := range strings.Split(names, ",") {
+		found := false
+		for _, l := range listeners {
+			if l.name == n {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// reportReadyLocked tells the parent process that this process is ready, once all inherited
+// listeners are registered. muxListeners MUST be locked.
+func reportReadyLocked() {
+	if readyReported || !inheritedListenersRegistered() {
+		return
+	}
+	readyReported = true
+
+	s := os.Getenv(readyFdEnv)
+	if s == "" {
+		return
+	}
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		log.Printf("restart: invalid %v[%v]\n", readyFdEnv, s)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Printf("restart: report ready error [%v]\n", err)
+	}
+	f.Close()
+	log.Println("restart: ready reported to the parent process")
+}
+
+// reportReady reports readiness if no listener is inherited.
+func reportReady() {
+	muxListeners.Lock()
+	defer muxListeners.Unlock()
+	reportReadyLocked()
+}
+
+// inheritedFile returns the file of a listener passed by the parent process.
+func inheritedFile(name string) (*os.File, error) {
+	names := os.Getenv(listenFdsEnv)
+	if names == "" {
+		return nil, errListenerNotInherited
+	}
+	for i, n := range strings.Split(names, ",") {
+		if n == name {
+			return os.NewFile(uintptr(3+i), name), nil
+		}
+	}
+	return nil, errListenerNotInherited
+}
+
+// listenTCP returns the inherited tcp listener, or listens on addr.
+func listenTCP(name string, addr string) (*net.TCPListener, error) {
+	var ln *net.TCPListener
+	if f, err := inheritedFile(name); err == nil {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if ln, ok = l.(*net.TCPListener); !ok {
+			l.Close()
+			return nil, fmt.Errorf("inherited listener[%v] is not tcp", name)
+		}
+		log.Printf("listener[%v] inherited\n", name)
+	} else {
+		tcpaddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if ln, err = net.ListenTCP("tcp", tcpaddr); err != nil {
+			return nil, err
+		}
+	}
+
+	registerListener(name, ln)
+	return ln, nil
+}
+
+// listenUDP returns the inherited udp conn, or listens on addr.
+func listenUDP(name string, addr string) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if f, err := inheritedFile(name); err == nil {
+		c, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if conn, ok = c.(*net.UDPConn); !ok {
+			c.Close()
+			return nil, fmt.Errorf("inherited listener[%v] is not udp", name)
+		}
+		log.Printf("listener[%v] inherited\n", name)
+	} else {
+		udpaddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if conn, err = net.ListenUDP("udp", udpaddr); err != nil {
+			return nil, err
+		}
+	}
+
+	registerListener(name, conn)
+	return conn, nil
+}
+
+// listenUnix returns the inherited unix listener, or listens on path.
+// The socket file is not removed when the listener is closed, because it may be
+// used by a new process. A stale socket file is removed before listening.
+func listenUnix(name string, path string) (*net.UnixListener, error) {
+	var ln *net.UnixListener
+	if f, err := inheritedFile(name); err == nil {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if ln, ok = l.(*net.UnixListener); !ok {
+			l.Close()
+			return nil, fmt.Errorf("inherited listener[%v] is not unix", name)
+		}
+		log.Printf("listener[%v] inherited\n", name)
+	} else {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		unixaddr, err := net.ResolveUnixAddr("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if ln, err = net.ListenUnix("unix", unixaddr); err != nil {
+			return nil, err
+		}
+	}
+	ln.SetUnlinkOnClose(false)
+
+	registerListener(name, ln)
+	return ln, nil
+}
+
+// restart starts a new process with the listeners, and drains this process when the new one is ready.
+func restart() {
+	if needQuit() || needDrain() {
+		return
+	}
+	if !atom.CompareAndSwapInt32(&restartGuard, 0, 1) {
+		return
+	}
+
+	muxListeners.Lock()
+	names := make([]string, 0, len(listeners))
+	files := make([]*os.File, 0, len(listeners))
+	for _, l := range listeners {
+		f, err := l.ln.File()
+		if err != nil {
+			log.Printf("restart: file of listener[%v] error [%v]\n", l.name, err)
+			continue
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+	muxListeners.Unlock()
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Printf("restart: pipe error [%v]\n", err)
+		atom.StoreInt32(&restartGuard, 0)
+		return
+	}
+	defer w.Close()
+
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, listenFdsEnv+"=") && !strings.HasPrefix(e, readyFdEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env, listenFdsEnv+"="+strings.Join(names, ","))
+	env = append(env, readyFdEnv+"="+strconv.Itoa(3+len(files)))
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	if err := cmd.Start(); err != nil {
+		log.Printf("restart: start new process error [%v]\n", err)
+		r.Close()
+		atom.StoreInt32(&restartGuard, 0)
+		return
+	}
+
+	log.Printf("restart: new process [%v] started, waiting for it to be ready\n", cmd.Process.Pid)
+	go func() {
+		if waitChildReady(cmd, r) {
+			log.Printf("restart: new process [%v] ready, draining\n", cmd.Process.Pid)
+			setDrain()
+		} else {
+			atom.StoreInt32(&restartGuard, 0)
+		}
+	}()
+}
+
+// waitChildReady returns true if the child reports readiness by r in readyMaxTime.
+// Otherwise the child is killed if it is still running. r is closed.
+func waitChildReady(cmd *exec.Cmd, r *os.File) bool {
+	defer r.Close()
+
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		ready <- n == 1
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	timer := time.NewTimer(readyMaxTime)
+	defer timer.Stop()
+
+	select {
+	case ok := <-ready:
+		if ok {
+			return true
+		}
+		// the pipe is closed without a byte, the child has exited or is broken
+		log.Printf("restart: new process [%v] closed the ready pipe\n", cmd.Process.Pid)
+	case err := <-exited:
+		log.Printf("restart: new process [%v] exited before ready [%v]\n", cmd.Process.Pid, err)
+		return false
+	case <-timer.C:
+		log.Printf("restart: new process [%v] not ready in %v\n", cmd.Process.Pid, readyMaxTime)
+	case <-getQuit():
+		return false
+	}
+	cmd.Process.Kill()
+	return false
+}
+
+func (b *Server) startDrainWatcher() {
+	b.wgAddOne()
+	go b.watchDrain()
+}
+
+// watchDrain quits when all clients and online players are gone after draining begins,
+// or drainMaxTime passes.
+func (b *Server) watchDrain() {
+	defer b.wgDone()
+	defer log.Println("drain watcher quit")
+
+	select {
+	case <-getDrain():
+	case <-getQuit():
+		return
+	}
+
+	deadline := time.Now().Add(drainMaxTime)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-getQuit():
+			return
+		}
+
+		clients := b.clientCount()
+		online := b.onlinePlayerCount()
+		if clients == 0 && online == 0 {
+			log.Println("drain: all clients gone")
+			setQuit()
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Printf("drain: timeout, clients[%v] online players[%v] left\n", clients, online)
+			setQuit()
+			return
+		}
+	}
+}
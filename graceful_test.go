@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestWaitChildReady(t *testing.T) {
+	setGlobal(t, &readyMaxTime, 500*time.Millisecond)
+
+	tests := []struct {
+		name   string
+		script string // run by sh, the ready pipe is fd 3
+		ready  bool
+	}{
+		{"ready", "printf x >&3; sleep 5", true},
+		{"exits", "exit 1", false},
+		{"closes pipe", "exec 3>&-; sleep 5", false},
+		{"not ready in time", "sleep 5", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("sh", "-c", tt.script)
+			cmd.ExtraFiles = []*os.File{w}
+			if err := cmd.Start(); err != nil {
+				t.Skip(err)
+			}
+			w.Close()
+			defer cmd.Process.Kill()
+
+			if got := waitChildReady(cmd, r); got != tt.ready {
+				t.Fatalf("got %v, want %v", got, tt.ready)
+			}
+		})
+	}
+}
+
+func TestInheritedListenersRegistered(t *testing.T) {
+	muxListeners.Lock()
+	defer muxListeners.Unlock()
+	old := listeners
+	defer func() { listeners = old }()
+	listeners = []*namedListener{{name: listenerPlayer}}
+
+	tests := []struct {
+		names string
+		want  bool
+	}{
+		{"", true},
+		{listenerPlayer, true},
+		{listenerPlayer + "," + listenerWS, false},
+	}
+	for _, tt := range tests {
+		t.Setenv(listenFdsEnv, tt.names)
+		if got := inheritedListenersRegistered(); got != tt.want {
+			t.Fatalf("names %q: got %v, want %v", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestInheritedFileNotPassed(t *testing.T) {
+	for _, names := range []string{"", listenerWS, listenerWS + "," + listenerUDP} {
+		t.Setenv(listenFdsEnv, names)
+		if _, err := inheritedFile(listenerPlayer); err != errListenerNotInherited {
+			t.Fatalf("names %q: got %v, want %v", names, err, errListenerNotInherited)
+		}
+	}
+}
+
+func TestListenTCPRegistered(t *testing.T) {
+	t.Setenv(listenFdsEnv, listenerWS) // the player listener is not inherited
+	muxListeners.Lock()
+	old := listeners
+	listeners = nil
+	muxListeners.Unlock()
+	defer func() {
+		muxListeners.Lock()
+		listeners = old
+		muxListeners.Unlock()
+	}()
+
+	ln, err := listenTCP(listenerPlayer, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	muxListeners.Lock()
+	defer muxListeners.Unlock()
+	if len(listeners) != 1 || listeners[0].name != listenerPlayer || listeners[0].ln != ln {
+		t.Fatalf("%v listeners registered", len(listeners))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	proto "biblio/protocol"
+	"biblio/util"
+	"errors"
+	"github.com/ZhangGuangxu/netbuffer"
+)
+
+// Handshake of stream connections(tcp, tls, unix, rudp). Websocket negotiates by subprotocol instead.
+//
+// Before C2SAuth, the client sends:
+// [4 bytes handshakeMagic][uint8 protocol version][uint8 n][n bytes codec name]
+// or, to encrypt the session(see frame_cipher.go):
+// [4 bytes handshakeMagicEncrypt][uint8 protocol version][uint8 n][n bytes codec name][32 bytes X25519 public key]
+// If protocol version is not less than checksumProtocolVersion, the codec name is followed by
+// [uint8 m][m bytes checksum name], m 0 means the default of the listener(see frame_checksum.go).
+// Sealed frames have no checksum, but the checksum name is sent all the same.
+// The server replies:
+// [4 bytes magic of the request][uint8 close reason, util.InvalidReason means accepted]
+// followed by the 32 bytes X25519 public key of server and the 64 bytes signature of the
+// handshake transcript if the session is encrypted and accepted(see frame_cipher.go).
+// An encrypted session is rejected with util.EncryptionUnavailable if handshakeKey is not configured.
+// If rejected, the server closes the connection after the reply.
+//
+// A frame starts with its int32 length, whose first byte is never 'B'(maxMessageLen is far smaller),
+// so a client sending C2SAuth directly is served by the default codec.
+
+const (
+	handshakeMagic        = "BBLO"
+	handshakeMagicEncrypt = "BBLE"
+	handshakeHeaderLen    = len(handshakeMagic) + 2
+	handshakeMaxNameLen   = 32
+	handshakeReplyLen     = len(handshakeMagic) + 1
+	minProtocolVersion    = 1
+	maxProtocolVersion    = proto.Version
+	legacyProtocolVersion = 1 // version of clients which send no handshake
+)
+
+var errHandshakeRejected = errors.New("handshake rejected")
+
+func handshakeReply(magic string, reason int8, keyReply []byte) *message {
+	b := make([]byte, 0, handshakeReplyLen+len(keyReply))
+	b = append(b, magic...)
+	b = append(b, byte(reason))
+	b = append(b, keyReply...)
+	return &message{protoID: 0, proto: rawFrame(b)}
+}
+
+// handleHandshake reads the handshake in incoming. It returns done=false if more data is needed.
+// When done, codec is the codec for later frames.
+// If the handshake is rejected, the reply is sent and errHandshakeRejected is returned.
+// secure tells whether the connection is over TLS.
+func handleHandshake(client *Client, incoming *netbuffer.Buffer, secure bool) (codec Codec, done bool, err error) {
+	if incoming.ReadableBytes() < 1 {
+		return nil, false, nil
+	}
+	if incoming.PeekAsByteSlice(1)[0] != handshakeMagic[0] {
+		if handshakeRequired {
+			return nil, true, rejectHandshake(client, handshakeMagic, util.InvalidHandshake)
+		}
+		if encryptionRequired && !secure {
+			return nil, true, rejectHandshake(client, handshakeMagic, util.EncryptionRequired)
+		}
+		client.setCodecSuite(defaultCodecSuite)
+		client.setProtocolVersion(legacyProtocolVersion)
+		return defaultCodecSuite.newCodec(newFramer(frameVersionOf(legacyProtocolVersion))), true, nil
+	}
+
+	if incoming.ReadableBytes() < handshakeHeaderLen {
+		return nil, false, nil
+	}
+	header := incoming.PeekAsByteSlice(handshakeHeaderLen)
+	magic := string(header[:len(handshakeMagic)])
+	if magic != handshakeMagic && magic != handshakeMagicEncrypt {
+		return nil, true, rejectHandshake(client, handshakeMagic, util.InvalidHandshake)
+	}
+	encrypt := magic == handshakeMagicEncrypt
+	version := int(header[len(handshakeMagic)])
+	nameLen := int(header[len(handshakeMagic)+1])
+	if nameLen > handshakeMaxNameLen {
+		return nil, true, rejectHandshake(client, magic, util.InvalidHandshake)
+	}
+	need := handshakeHeaderLen + nameLen
+	sumNameLen := -1
+	if version >= checksumProtocolVersion {
+		if incoming.ReadableBytes() < need+1 {
+			return nil, false, nil
+		}
+		sumNameLen = int(incoming.PeekAsByteSlice(need + 1)[need])
+		if sumNameLen > handshakeMaxNameLen {
+			return nil, true, rejectHandshake(client, magic, util.InvalidHandshake)
+		}
+		need += 1 + sumNameLen
+	}
+	keyLen := 0
+	if encrypt {
+		keyLen = cipherPublicKeyLen
+	}
+	if incoming.ReadableBytes() < need+keyLen {
+		return nil, false, nil
+	}
+	var request []byte // signed as a part of the transcript
+	if encrypt {
+		request = append([]byte(nil), incoming.PeekAsByteSlice(need+keyLen)...)
+	}
+	incoming.Retrieve(handshakeHeaderLen)
+	name := string(incoming.PeekAsByteSlice(nameLen))
+	incoming.Retrieve(nameLen)
+	var sumName string
+	if sumNameLen >= 0 {
+		incoming.Retrieve(1)
+		sumName = string(incoming.PeekAsByteSlice(sumNameLen))
+		incoming.Retrieve(sumNameLen)
+	}
+	clientPublic := append([]byte(nil), incoming.PeekAsByteSlice(keyLen)...)
+	incoming.Retrieve(keyLen)
+
+	suite, err := getCodecSuite(name)
+	if err != nil {
+		return nil, true, rejectHandshake(client, magic, util.UnsupportedCodec)
+	}
+	if version < minProtocolVersion || version > maxProtocolVersion ||
+		version < suite.minVersion || version > suite.maxVersion {
+		return nil, true, rejectHandshake(client, magic, util.UnsupportedProtocolVersion)
+	}
+	if encryptionRequired && !secure && !encrypt {
+		return nil, true, rejectHandshake(client, magic, util.EncryptionRequired)
+	}
+	listenerChecksum := frameChecksumDefault
+	if secure {
+		listenerChecksum = frameChecksumTLS
+	}
+	checksum, err := checksumOf(version, sumName, listenerChecksum)
+	if err != nil {
+		return nil, true, rejectHandshake(client, magic, util.UnsupportedChecksum)
+	}
+
+	f := newFramer(frameVersionOf(version))
+	f.requireSeq = version >= seqProtocolVersion
+	f.sendSeq = version >= ackProtocolVersion
+	f.setChecksum(checksum)
+	var keyReply []byte
+	if encrypt {
+		if handshakeSigner == nil {
+			return nil, true, rejectHandshake(client, magic, util.EncryptionUnavailable)
+		}
+		fc, r, err := newServerFrameCipher(handshakeSigner, request, clientPublic)
+		if err != nil {
+			return nil, true, rejectHandshake(client, magic, util.InvalidHandshake)
+		}
+		f.setCipher(fc)
+		keyReply = r
+	}
+
+	client.setCodecSuite(suite)
+	client.setProtocolVersion(version)
+	client.setReplayProtected(secure || encrypt)
+	client.recver.addMessage(handshakeReply(magic, util.InvalidReason, keyReply))
+	return suite.newCodec(f), true, nil
+}
+
+func rejectHandshake(client *Client, magic string, reason int8) error {
+	client.sender.notifyClose()
+	client.recver.addMessage(handshakeReply(magic, reason, nil))
+	client.recver.notifyClose()
+	return errHandshakeRejected
+}
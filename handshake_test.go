@@ -0,0 +1,156 @@
+package main
+
+import (
+	"biblio/util"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/ZhangGuangxu/netbuffer"
+	"testing"
+)
+
+func TestHandleHandshake(t *testing.T) {
+
+	const accepted = util.InvalidReason
+	tests := []struct {
+		name     string
+		data     string
+		required bool // handshakeRequired
+		secure   bool // over TLS
+		done     bool // false means more data is needed
+		reason   int8 // of the reply, -1 means no reply
+		suite    string
+		version  int
+		checksum string // of the pb codec
+		left     int    // bytes not taken
+	}{
+		{"empty", "", false, false, false, -1, "", 0, "", 0},
+		{"legacy", "\x00\x00\x00\x10", false, false, true, -1, codecNameJSON, legacyProtocolVersion, "", 4},
+		{"legacy not allowed", "\x00\x00\x00\x10", true, false, true, util.InvalidHandshake, "", 0, "", 4},
+		{"truncated magic", "BBL", false, false, false, -1, "", 0, "", 3},
+		{"truncated header", "BBLO\x06", false, false, false, -1, "", 0, "", 5},
+		{"truncated checksum", "BBLO\x06\x02pb\x06crc", false, false, false, -1, "", 0, "", 12},
+		{"invalid magic", "BXLO\x06\x02pb\x00", false, false, true, util.InvalidHandshake, "", 0, "", 9},
+		{"codec name too long", "BBLO\x06\x21", false, false, true, util.InvalidHandshake, "", 0, "", 6},
+		{"unknown codec", "BBLO\x06\x03xml\x00", false, false, true, util.UnsupportedCodec, "", 0, "", 0},
+		{"version 0", "BBLO\x00\x02pb", false, false, true, util.UnsupportedProtocolVersion, "", 0, "", 0},
+		{"version too new", "BBLO\x7f\x02pb\x00", false, false, true, util.UnsupportedProtocolVersion, "", 0, "", 0},
+		{"unknown checksum", "BBLO\x06\x02pb\x03md5", false, false, true, util.UnsupportedChecksum, "", 0, "", 0},
+		{"default checksum", "BBLO\x06\x02pb\x00", false, false, true, accepted, codecNamePB, 6, frameChecksumDefault, 0},
+		{"default checksum of tls", "BBLO\x06\x02pb\x00", false, true, true, accepted, codecNamePB, 6, frameChecksumTLS, 0},
+		{"chosen checksum", "BBLO\x06\x02pb\x08xxhash64", false, false, true, accepted, codecNamePB, 6, checksumXXHash64, 0},
+		{"below checksumProtocolVersion", "BBLO\x03\x02pb\x00\x00", false, false, true, accepted, codecNamePB, 3, checksumAdler32, 2},
+		{"frames follow", "BBLO\x06\x02pb\x00\x00\x00\x00\x10", false, false, true, accepted, codecNamePB, 6, frameChecksumDefault, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &handshakeRequired, tt.required)
+			client := newClient()
+			buf := netbuffer.NewBuffer()
+			buf.Append([]byte(tt.data))
+
+			codec, done, err := handleHandshake(client, buf, tt.secure)
+			if done != tt.done {
+				t.Fatalf("done %v, want %v", done, tt.done)
+			}
+			if buf.ReadableBytes() != tt.left {
+				t.Fatalf("%v bytes left, want %v", buf.ReadableBytes(), tt.left)
+			}
+
+			inCh := client.recver.(*messageChannel).inCh
+			if tt.reason < 0 {
+				if len(inCh) != 0 {
+					t.Fatal("unexpected reply")
+				}
+			} else {
+				reply := (<-inCh).proto.(rawFrame)
+				if len(reply) != handshakeReplyLen || int8(reply[len(handshakeMagic)]) != tt.reason {
+					t.Fatalf("reply %q, want reason %v", reply, tt.reason)
+				}
+			}
+			if tt.reason > 0 {
+				if err != errHandshakeRejected {
+					t.Fatalf("got %v, want %v", err, errHandshakeRejected)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !done {
+				return
+			}
+
+			if client.suite.name != tt.suite || client.protocolVersion != tt.version {
+				t.Fatalf("codec %v v%v, want %v v%v", client.suite.name, client.protocolVersion, tt.suite, tt.version)
+			}
+			if pb, ok := codec.(*pbCodec); ok && pb.frame.checksum.name != tt.checksum {
+				t.Fatalf("checksum %v, want %v", pb.frame.checksum.name, tt.checksum)
+			}
+			if client.replayProtected != tt.secure {
+				t.Fatalf("replay protected %v over tls %v", client.replayProtected, tt.secure)
+			}
+		})
+	}
+}
+
+func TestHandleHandshakeEncrypted(t *testing.T) {
+	_, signer, _ := ed25519.GenerateKey(rand.Reader)
+	setGlobal(t, &handshakeSigner, signer)
+
+	client := newClient()
+	buf := netbuffer.NewBuffer()
+	buf.Append(newTestHandshakeClient(t, "\x06\x02pb\x00").request)
+	if _, done, err := handleHandshake(client, buf, false); !done || err != nil {
+		t.Fatalf("done %v, %v", done, err)
+	}
+	if !client.replayProtected {
+		t.Fatal("encrypted session not replay protected")
+	}
+}
+
+func TestHandleHandshakeEncryption(t *testing.T) {
+	_, signer, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keyReplyLen = cipherPublicKeyLen + cipherSignatureLen
+	encrypted := string(newTestHandshakeClient(t, "\x02\x02pb").request)
+	tests := []struct {
+		name     string
+		data     string
+		noKey    bool // handshakeKey not configured
+		required bool // encryptionRequired
+		secure   bool // over TLS
+		reason   int8 // of the reply
+		keyLen   int  // bytes of the reply after the reason
+	}{
+		{"encrypted", encrypted, false, false, false, util.InvalidReason, keyReplyLen},
+		{"encrypted over tls", encrypted, false, true, true, util.InvalidReason, keyReplyLen},
+		{"no handshake key", encrypted, true, false, false, util.EncryptionUnavailable, 0},
+		{"invalid key", handshakeMagicEncrypt + "\x02\x02pb" + string(make([]byte, cipherPublicKeyLen)),
+			false, false, false, util.InvalidHandshake, 0},
+		{"plain", "BBLO\x02\x02pb", false, false, false, util.InvalidReason, 0},
+		{"plain required", "BBLO\x02\x02pb", false, true, false, util.EncryptionRequired, 0},
+		{"plain over tls", "BBLO\x02\x02pb", false, true, true, util.InvalidReason, 0},
+		{"legacy required", "\x00\x00\x00\x10", false, true, false, util.EncryptionRequired, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &encryptionRequired, tt.required)
+			if tt.noKey {
+				setGlobal(t, &handshakeSigner, nil)
+			} else {
+				setGlobal(t, &handshakeSigner, signer)
+			}
+			client := newClient()
+			buf := netbuffer.NewBuffer()
+			buf.Append([]byte(tt.data))
+			handleHandshake(client, buf, tt.secure)
+
+			reply := (<-client.recver.(*messageChannel).inCh).proto.(rawFrame)
+			if len(reply) != handshakeReplyLen+tt.keyLen || int8(reply[len(handshakeMagic)]) != tt.reason {
+				t.Fatalf("reply %q, want reason %v", reply, tt.reason)
+			}
+		})
+	}
+}
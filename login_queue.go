@@ -0,0 +1,307 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Login queue.
+//
+// An authenticated client takes a slot before it is binded to its player, and keeps it until
+// it is closed. If all playerCapacity slots are taken, the client is parked in the login queue
+// instead of being closed, and S2CAuth passed is not sent until it is admitted. A client of
+// queueProtocolVersion gets S2CQueuePosition when it is parked and every loginQueueUpdateInterval
+// then. EstimatedWait is in seconds, 0 means unknown yet.
+//
+// Queued clients are admitted in FIFO order as slots are freed, lane by lane. The lane of a
+// client is its vip level from the Authenticator, up to loginQueueLanes-1. Higher lanes are
+// always admitted first. A client resuming a session(see resume.go), or logging in a player
+// which is online, takes a slot without waiting, as the slot of the old client is freed soon.
+//
+// A client waiting longer than loginQueueMaxWait is closed by the timing wheel, which frees its
+// place in the queue(see clientStateQueued).
+//
+// The queue is bounded by maxConnectionCount, set it above playerCapacity to leave room for the queue.
+
+// queueProtocolVersion is the first protocol version whose clients get S2CQueuePosition.
+const queueProtocolVersion = 6
+
+type queuedClient struct {
+	client     *Client
+	uid        int64
+	enqueuedAt time.Time
+	gone       bool // closed while waiting, dropped lazily
+}
+
+type queueAdmit struct {
+	client *Client
+	uid    int64
+}
+
+type queuePosition struct {
+	client   *Client
+	position uint32
+	wait     uint32
+}
+
+type loginQueue struct {
+	mux      sync.Mutex
+	taken    int               // slots taken
+	lanes    [][]*queuedClient // lanes[i] is of vip level i
+	waiting  int               // clients in lanes and not gone
+	interval time.Duration     // moving average of intervals between admissions from the queue
+	lastPop  time.Time         // the last admission from the queue, zero if the queue has been empty
+
+	queued    int64 // clients parked
+	admitted  int64 // clients admitted from the queue
+	abandoned int64 // clients closed while waiting
+}
+
+func newLoginQueue() *loginQueue {
+	lanes := loginQueueLanes
+	if lanes < 1 {
+		lanes = 1
+	}
+	return &loginQueue{
+		lanes: make([][]*queuedClient, lanes),
+	}
+}
+
+func (q *loginQueue) hasFreeSlot() bool {
+	return playerCapacity <= 0 || q.taken < playerCapacity
+}
+
+// enter takes a slot for c, or parks it. force takes a slot even if there is no free one.
+// It returns true if c takes a slot, otherwise position and estimated wait of c in the queue,
+// position 0 means c is removed from the server already.
+// c MUST be in queued state.
+func (q *loginQueue) enter(c *Client, uid int64, vip int, force bool) (bool, uint32, uint32) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	// c could have left already, when its 'handleWrite' goroutine quits first
+	if c.slot || c.queueEntry != nil || !serverInst.hasClient(c) {
+		return false, 0, 0
+	}
+	if force || (q.waiting == 0 && q.hasFreeSlot()) {
+		c.slot = true
+		q.taken++
+		return true, 0, 0
+	}
+
+	lane := vip
+	if lane < 0 {
+		lane = 0
+	} else if lane >= len(q.lanes) {
+		lane = len(q.lanes) - 1
+	}
+	e := &queuedClient{client: c, uid: uid, enqueuedAt: time.Now()}
+	q.lanes[lane] = append(q.lanes[lane], e)
+	c.queueEntry = e
+	q.waiting++
+	q.queued++
+
+	var position int
+	for i := len(q.lanes) - 1; i > lane; i-- {
+		position += q.laneLen(i)
+	}
+	position += q.laneLen(lane)
+	return false, uint32(position), q.estimateWait(position)
+}
+
+// take makes c take a slot without waiting.
+func (q *loginQueue) take(c *Client) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	if !c.slot && serverInst.hasClient(c) {
+		c.slot = true
+		q.taken++
+	}
+}
+
+// leave frees the slot of c, or drops it from the queue. It is called when c is closed.
+func (q *loginQueue) leave(c *Client) {
+	q.mux.Lock()
+	if c.slot {
+		c.slot = false
+		q.taken--
+	} else if e := c.queueEntry; e != nil {
+		e.gone = true
+		c.queueEntry = nil
+		q.waiting--
+		q.abandoned++
+	}
+	admits := q.pop()
+	q.mux.Unlock()
+
+	q.admit(admits)
+}
+
+// laneLen returns count of clients not gone in lane i.
+func (q *loginQueue) laneLen(i int) int {
+	var n int
+	for _, e := range q.lanes[i] {
+		if !e.gone {
+			n++
+		}
+	}
+	return n
+}
+
+// pop takes clients out of the queue while there are free slots.
+func (q *loginQueue) pop() []*queueAdmit {
+	var admits []*queueAdmit
+	for i := len(q.lanes) - 1; i >= 0 && q.hasFreeSlot(); {
+		if len(q.lanes[i]) == 0 {
+			q.lanes[i] = nil
+			i--
+			continue
+		}
+		e := q.lanes[i][0]
+		q.lanes[i][0] = nil
+		q.lanes[i] = q.lanes[i][1:]
+		if e.gone {
+			continue
+		}
+
+		e.client.queueEntry = nil
+		e.client.slot = true
+		q.taken++
+		q.waiting--
+		q.admitted++
+		q.observePop()
+		admits = append(admits, &queueAdmit{client: e.client, uid: e.uid})
+	}
+	if q.waiting == 0 {
+		q.lastPop = time.Time{}
+	}
+	return admits
+}
+
+func (q *loginQueue) observePop() {
+	now := time.Now()
+	if !q.lastPop.IsZero() {
+		d := now.Sub(q.lastPop)
+		if q.interval == 0 {
+			q.interval = d
+		} else {
+			q.interval = (q.interval*4 + d) / 5
+		}
+	}
+	q.lastPop = now
+}
+
+// estimateWait returns seconds to wait at position, 0 means unknown.
+func (q *loginQueue) estimateWait(position int) uint32 {
+	if q.interval == 0 {
+		return 0
+	}
+	d := time.Duration(position) * q.interval
+	return uint32((d + time.Second - 1) / time.Second)
+}
+
+// admit binds clients taken out of the queue. It is called without q.mux locked.
+func (q *loginQueue) admit(admits []*queueAdmit) {
+	for _, a := range admits {
+		a.client.onAdmit()
+		a.client.bind(a.uid)
+	}
+}
+
+// positions drops gone clients, and returns positions of waiting clients to be told.
+func (q *loginQueue) positions() []*queuePosition {
+	var ps []*queuePosition
+	var position int
+	for i := len(q.lanes) - 1; i >= 0; i-- {
+		lane := q.lanes[i][:0]
+		for _, e := range q.lanes[i] {
+			if e.gone {
+				continue
+			}
+			lane = append(lane, e)
+			position++
+			if e.client.protocolVersion >= queueProtocolVersion {
+				ps = append(ps, &queuePosition{
+					client:   e.client,
+					position: uint32(position),
+					wait:     q.estimateWait(position),
+				})
+			}
+		}
+		for j := len(lane); j < len(q.lanes[i]); j++ {
+			q.lanes[i][j] = nil
+		}
+		q.lanes[i] = lane
+	}
+	return ps
+}
+
+func (q *loginQueue) update() {
+	q.mux.Lock()
+	admits := q.pop()
+	ps := q.positions()
+	q.mux.Unlock()
+
+	q.admit(admits)
+	for _, p := range ps {
+		if p.client.needClose() {
+			continue
+		}
+		p.client.recver.addMessage(p.client.suite.creater.createS2CQueuePosition(p.position, p.wait))
+	}
+}
+
+func (q *loginQueue) stats() map[string]interface{} {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	lanes := make([]int, len(q.lanes))
+	var longest time.Duration
+	now := time.Now()
+	for i := range q.lanes {
+		lanes[i] = q.laneLen(i)
+		for _, e := range q.lanes[i] {
+			if !e.gone {
+				if d := now.Sub(e.enqueuedAt); d > longest {
+					longest = d
+				}
+				break
+			}
+		}
+	}
+	return map[string]interface{}{
+		"capacity":      playerCapacity,
+		"taken":         q.taken,
+		"waiting":       q.waiting,
+		"lanes":         lanes,
+		"intervalMs":    int64(q.interval / time.Millisecond),
+		"longestWaitMs": int64(longest / time.Millisecond),
+		"queued":        q.queued,
+		"admitted":      q.admitted,
+		"abandoned":     q.abandoned,
+	}
+}
+
+func (b *Server) startLoginQueue() {
+	b.wgAddOne()
+	go b.runLoginQueue()
+}
+
+// runLoginQueue sends S2CQueuePosition to queued clients periodically.
+func (b *Server) runLoginQueue() {
+	defer b.wgDone()
+	defer log.Println("login queue quit")
+
+	ticker := time.NewTicker(loginQueueUpdateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-getQuit():
+			return
+		}
+		b.loginQueue.update()
+	}
+}
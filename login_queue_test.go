@@ -0,0 +1,199 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestQueuedClient returns a client on serverInst in queued state.
+func newTestQueuedClient(t *testing.T) *Client {
+	c := newClient()
+	serverInst.addClient(c)
+	c.onQueue()
+	t.Cleanup(func() {
+		// not by removeClient, which leaves the login queue of serverInst
+		serverInst.muxc.Lock()
+		delete(serverInst.clients, c)
+		serverInst.muxc.Unlock()
+	})
+	return c
+}
+
+func TestLoginQueueLanes(t *testing.T) {
+	tests := []struct {
+		name      string
+		capacity  int
+		vips      []int    // of clients entering, their uids are 1, 2, ...
+		positions []uint32 // 0 means taking a slot
+		admits    []int64  // order of uids admitted as all slots are freed
+	}{
+		{"fifo", 1, []int{0, 0, 0}, []uint32{0, 1, 2}, []int64{2, 3}},
+		{"vip first", 1, []int{0, 0, 2, 1, 2}, []uint32{0, 1, 1, 2, 2}, []int64{3, 5, 4, 2}},
+		{"vip clamped", 1, []int{0, 9, -1, 3}, []uint32{0, 1, 2, 2}, []int64{2, 4, 3}},
+		{"free slots", 2, []int{0, 3, 0}, []uint32{0, 0, 1}, []int64{3}},
+		{"no capacity", 0, []int{0, 0, 0}, []uint32{0, 0, 0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &playerCapacity, tt.capacity)
+			setGlobal(t, &loginQueueLanes, 4)
+			q := newLoginQueue()
+
+			for i, vip := range tt.vips {
+				c := newTestQueuedClient(t)
+				slot, position, _ := q.enter(c, int64(i+1), vip, false)
+				if slot != (tt.positions[i] == 0) || position != tt.positions[i] {
+					t.Fatalf("client %v: got slot %v position %v, want position %v", i+1, slot, position, tt.positions[i])
+				}
+			}
+
+			if tt.capacity > 0 {
+				playerCapacity = q.taken + len(tt.vips)
+			}
+			var got []int64
+			for _, a := range q.pop() {
+				got = append(got, a.uid)
+				if !a.client.slot || a.client.queueEntry != nil {
+					t.Fatal("admitted client takes no slot")
+				}
+			}
+			if len(got) != len(tt.admits) {
+				t.Fatalf("admitted %v, want %v", got, tt.admits)
+			}
+			for i := range got {
+				if got[i] != tt.admits[i] {
+					t.Fatalf("admitted %v, want %v", got, tt.admits)
+				}
+			}
+			if q.waiting != 0 || !q.lastPop.IsZero() {
+				t.Fatalf("waiting %v after all admitted", q.waiting)
+			}
+		})
+	}
+}
+
+func TestLoginQueueLeave(t *testing.T) {
+	setGlobal(t, &playerCapacity, 1)
+	setGlobal(t, &loginQueueLanes, 2)
+	q := newLoginQueue()
+
+	holder := newTestQueuedClient(t)
+	gone := newTestQueuedClient(t)
+	next := newTestQueuedClient(t)
+	q.enter(holder, 1, 0, false)
+	q.enter(gone, 2, 0, false)
+	if _, position, _ := q.enter(next, 3, 0, false); position != 2 {
+		t.Fatalf("position %v, want 2", position)
+	}
+
+	// a client closed while waiting is dropped
+	q.leave(gone)
+	if gone.queueEntry != nil || q.waiting != 1 || q.abandoned != 1 {
+		t.Fatal("gone client not dropped")
+	}
+	next.setProtocolVersion(queueProtocolVersion)
+	if ps := q.positions(); len(ps) != 1 || ps[0].client != next || ps[0].position != 1 {
+		t.Fatal("gone client counted in positions")
+	}
+
+	// the slot freed is taken by the next one, which is binded
+	q.leave(holder)
+	if holder.slot || !next.slot || q.taken != 1 || q.admitted != 1 {
+		t.Fatal("slot not passed to the next client")
+	}
+	if name := next.stateName(); name != "binding" {
+		t.Fatalf("admitted client in state %v", name)
+	}
+	if len(next.recver.(*messageChannel).inCh) != 1 {
+		t.Fatal("S2CAuth not sent to the admitted client")
+	}
+
+	q.leave(next)
+	if q.taken != 0 {
+		t.Fatalf("taken %v after all left", q.taken)
+	}
+}
+
+func TestLoginQueueTakeSlot(t *testing.T) {
+	setGlobal(t, &playerCapacity, 1)
+	setGlobal(t, &loginQueueLanes, 2)
+	q := newLoginQueue()
+
+	holder := newTestQueuedClient(t)
+	q.enter(holder, 1, 0, false)
+	if slot, _, _ := q.enter(holder, 1, 0, false); slot {
+		t.Fatal("a client takes two slots")
+	}
+
+	forced := newTestQueuedClient(t)
+	if slot, _, _ := q.enter(forced, 2, 0, true); !slot {
+		t.Fatal("forced client parked")
+	}
+	resumed := newTestQueuedClient(t)
+	q.take(resumed)
+	q.take(resumed)
+	if !resumed.slot || q.taken != 3 {
+		t.Fatalf("taken %v, want 3", q.taken)
+	}
+
+	removed := newClient()
+	if slot, position, _ := q.enter(removed, 4, 0, false); slot || position != 0 {
+		t.Fatal("client not on server entered")
+	}
+	q.take(removed)
+	if removed.slot {
+		t.Fatal("client not on server takes a slot")
+	}
+}
+
+func TestLoginQueueEstimateWait(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		position int
+		want     uint32
+	}{
+		{0, 5, 0},
+		{time.Second, 3, 3},
+		{1500 * time.Millisecond, 3, 5},
+		{10 * time.Millisecond, 1, 1},
+	}
+	for _, tt := range tests {
+		q := &loginQueue{interval: tt.interval}
+		if got := q.estimateWait(tt.position); got != tt.want {
+			t.Fatalf("interval %v position %v: got %v, want %v", tt.interval, tt.position, got, tt.want)
+		}
+	}
+}
+
+// TestLoginQueueDeadline checks that a client waiting too long is closed and frees its place,
+// the timing wheel is stood in for by releasing the item of its queued state.
+func TestLoginQueueDeadline(t *testing.T) {
+	setGlobal(t, &playerCapacity, 1)
+	setGlobal(t, &loginQueueLanes, 4)
+	q := newLoginQueue()
+
+	holder := newTestQueuedClient(t)
+	vip := newTestQueuedClient(t)
+	next := newTestQueuedClient(t)
+	q.enter(holder, 1, 0, false)
+	q.enter(vip, 2, 3, false)
+	q.enter(next, 3, 0, false)
+
+	vip.state.(*clientStateQueued).item.Release()
+	if !vip.needClose() {
+		t.Fatal("client waiting too long not closed")
+	}
+	// removeClient of the closed client
+	q.leave(vip)
+	if vip.queueEntry != nil || q.waiting != 1 || q.laneLen(3) != 0 {
+		t.Fatal("vip place not freed")
+	}
+
+	q.leave(holder)
+	if !next.slot || next.stateName() != "binding" {
+		t.Fatal("slot not passed to the next client")
+	}
+	if next.needClose() {
+		t.Fatal("admitted client closed")
+	}
+}
@@ -17,10 +17,36 @@ var needQuit func() bool
 var getQuit func() chan bool
 var setQuit func()
 
+// draining means stop accepting, and quit after existing clients are gone
+var needDrain func() bool
+var getDrain func() chan bool
+var setDrain func()
+
 func main() {
 	log.Println("runtime.NumCPU():", runtime.NumCPU())
 	//runtime.GOMAXPROCS(runtime.NumCPU())
 
+	initQuitAndDrain()
+
+	var wg sync.WaitGroup
+	startSignalHandler(&wg)
+
+	var err error
+	serverInst, err = NewServer()
+	if err != nil {
+		log.Printf("NewServer() returns error [%v]\n", err)
+		return
+	}
+	serverInst.start(&wg)
+
+	handleConsoleCommand()
+
+	log.Println("waiting for quit...")
+	wg.Wait()
+	log.Println("main goroutine quit")
+}
+
+func initQuitAndDrain() {
 	var quitGuard int32
 	quit := make(chan bool)
 	needQuit = func() bool {
@@ -40,27 +66,29 @@ func main() {
 		}
 	}
 
-	var wg sync.WaitGroup
-	startSignalHandler(&wg)
-
-	var err error
-	serverInst, err = NewServer()
-	if err != nil {
-		log.Printf("NewServer() returns error [%v]\n", err)
-		return
+	var drainGuard int32
+	drain := make(chan bool)
+	needDrain = func() bool {
+		select {
+		case <-drain:
+			return true
+		default:
+			return false
+		}
+	}
+	getDrain = func() chan bool {
+		return drain
+	}
+	setDrain = func() {
+		if atom.CompareAndSwapInt32(&drainGuard, 0, 1) {
+			close(drain)
+		}
 	}
-	serverInst.start(&wg)
-
-	handleConsoleCommand()
-
-	log.Println("waiting for quit...")
-	wg.Wait()
-	log.Println("main goroutine quit")
 }
 
 func startSignalHandler(wg *sync.WaitGroup) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -70,6 +98,14 @@ func startSignalHandler(wg *sync.WaitGroup) {
 			select {
 			case sig := <-sigs:
 				log.Println("signal:", sig)
+				if sig == syscall.SIGHUP {
+					reloadCertificates()
+					continue
+				}
+				if sig == syscall.SIGUSR2 {
+					restart()
+					continue
+				}
 				setQuit()
 				return
 			case <-getQuit():
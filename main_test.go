@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	initQuitAndDrain()
+
+	var err error
+	serverInst, err = NewServer()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	os.Exit(m.Run())
+}
+
+// setGlobal sets the config *p to v, and restores it when the test finishes.
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
@@ -4,4 +4,8 @@ package main
 type message struct {
 	protoID int16
 	proto   interface{}
+	seq     uint32 // sequence number of a message from client, 0 if not numbered
 }
+
+// rawFrame is sent as is without Codec, for example the handshake reply.
+type rawFrame []byte
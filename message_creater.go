@@ -1,9 +1,5 @@
 package main
 
-var messageCreater = jsonCreater
-
-// MessageCreater defines some methods to create different kinds of messages.
-type MessageCreater interface {
-	createS2CAuth(passed bool) *message
-	createS2CClose(reason int8) *message
-}
+// Protocols are described in protocol/schema, one file for each.
+// After changing them, run go generate in this directory.
+//go:generate go run ./protocol/protogen -schema protocol/schema
@@ -0,0 +1,76 @@
+// Code generated by protogen from protocol/schema. DO NOT EDIT.
+
+package main
+
+import (
+	proto "biblio/protocol"
+	protojson "biblio/protocol/json"
+	protopb "biblio/protocol/pb"
+)
+
+// MessageCreater defines some methods to create different kinds of messages.
+type MessageCreater interface {
+	createS2CAuth(passed bool, resumeToken string, lastSeq uint32) *message
+	createS2CClose(reason int8) *message
+	createS2CQueuePosition(position uint32, estimatedWait uint32) *message
+}
+
+func (c *JSONCreater) createS2CAuth(passed bool, resumeToken string, lastSeq uint32) *message {
+	v := &protojson.S2CAuth{
+		Passed:      passed,
+		ResumeToken: resumeToken,
+		LastSeq:     lastSeq,
+	}
+	protoID := proto.S2CAuthID
+	proto, _ := protojson.ProtoFactory.RequireWithSourceProto(protoID, v)
+	return &message{protoID: protoID, proto: proto}
+}
+
+func (c *JSONCreater) createS2CClose(reason int8) *message {
+	v := &protojson.S2CClose{
+		Reason: reason,
+	}
+	protoID := proto.S2CCloseID
+	proto, _ := protojson.ProtoFactory.RequireWithSourceProto(protoID, v)
+	return &message{protoID: protoID, proto: proto}
+}
+
+func (c *JSONCreater) createS2CQueuePosition(position uint32, estimatedWait uint32) *message {
+	v := &protojson.S2CQueuePosition{
+		Position:      position,
+		EstimatedWait: estimatedWait,
+	}
+	protoID := proto.S2CQueuePositionID
+	proto, _ := protojson.ProtoFactory.RequireWithSourceProto(protoID, v)
+	return &message{protoID: protoID, proto: proto}
+}
+
+func (c *PBCreater) createS2CAuth(passed bool, resumeToken string, lastSeq uint32) *message {
+	v := &protopb.S2CAuth{
+		Passed:      passed,
+		ResumeToken: resumeToken,
+		LastSeq:     lastSeq,
+	}
+	protoID := proto.S2CAuthID
+	proto, _ := protopb.ProtoFactory.RequireWithSourceProto(protoID, v)
+	return &message{protoID: protoID, proto: proto}
+}
+
+func (c *PBCreater) createS2CClose(reason int8) *message {
+	v := &protopb.S2CClose{
+		Reason: reason,
+	}
+	protoID := proto.S2CCloseID
+	proto, _ := protopb.ProtoFactory.RequireWithSourceProto(protoID, v)
+	return &message{protoID: protoID, proto: proto}
+}
+
+func (c *PBCreater) createS2CQueuePosition(position uint32, estimatedWait uint32) *message {
+	v := &protopb.S2CQueuePosition{
+		Position:      position,
+		EstimatedWait: estimatedWait,
+	}
+	protoID := proto.S2CQueuePositionID
+	proto, _ := protopb.ProtoFactory.RequireWithSourceProto(protoID, v)
+	return &message{protoID: protoID, proto: proto}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	protojson "biblio/protocol/json"
+	"bytes"
+	"github.com/ZhangGuangxu/netbuffer"
+	"github.com/vmihailenco/msgpack"
+)
+
+// msgpackCodec encodes the same protocols as jsonCodec(package protocol/json) in MessagePack.
+// Field names are taken from json tags, so game modules receive the same Go types
+// whichever of the two codecs a connection uses.
+// Its frame format is the same as jsonCodec.
+type msgpackCodec struct {
+	frame *framer
+
+	encBuf  *bytes.Buffer
+	encoder *msgpack.Encoder
+	decBuf  *bytes.Reader
+	decoder *msgpack.Decoder
+}
+
+func newMsgpackCodec(f *framer) *msgpackCodec {
+	c := &msgpackCodec{
+		frame:  f,
+		encBuf: &bytes.Buffer{},
+		decBuf: bytes.NewReader(nil),
+	}
+	c.encoder = msgpack.NewEncoder(c.encBuf).UseJSONTag(true).UseCompactEncoding(true)
+	c.decoder = msgpack.NewDecoder(c.decBuf).UseJSONTag(true)
+	return c
+}
+
+func (c *msgpackCodec) Unpack(buf *netbuffer.Buffer, client *Client) error {
+	return c.frame.unpack(buf, client, c.Decode)
+}
+
+func (c *msgpackCodec) Pack(msg *message) ([]byte, error) {
+	data, err := c.encodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.frame.pack(msg.seq, msg.protoID, data)
+}
+
+func (c *msgpackCodec) PackBatch(msgs []*message) ([]byte, error) {
+	return c.frame.packBatch(msgs, c.encodeMessage)
+}
+
+// encodeMessage encodes msg, and releases its proto.
+func (c *msgpackCodec) encodeMessage(msg *message) ([]byte, error) {
+	data, err := c.Encode(msg.proto)
+	if err != nil {
+		return nil, err
+	}
+	err = protojson.ProtoFactory.Release(msg.protoID, msg.proto)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *msgpackCodec) Decode(protoID int16, data []byte) (interface{}, error) {
+	proto, err := protojson.ProtoFactory.Require(protoID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.decBuf.Reset(data)
+	if err = c.decoder.Reset(c.decBuf); err != nil {
+		return nil, err
+	}
+	if err = c.decoder.Decode(proto); err != nil {
+		return nil, err
+	}
+
+	return proto, nil
+}
+
+// Encode returns data which is valid until the next Encode.
+func (c *msgpackCodec) Encode(proto interface{}) ([]byte, error) {
+	c.encBuf.Reset()
+	if err := c.encoder.Encode(proto); err != nil {
+		return nil, err
+	}
+	return c.encBuf.Bytes(), nil
+}
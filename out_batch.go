@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+)
+
+// outBatch collects messages to a client, which are packed by Codec.PackBatch and written at once.
+// A batch is full when it has batchMaxMessages messages, or its first message has waited batchMaxDelay.
+type outBatch struct {
+	msgs  []*message
+	first time.Time
+}
+
+func (b *outBatch) add(msg *message) {
+	if len(b.msgs) == 0 {
+		b.first = time.Now()
+	}
+	b.msgs = append(b.msgs, msg)
+}
+
+func (b *outBatch) isEmpty() bool {
+	return len(b.msgs) == 0
+}
+
+func (b *outBatch) isFull() bool {
+	return len(b.msgs) >= batchMaxMessages ||
+		(len(b.msgs) > 0 && time.Since(b.first) >= batchMaxDelay)
+}
+
+// pack packs and clears the batch. The result is valid until the next pack of codec.
+func (b *outBatch) pack(codec Codec) ([]byte, error) {
+	data, err := codec.PackBatch(b.msgs)
+	b.drop()
+	return data, err
+}
+
+// drop clears the batch without packing.
+func (b *outBatch) drop() {
+	for i := range b.msgs {
+		b.msgs[i] = nil
+	}
+	b.msgs = b.msgs[:0]
+}
+
+// stopTimer stops t and drains its channel, so that t can be Reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
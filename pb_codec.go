@@ -0,0 +1,76 @@
+package main
+
+import (
+	protopb "biblio/protocol/pb"
+	"errors"
+	"github.com/ZhangGuangxu/netbuffer"
+)
+
+var errNotPBMessage = errors.New("not a protobuf message")
+
+// pbCodec encodes protocols of package protocol/pb.
+// Its frame format is the same as jsonCodec.
+type pbCodec struct {
+	frame *framer
+}
+
+func newPBCodec(f *framer) *pbCodec {
+	return &pbCodec{
+		frame: f,
+	}
+}
+
+func (c *pbCodec) Unpack(buf *netbuffer.Buffer, client *Client) error {
+	return c.frame.unpack(buf, client, c.Decode)
+}
+
+func (c *pbCodec) Pack(msg *message) ([]byte, error) {
+	data, err := c.encodeMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.frame.pack(msg.seq, msg.protoID, data)
+}
+
+func (c *pbCodec) PackBatch(msgs []*message) ([]byte, error) {
+	return c.frame.packBatch(msgs, c.encodeMessage)
+}
+
+// encodeMessage encodes msg, and releases its proto.
+func (c *pbCodec) encodeMessage(msg *message) ([]byte, error) {
+	data, err := c.Encode(msg.proto)
+	if err != nil {
+		return nil, err
+	}
+	err = protopb.ProtoFactory.Release(msg.protoID, msg.proto)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *pbCodec) Decode(protoID int16, data []byte) (interface{}, error) {
+	proto, err := protopb.ProtoFactory.Require(protoID)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := proto.(protopb.Message)
+	if !ok {
+		return nil, errNotPBMessage
+	}
+	if err = m.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	return proto, nil
+}
+
+func (c *pbCodec) Encode(proto interface{}) ([]byte, error) {
+	m, ok := proto.(protopb.Message)
+	if !ok {
+		return nil, errNotPBMessage
+	}
+	return m.Marshal()
+}
@@ -0,0 +1,7 @@
+package main
+
+var pbCreater = &PBCreater{}
+
+// PBCreater creates protobuf proto instance.
+type PBCreater struct {
+}
@@ -4,6 +4,8 @@ import (
 	proto "biblio/protocol"
 	"biblio/util"
 	"errors"
+	"log"
+	"net"
 	"sync"
 	atom "sync/atomic"
 	"time"
@@ -16,6 +18,9 @@ var mapProtocol2PlayerHandler = map[int16](func(*Player, *message)){
 	proto.C2SHeartbeatID: func(player *Player, msg *message) {
 		player.playerHeartbeatModule.handle(msg)
 	},
+	proto.C2SAckID: func(player *Player, msg *message) {
+		player.handleAck(msg)
+	},
 }
 
 func dispatchMessageToPlayer(player *Player, msg *message) {
@@ -31,10 +36,19 @@ type Player struct {
 
 	bindReqs   chan *bindReqToPlayer
 	unbindReqs chan bool
+	resumeReqs chan *resumeReqToPlayer // taken by the goroutine running the player
 
 	recver messageMediator // take message from recver
 	sender messageMediator // add message to sender
 
+	remote net.Addr    // address of the binded client
+	suite  *codecSuite // codec suite of the binded client
+
+	lastInSeq uint32 // sequence number of the last message handled, kept across resumed clients
+
+	resumeToken string        // of the binded client, see resume.go
+	replay      *replayBuffer // messages sent to the binded client
+
 	toStop  int32
 	running int32
 
@@ -51,11 +65,14 @@ func newPlayer(r messageMediator, s messageMediator) *Player {
 	p := &Player{
 		bindReqs:       make(chan *bindReqToPlayer),
 		unbindReqs:     make(chan bool),
+		resumeReqs:     make(chan *resumeReqToPlayer, 1),
 		recver:         r,
 		sender:         s,
+		suite:          defaultCodecSuite,
 		unloadFlag:     make(chan bool),
 		playerBaseData: &PlayerBaseData{},
 	}
+	p.replay = newReplayBuffer(replayBufferSize, p.suite.factory)
 	p.state = newPlayerStateOffline(p)
 	p.playerBaseModule = newPlayerBaseModule(p)
 	p.playerHeartbeatModule = newPlayerHeartbeatModule(p)
@@ -115,6 +132,13 @@ func (p *Player) onHeartbeat() {
 	p.state.onHeartbeat()
 }
 
+// @public
+func (p *Player) stateName() string {
+	p.muxState.Lock()
+	defer p.muxState.Unlock()
+	return p.state.name()
+}
+
 func (p *Player) reqBind(req *bindReqToPlayer) bool {
 	select {
 	case p.bindReqs <- req:
@@ -234,19 +258,34 @@ func (p *Player) bind(req *bindReqToPlayer) {
 		if p.recver != nil {
 			p.recver.notifyClose()
 		}
-		p.sendMessageAnyway(messageCreater.createS2CClose(util.AnotherClientConnected))
+		p.sendMessageAnyway(p.suite.creater.createS2CClose(util.AnotherClientConnected))
 		if p.sender != nil {
 			p.sender.notifyClose()
 		}
 
-		p.recver = req.recverForPlayer
-		p.sender = req.senderForPlayer
+		p.switchClient(req)
 		p.setToStop(false)
 		p.start()
 		p.onBindSuccess()
 	}
 }
 
+// switchClient makes p send to the client of req, and sends it again critical messages
+// the last client did not ack.
+func (p *Player) switchClient(req *bindReqToPlayer) {
+	p.recver = req.recverForPlayer
+	p.sender = req.senderForPlayer
+	p.remote = req.remoteAddr
+	p.suite = req.suite
+	p.resumeToken = req.resumeToken
+	resend := p.replay.reset(p.suite.factory, req.acking)
+	atom.StoreUint32(&p.lastInSeq, 0)
+	for _, msg := range resend {
+		p.sendMessage(msg, true)
+	}
+	addAckStats(&ackStats.retransmits, len(resend))
+}
+
 func (p *Player) notifyBindSuccess() {
 	p.sender.notifyBindSuccess()
 }
@@ -315,13 +354,14 @@ func (p *Player) unbind() {
 		if p.recver != nil {
 			p.recver.notifyClose()
 		}
-		p.sendMessageAnyway(messageCreater.createS2CClose(util.HeartbeatTimeout))
+		p.sendMessageAnyway(p.suite.creater.createS2CClose(util.HeartbeatTimeout))
 		if p.sender != nil {
 			p.sender.notifyClose()
 		}
 
 		p.recver = nil
 		p.sender = nil
+		p.resumeToken = ""
 		p.setToStop(false)
 		p.onKickSuccess()
 	}
@@ -396,6 +436,12 @@ func (p *Player) handleMsg() {
 			break
 		}
 
+		select {
+		case req := <-p.resumeReqs:
+			p.resume(req)
+		default:
+		}
+
 		t.Reset(delay)
 		msg := p.recver.takeMessage(t)
 		if msg == nil {
@@ -403,14 +449,47 @@ func (p *Player) handleMsg() {
 		}
 
 		dispatchMessageToPlayer(p, msg)
-		if err := protoFactory.Release(msg.protoID, msg.proto); err != nil {
+		if msg.seq != 0 {
+			atom.StoreUint32(&p.lastInSeq, msg.seq)
+		}
+		if err := p.suite.factory.Release(msg.protoID, msg.proto); err != nil {
 			break
 		}
 	}
 }
 
+// getLastInSeq returns the sequence number of the last message handled.
+func (p *Player) getLastInSeq() uint32 {
+	return atom.LoadUint32(&p.lastInSeq)
+}
+
 func (p *Player) sendProto(protoID int16, proto interface{}) {
-	p.sender.addMessage(&message{protoID, proto})
+	p.sendMessage(&message{protoID: protoID, proto: proto}, false)
+}
+
+// @public
+// sendCriticalProto sends a message which must be delivered, for example rewards and trade results.
+// If the client acks, it is kept until acked, and sent again after the player is binded again.
+func (p *Player) sendCriticalProto(protoID int16, proto interface{}) {
+	p.sendMessage(&message{protoID: protoID, proto: proto}, true)
+}
+
+func (p *Player) sendMessage(msg *message, critical bool) {
+	if err := p.replay.add(msg, critical); err != nil {
+		log.Println(err)
+	}
+	p.sender.addMessage(msg)
+}
+
+// handleAck handles C2SAck, which acks all messages not after its seq.
+func (p *Player) handleAck(msg *message) {
+	seq, ok := ackRequest(msg.proto)
+	if !ok {
+		return
+	}
+	if !p.replay.ack(seq) {
+		log.Printf("player[%v] acks seq[%v] not sent\n", p.uid(), seq)
+	}
 }
 
 func (p *Player) sendMessageAnyway(msg *message) {
@@ -419,6 +498,11 @@ func (p *Player) sendMessageAnyway(msg *message) {
 	}
 }
 
+// remoteAddr returns the real address of the binded client, it could be nil.
+func (p *Player) remoteAddr() net.Addr {
+	return p.remote
+}
+
 func (p *Player) uid() int64 {
 	return p.playerBaseData.uid
 }
@@ -11,6 +11,7 @@ type playerState interface {
 
 	isOnline() bool
 	onHeartbeat()
+	name() string
 }
 
 // playerStateOffline
@@ -50,6 +51,10 @@ func (s *playerStateOffline) isOnline() bool {
 
 func (s *playerStateOffline) onHeartbeat() {}
 
+func (s *playerStateOffline) name() string {
+	return "offline"
+}
+
 // playerStateBinding
 type playerStateBinding struct {
 	player *Player
@@ -77,6 +82,10 @@ func (s *playerStateBinding) isOnline() bool {
 
 func (s *playerStateBinding) onHeartbeat() {}
 
+func (s *playerStateBinding) name() string {
+	return "binding"
+}
+
 // playerStateOnline
 type playerStateOnline struct {
 	player   *Player
@@ -118,6 +127,10 @@ func (s *playerStateOnline) onHeartbeat() {
 	serverInst.addPlayerToKick(s.kickItem)
 }
 
+func (s *playerStateOnline) name() string {
+	return "online"
+}
+
 // playerStateKicking
 type playerStateKicking struct {
 	player *Player
@@ -147,6 +160,10 @@ func (s *playerStateKicking) isOnline() bool {
 
 func (s *playerStateKicking) onHeartbeat() {}
 
+func (s *playerStateKicking) name() string {
+	return "kicking"
+}
+
 // playerStateUnloading
 type playerStateUnloading struct {
 	player *Player
@@ -174,3 +191,7 @@ func (s *playerStateUnloading) isOnline() bool {
 }
 
 func (s *playerStateUnloading) onHeartbeat() {}
+
+func (s *playerStateUnloading) name() string {
+	return "unloading"
+}
@@ -0,0 +1,101 @@
+// Code generated by protogen from protocol/schema. DO NOT EDIT.
+
+package json
+
+import (
+	proto "biblio/protocol"
+	"errors"
+	"sync"
+)
+
+// C2SAuth protocol
+type C2SAuth struct {
+	UID   int64  `json:"uid"`
+	Token string `json:"token"`
+}
+
+// C2SHeartbeat protocol
+type C2SHeartbeat struct {
+}
+
+// C2SResume protocol
+type C2SResume struct {
+	UID         int64  `json:"uid"`
+	ResumeToken string `json:"resumeToken"`
+	Received    uint32 `json:"received"`
+}
+
+// C2SAck protocol
+type C2SAck struct {
+	Seq uint32 `json:"seq"`
+}
+
+// S2CAuth protocol
+type S2CAuth struct {
+	Passed      bool   `json:"passed"`
+	ResumeToken string `json:"resumeToken"`
+	LastSeq     uint32 `json:"lastSeq"`
+}
+
+// S2CClose protocol
+type S2CClose struct {
+	Reason int8 `json:"reason"`
+}
+
+// S2CQueuePosition protocol
+type S2CQueuePosition struct {
+	Position      uint32 `json:"position"`
+	EstimatedWait uint32 `json:"estimatedWait"`
+}
+
+var errS2CAuthSrcTypeWrong = errors.New("S2CAuth src type wrong")
+var errS2CAuthDstTypeWrong = errors.New("S2CAuth dst type wrong")
+var errS2CCloseSrcTypeWrong = errors.New("S2CClose src type wrong")
+var errS2CCloseDstTypeWrong = errors.New("S2CClose dst type wrong")
+var errS2CQueuePositionSrcTypeWrong = errors.New("S2CQueuePosition src type wrong")
+var errS2CQueuePositionDstTypeWrong = errors.New("S2CQueuePosition dst type wrong")
+
+// ProtoFactory is a factory instance to create json instance.
+var ProtoFactory = &factory{
+	mapProtoID2Pool: map[int16]*sync.Pool{
+		proto.C2SAuthID:          &sync.Pool{New: func() interface{} { return &C2SAuth{} }},
+		proto.C2SHeartbeatID:     &sync.Pool{New: func() interface{} { return &C2SHeartbeat{} }},
+		proto.C2SResumeID:        &sync.Pool{New: func() interface{} { return &C2SResume{} }},
+		proto.C2SAckID:           &sync.Pool{New: func() interface{} { return &C2SAck{} }},
+		proto.S2CAuthID:          &sync.Pool{New: func() interface{} { return &S2CAuth{} }},
+		proto.S2CCloseID:         &sync.Pool{New: func() interface{} { return &S2CClose{} }},
+		proto.S2CQueuePositionID: &sync.Pool{New: func() interface{} { return &S2CQueuePosition{} }},
+	},
+	protoSetter: map[int16]protoSetFunc{
+		proto.S2CAuthID: func(dst interface{}, src interface{}) error {
+			if d, ok := dst.(*S2CAuth); ok {
+				if s, ok := src.(*S2CAuth); ok {
+					*d = *s
+					return nil
+				}
+				return errS2CAuthSrcTypeWrong
+			}
+			return errS2CAuthDstTypeWrong
+		},
+		proto.S2CCloseID: func(dst interface{}, src interface{}) error {
+			if d, ok := dst.(*S2CClose); ok {
+				if s, ok := src.(*S2CClose); ok {
+					*d = *s
+					return nil
+				}
+				return errS2CCloseSrcTypeWrong
+			}
+			return errS2CCloseDstTypeWrong
+		},
+		proto.S2CQueuePositionID: func(dst interface{}, src interface{}) error {
+			if d, ok := dst.(*S2CQueuePosition); ok {
+				if s, ok := src.(*S2CQueuePosition); ok {
+					*d = *s
+					return nil
+				}
+				return errS2CQueuePositionSrcTypeWrong
+			}
+			return errS2CQueuePositionDstTypeWrong
+		},
+	},
+}
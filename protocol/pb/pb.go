@@ -0,0 +1,80 @@
+// Package pb contains protocols in Protocol Buffers form.
+// The wire format is described by biblio.proto.
+// Structs, Marshal/Unmarshal and ProtoFactory are generated from protocol/schema into pb_gen.go.
+package pb
+
+import (
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sync"
+)
+
+// Message is implemented by all protocols in this package.
+type Message interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+var errInvalidWireData = errors.New("invalid protobuf wire data")
+
+// consumeFields iterates fields of data, fn consumes the value of a field
+// and returns its length.
+func consumeFields(data []byte, fn func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errInvalidWireData
+		}
+		data = data[n:]
+
+		n, err := fn(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errInvalidWireData
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+type protoSetFunc func(interface{}, interface{}) error
+
+type factory struct {
+	mapProtoID2Pool map[int16]*sync.Pool
+	protoSetter     map[int16]protoSetFunc
+}
+
+func (f *factory) Require(protoID int16) (interface{}, error) {
+	if pool, ok := f.mapProtoID2Pool[protoID]; ok {
+		return pool.Get(), nil
+	}
+
+	return nil, fmt.Errorf("protoID[%v] has no pool", protoID)
+}
+
+func (f *factory) RequireWithSourceProto(protoID int16, src interface{}) (interface{}, error) {
+	if pool, ok := f.mapProtoID2Pool[protoID]; ok {
+		dst := pool.Get()
+		if fn, ok := f.protoSetter[protoID]; ok {
+			if err := fn(dst, src); err != nil {
+				return nil, err
+			}
+			return dst, nil
+		}
+		return nil, fmt.Errorf("protoID[%v] has no setter", protoID)
+	}
+
+	return nil, fmt.Errorf("protoID[%v] has no pool", protoID)
+}
+
+func (f *factory) Release(protoID int16, x interface{}) error {
+	if pool, ok := f.mapProtoID2Pool[protoID]; ok {
+		pool.Put(x)
+		return nil
+	}
+
+	return fmt.Errorf("protoID[%v] has no pool", protoID)
+}
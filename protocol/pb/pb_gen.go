@@ -0,0 +1,308 @@
+// Code generated by protogen from protocol/schema. DO NOT EDIT.
+
+package pb
+
+import (
+	proto "biblio/protocol"
+	"errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sync"
+)
+
+// C2SAuth protocol
+type C2SAuth struct {
+	UID   int64  // 1
+	Token string // 2
+}
+
+// Marshal encodes C2SAuth.
+func (m *C2SAuth) Marshal() ([]byte, error) {
+	var b []byte
+	if m.UID != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.UID))
+	}
+	if m.Token != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.Token)
+	}
+	return b, nil
+}
+
+// Unmarshal decodes C2SAuth.
+func (m *C2SAuth) Unmarshal(data []byte) error {
+	*m = C2SAuth{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.UID = int64(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			m.Token = v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// C2SHeartbeat protocol
+type C2SHeartbeat struct {
+}
+
+// Marshal encodes C2SHeartbeat.
+func (m *C2SHeartbeat) Marshal() ([]byte, error) {
+	var b []byte
+	return b, nil
+}
+
+// Unmarshal decodes C2SHeartbeat.
+func (m *C2SHeartbeat) Unmarshal(data []byte) error {
+	*m = C2SHeartbeat{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// C2SResume protocol
+type C2SResume struct {
+	UID         int64  // 1
+	ResumeToken string // 2
+	Received    uint32 // 3
+}
+
+// Marshal encodes C2SResume.
+func (m *C2SResume) Marshal() ([]byte, error) {
+	var b []byte
+	if m.UID != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.UID))
+	}
+	if m.ResumeToken != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.ResumeToken)
+	}
+	if m.Received != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Received))
+	}
+	return b, nil
+}
+
+// Unmarshal decodes C2SResume.
+func (m *C2SResume) Unmarshal(data []byte) error {
+	*m = C2SResume{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.UID = int64(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			m.ResumeToken = v
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Received = uint32(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// C2SAck protocol
+type C2SAck struct {
+	Seq uint32 // 1
+}
+
+// Marshal encodes C2SAck.
+func (m *C2SAck) Marshal() ([]byte, error) {
+	var b []byte
+	if m.Seq != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Seq))
+	}
+	return b, nil
+}
+
+// Unmarshal decodes C2SAck.
+func (m *C2SAck) Unmarshal(data []byte) error {
+	*m = C2SAck{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Seq = uint32(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// S2CAuth protocol
+type S2CAuth struct {
+	Passed      bool   // 1
+	ResumeToken string // 2
+	LastSeq     uint32 // 3
+}
+
+// Marshal encodes S2CAuth.
+func (m *S2CAuth) Marshal() ([]byte, error) {
+	var b []byte
+	if m.Passed {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(m.Passed))
+	}
+	if m.ResumeToken != "" {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, m.ResumeToken)
+	}
+	if m.LastSeq != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.LastSeq))
+	}
+	return b, nil
+}
+
+// Unmarshal decodes S2CAuth.
+func (m *S2CAuth) Unmarshal(data []byte) error {
+	*m = S2CAuth{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Passed = protowire.DecodeBool(v)
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			m.ResumeToken = v
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.LastSeq = uint32(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// S2CClose protocol
+type S2CClose struct {
+	Reason int8 // 1, int32 in biblio.proto
+}
+
+// Marshal encodes S2CClose.
+func (m *S2CClose) Marshal() ([]byte, error) {
+	var b []byte
+	if m.Reason != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(int64(m.Reason)))
+	}
+	return b, nil
+}
+
+// Unmarshal decodes S2CClose.
+func (m *S2CClose) Unmarshal(data []byte) error {
+	*m = S2CClose{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Reason = int8(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+// S2CQueuePosition protocol
+type S2CQueuePosition struct {
+	Position      uint32 // 1
+	EstimatedWait uint32 // 2
+}
+
+// Marshal encodes S2CQueuePosition.
+func (m *S2CQueuePosition) Marshal() ([]byte, error) {
+	var b []byte
+	if m.Position != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.Position))
+	}
+	if m.EstimatedWait != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.EstimatedWait))
+	}
+	return b, nil
+}
+
+// Unmarshal decodes S2CQueuePosition.
+func (m *S2CQueuePosition) Unmarshal(data []byte) error {
+	*m = S2CQueuePosition{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.Position = uint32(v)
+			return n, nil
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.EstimatedWait = uint32(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+
+var errS2CAuthSrcTypeWrong = errors.New("S2CAuth src type wrong")
+var errS2CAuthDstTypeWrong = errors.New("S2CAuth dst type wrong")
+var errS2CCloseSrcTypeWrong = errors.New("S2CClose src type wrong")
+var errS2CCloseDstTypeWrong = errors.New("S2CClose dst type wrong")
+var errS2CQueuePositionSrcTypeWrong = errors.New("S2CQueuePosition src type wrong")
+var errS2CQueuePositionDstTypeWrong = errors.New("S2CQueuePosition dst type wrong")
+
+// ProtoFactory is a factory instance to create protobuf instance.
+var ProtoFactory = &factory{
+	mapProtoID2Pool: map[int16]*sync.Pool{
+		proto.C2SAuthID:          &sync.Pool{New: func() interface{} { return &C2SAuth{} }},
+		proto.C2SHeartbeatID:     &sync.Pool{New: func() interface{} { return &C2SHeartbeat{} }},
+		proto.C2SResumeID:        &sync.Pool{New: func() interface{} { return &C2SResume{} }},
+		proto.C2SAckID:           &sync.Pool{New: func() interface{} { return &C2SAck{} }},
+		proto.S2CAuthID:          &sync.Pool{New: func() interface{} { return &S2CAuth{} }},
+		proto.S2CCloseID:         &sync.Pool{New: func() interface{} { return &S2CClose{} }},
+		proto.S2CQueuePositionID: &sync.Pool{New: func() interface{} { return &S2CQueuePosition{} }},
+	},
+	protoSetter: map[int16]protoSetFunc{
+		proto.S2CAuthID: func(dst interface{}, src interface{}) error {
+			if d, ok := dst.(*S2CAuth); ok {
+				if s, ok := src.(*S2CAuth); ok {
+					*d = *s
+					return nil
+				}
+				return errS2CAuthSrcTypeWrong
+			}
+			return errS2CAuthDstTypeWrong
+		},
+		proto.S2CCloseID: func(dst interface{}, src interface{}) error {
+			if d, ok := dst.(*S2CClose); ok {
+				if s, ok := src.(*S2CClose); ok {
+					*d = *s
+					return nil
+				}
+				return errS2CCloseSrcTypeWrong
+			}
+			return errS2CCloseDstTypeWrong
+		},
+		proto.S2CQueuePositionID: func(dst interface{}, src interface{}) error {
+			if d, ok := dst.(*S2CQueuePosition); ok {
+				if s, ok := src.(*S2CQueuePosition); ok {
+					*d = *s
+					return nil
+				}
+				return errS2CQueuePositionSrcTypeWrong
+			}
+			return errS2CQueuePositionDstTypeWrong
+		},
+	},
+}
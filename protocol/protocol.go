@@ -1,6 +1,10 @@
 // Package protocol defines protocol ids and some other stuff.
+// Protocol ids are generated from protocol/schema into protocol_gen.go.
 package protocol
 
+// Version is the version of protocols. Increase it when protocols change incompatibly.
+const Version = 6
+
 // ProtoFactory defines a interface with methods to
 // require and release proto instances.
 type ProtoFactory interface {
@@ -8,15 +12,3 @@ type ProtoFactory interface {
 	RequireWithSourceProto(protoID int16, src interface{}) (interface{}, error)
 	Release(protoID int16, x interface{}) error
 }
-
-// C2S protocol
-const (
-	C2SAuthID      int16 = 100
-	C2SHeartbeatID int16 = 101
-)
-
-// S2C protocol
-const (
-	S2CAuthID  int16 = 500
-	S2CCloseID int16 = 501
-)
@@ -0,0 +1,18 @@
+// Code generated by protogen from protocol/schema. DO NOT EDIT.
+
+package protocol
+
+// C2S protocol
+const (
+	C2SAuthID      int16 = 100
+	C2SHeartbeatID int16 = 101
+	C2SResumeID    int16 = 102
+	C2SAckID       int16 = 103
+)
+
+// S2C protocol
+const (
+	S2CAuthID          int16 = 500
+	S2CCloseID         int16 = 501
+	S2CQueuePositionID int16 = 502
+)
@@ -0,0 +1,430 @@
+// Command protogen generates protocol code from the schema files in protocol/schema.
+//
+// A schema file describes one message:
+//
+//	{
+//		"name": "S2CClose",
+//		"id": 501,
+//		"direction": "s2c",
+//		"fields": [
+//			{"name": "Reason", "type": "int8", "json": "reason", "num": 1}
+//		]
+//	}
+//
+// num is the field number in protobuf, never change or reuse it.
+// It generates protocol ids, structs, factory pools and setters of package protocol/json and
+// protocol/pb, protocol/pb/biblio.proto, and MessageCreater with its methods of both creaters.
+// It fails if two messages have the same id or name.
+//
+// Run it by go generate in the root directory.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+const (
+	dirC2S = "c2s"
+	dirS2C = "s2c"
+)
+
+type field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	JSON string `json:"json"`
+	Num  int    `json:"num"`
+}
+
+type schema struct {
+	Name      string   `json:"name"`
+	ID        int16    `json:"id"`
+	Direction string   `json:"direction"`
+	Fields    []*field `json:"fields"`
+}
+
+// pbType describes how a Go type is in protobuf.
+type pbType struct {
+	Proto    string // type in biblio.proto
+	Wire     string // protowire type
+	AppendFn string // appends the value to b
+	DecodeFn string // converts the consumed v
+	NonZero  string // tells whether the value is not zero
+}
+
+var pbTypes = map[string]*pbType{
+	"bool":   {"bool", "protowire.VarintType", "protowire.AppendVarint(b, protowire.EncodeBool(%s))", "protowire.DecodeBool(v)", "m.%s"},
+	"int8":   {"int32", "protowire.VarintType", "protowire.AppendVarint(b, uint64(int64(%s)))", "int8(v)", "m.%s != 0"},
+	"int16":  {"int32", "protowire.VarintType", "protowire.AppendVarint(b, uint64(int64(%s)))", "int16(v)", "m.%s != 0"},
+	"int32":  {"int32", "protowire.VarintType", "protowire.AppendVarint(b, uint64(int64(%s)))", "int32(v)", "m.%s != 0"},
+	"int64":  {"int64", "protowire.VarintType", "protowire.AppendVarint(b, uint64(%s))", "int64(v)", "m.%s != 0"},
+	"uint8":  {"uint32", "protowire.VarintType", "protowire.AppendVarint(b, uint64(%s))", "uint8(v)", "m.%s != 0"},
+	"uint16": {"uint32", "protowire.VarintType", "protowire.AppendVarint(b, uint64(%s))", "uint16(v)", "m.%s != 0"},
+	"uint32": {"uint32", "protowire.VarintType", "protowire.AppendVarint(b, uint64(%s))", "uint32(v)", "m.%s != 0"},
+	"uint64": {"uint64", "protowire.VarintType", "protowire.AppendVarint(b, %s)", "v", "m.%s != 0"},
+	"string": {"string", "protowire.BytesType", "protowire.AppendString(b, %s)", "v", `m.%s != ""`},
+	"[]byte": {"bytes", "protowire.BytesType", "protowire.AppendBytes(b, %s)", "append([]byte(nil), v...)", "len(m.%s) != 0"},
+}
+
+func main() {
+	schemaDir := flag.String("schema", "protocol/schema", "directory of schema files")
+	outDir := flag.String("out", ".", "root directory of package main")
+	flag.Parse()
+
+	msgs, err := loadSchemas(*schemaDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outputs := []struct {
+		path  string
+		tmpl  *template.Template
+		gofmt bool
+	}{
+		{"protocol/protocol_gen.go", tmplIDs, true},
+		{"protocol/json/json_gen.go", tmplJSON, true},
+		{"protocol/pb/pb_gen.go", tmplPB, true},
+		{"protocol/pb/biblio.proto", tmplProto, false},
+		{"message_creater_gen.go", tmplCreater, true},
+	}
+	for _, o := range outputs {
+		if err := generate(filepath.Join(*outDir, o.path), o.tmpl, msgs, o.gofmt); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func loadSchemas(dir string) ([]*schema, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no schema in %v", dir)
+	}
+
+	var msgs []*schema
+	ids := make(map[int16]string)
+	names := make(map[string]bool)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		m := &schema{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+		if err := m.check(); err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+		if other, ok := ids[m.ID]; ok {
+			return nil, fmt.Errorf("%v: id %v of %v is used by %v", file, m.ID, m.Name, other)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("%v: duplicate message name %v", file, m.Name)
+		}
+		ids[m.ID] = m.Name
+		names[m.Name] = true
+		msgs = append(msgs, m)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs, nil
+}
+
+func (m *schema) check() error {
+	if !token.IsIdentifier(m.Name) || !token.IsExported(m.Name) {
+		return fmt.Errorf("invalid message name %q", m.Name)
+	}
+	switch m.Direction {
+	case dirC2S, dirS2C:
+		if !strings.HasPrefix(m.Name, strings.ToUpper(m.Direction)) {
+			return fmt.Errorf("name of %v message %v must begin with %v", m.Direction, m.Name, strings.ToUpper(m.Direction))
+		}
+	default:
+		return fmt.Errorf("invalid direction %q of %v", m.Direction, m.Name)
+	}
+	if m.ID <= 0 {
+		return fmt.Errorf("invalid id %v of %v", m.ID, m.Name)
+	}
+
+	names := make(map[string]bool)
+	nums := make(map[int]bool)
+	for _, f := range m.Fields {
+		if !token.IsIdentifier(f.Name) || !token.IsExported(f.Name) {
+			return fmt.Errorf("invalid field name %q of %v", f.Name, m.Name)
+		}
+		if _, ok := pbTypes[f.Type]; !ok {
+			return fmt.Errorf("unsupported type %q of %v.%v", f.Type, m.Name, f.Name)
+		}
+		if f.JSON == "" {
+			return fmt.Errorf("no json name of %v.%v", m.Name, f.Name)
+		}
+		if f.Num <= 0 || f.Num > 536870911 {
+			return fmt.Errorf("invalid num %v of %v.%v", f.Num, m.Name, f.Name)
+		}
+		if names[f.Name] || nums[f.Num] {
+			return fmt.Errorf("duplicate field %v or num %v of %v", f.Name, f.Num, m.Name)
+		}
+		names[f.Name] = true
+		nums[f.Num] = true
+	}
+	return nil
+}
+
+func generate(path string, tmpl *template.Template, msgs []*schema, gofmt bool) error {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, msgs); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	data := buf.Bytes()
+	if gofmt {
+		var err error
+		if data, err = format.Source(data); err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// paramName returns the parameter name of a field in creater methods, for example
+// Reason -> reason, UID -> uid, HTTPCode -> httpCode.
+func paramName(name string) string {
+	r := []rune(name)
+	i := 0
+	for i < len(r) && unicode.IsUpper(r[i]) {
+		i++
+	}
+	if i > 1 && i < len(r) {
+		i-- // the last upper letter begins the next word
+	}
+	s := strings.ToLower(string(r[:i])) + string(r[i:])
+	if token.IsKeyword(s) || s == "proto" || s == "protoID" || s == "v" || s == "c" {
+		s += "Arg"
+	}
+	return s
+}
+
+func isS2C(m *schema) bool {
+	return m.Direction == dirS2C
+}
+
+func pbOf(f *field) *pbType {
+	return pbTypes[f.Type]
+}
+
+var funcs = template.FuncMap{
+	"isS2C":     isS2C,
+	"paramName": paramName,
+	"pb":        pbOf,
+	"printf":    fmt.Sprintf,
+}
+
+const header = "// Code generated by protogen from protocol/schema. DO NOT EDIT.\n\n"
+
+var tmplIDs = template.Must(template.New("ids").Funcs(funcs).Parse(header + `package protocol
+
+// C2S protocol
+const (
+{{- range .}}{{if not (isS2C .)}}
+	{{.Name}}ID int16 = {{.ID}}
+{{- end}}{{end}}
+)
+
+// S2C protocol
+const (
+{{- range .}}{{if isS2C .}}
+	{{.Name}}ID int16 = {{.ID}}
+{{- end}}{{end}}
+)
+`))
+
+var tmplJSON = template.Must(template.New("json").Funcs(funcs).Parse(header + `package json
+
+import (
+	proto "biblio/protocol"
+	"errors"
+	"sync"
+)
+{{range .}}
+// {{.Name}} protocol
+type {{.Name}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.Type}} ` + "`json:\"{{.JSON}}\"`" + `
+{{- end}}
+}
+{{end}}
+{{range .}}{{if isS2C .}}
+var err{{.Name}}SrcTypeWrong = errors.New("{{.Name}} src type wrong")
+var err{{.Name}}DstTypeWrong = errors.New("{{.Name}} dst type wrong")
+{{- end}}{{end}}
+
+// ProtoFactory is a factory instance to create json instance.
+var ProtoFactory = &factory{
+	mapProtoID2Pool: map[int16]*sync.Pool{
+{{- range .}}
+		proto.{{.Name}}ID: &sync.Pool{New: func() interface{} { return &{{.Name}}{} }},
+{{- end}}
+	},
+	protoSetter: map[int16]protoSetFunc{
+{{- range .}}{{if isS2C .}}
+		proto.{{.Name}}ID: func(dst interface{}, src interface{}) error {
+			if d, ok := dst.(*{{.Name}}); ok {
+				if s, ok := src.(*{{.Name}}); ok {
+					*d = *s
+					return nil
+				}
+				return err{{.Name}}SrcTypeWrong
+			}
+			return err{{.Name}}DstTypeWrong
+		},
+{{- end}}{{end}}
+	},
+}
+`))
+
+var tmplPB = template.Must(template.New("pb").Funcs(funcs).Parse(header + `package pb
+
+import (
+	proto "biblio/protocol"
+	"errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"sync"
+)
+{{range $m := .}}
+// {{.Name}} protocol
+type {{.Name}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.Type}} // {{.Num}}{{if and (ne .Type (pb .).Proto) (ne .Type "[]byte")}}, {{(pb .).Proto}} in biblio.proto{{end}}
+{{- end}}
+}
+
+// Marshal encodes {{.Name}}.
+func (m *{{.Name}}) Marshal() ([]byte, error) {
+	var b []byte
+{{- range .Fields}}
+	if {{printf (pb .).NonZero .Name}} {
+		b = protowire.AppendTag(b, {{.Num}}, {{(pb .).Wire}})
+		b = {{printf (pb .).AppendFn (printf "m.%s" .Name)}}
+	}
+{{- end}}
+	return b, nil
+}
+
+// Unmarshal decodes {{.Name}}.
+func (m *{{.Name}}) Unmarshal(data []byte) error {
+	*m = {{.Name}}{}
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+{{- if .Fields}}
+		switch {
+{{- range .Fields}}
+		case num == {{.Num}} && typ == {{(pb .).Wire}}:
+			{{- if eq (pb .).Wire "protowire.VarintType"}}
+			v, n := protowire.ConsumeVarint(b)
+			{{- else if eq .Type "string"}}
+			v, n := protowire.ConsumeString(b)
+			{{- else}}
+			v, n := protowire.ConsumeBytes(b)
+			{{- end}}
+			m.{{.Name}} = {{(pb .).DecodeFn}}
+			return n, nil
+{{- end}}
+		}
+{{- end}}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+}
+{{end}}
+{{range .}}{{if isS2C .}}
+var err{{.Name}}SrcTypeWrong = errors.New("{{.Name}} src type wrong")
+var err{{.Name}}DstTypeWrong = errors.New("{{.Name}} dst type wrong")
+{{- end}}{{end}}
+
+// ProtoFactory is a factory instance to create protobuf instance.
+var ProtoFactory = &factory{
+	mapProtoID2Pool: map[int16]*sync.Pool{
+{{- range .}}
+		proto.{{.Name}}ID: &sync.Pool{New: func() interface{} { return &{{.Name}}{} }},
+{{- end}}
+	},
+	protoSetter: map[int16]protoSetFunc{
+{{- range .}}{{if isS2C .}}
+		proto.{{.Name}}ID: func(dst interface{}, src interface{}) error {
+			if d, ok := dst.(*{{.Name}}); ok {
+				if s, ok := src.(*{{.Name}}); ok {
+					*d = *s
+					return nil
+				}
+				return err{{.Name}}SrcTypeWrong
+			}
+			return err{{.Name}}DstTypeWrong
+		},
+{{- end}}{{end}}
+	},
+}
+`))
+
+var tmplProto = template.Must(template.New("proto").Funcs(funcs).Parse(`// Code generated by protogen from protocol/schema. DO NOT EDIT.
+// Wire format of protocols in package pb. Protocol ids are in protocol_gen.go.
+syntax = "proto3";
+
+package biblio;
+{{range .}}
+// {{.Name}}ID = {{.ID}}
+message {{.Name}} {
+{{- range .Fields}}
+  {{(pb .).Proto}} {{.JSON}} = {{.Num}};
+{{- end}}
+}
+{{end}}`))
+
+var tmplCreater = template.Must(template.New("creater").Funcs(funcs).Parse(header + `package main
+
+import (
+	proto "biblio/protocol"
+	protojson "biblio/protocol/json"
+	protopb "biblio/protocol/pb"
+)
+
+// MessageCreater defines some methods to create different kinds of messages.
+type MessageCreater interface {
+{{- range .}}{{if isS2C .}}
+	create{{.Name}}({{range $i, $f := .Fields}}{{if $i}}, {{end}}{{paramName .Name}} {{.Type}}{{end}}) *message
+{{- end}}{{end}}
+}
+{{- range .}}{{if isS2C .}}
+func (c *JSONCreater) create{{.Name}}({{range $i, $f := .Fields}}{{if $i}}, {{end}}{{paramName .Name}} {{.Type}}{{end}}) *message {
+	v := &protojson.{{.Name}}{
+{{- range .Fields}}
+		{{.Name}}: {{paramName .Name}},
+{{- end}}
+	}
+	protoID := proto.{{.Name}}ID
+	proto, _ := protojson.ProtoFactory.RequireWithSourceProto(protoID, v)
+	return &message{protoID: protoID, proto: proto}
+}
+{{end}}{{end}}
+{{- range .}}{{if isS2C .}}
+func (c *PBCreater) create{{.Name}}({{range $i, $f := .Fields}}{{if $i}}, {{end}}{{paramName .Name}} {{.Type}}{{end}}) *message {
+	v := &protopb.{{.Name}}{
+{{- range .Fields}}
+		{{.Name}}: {{paramName .Name}},
+{{- end}}
+	}
+	protoID := proto.{{.Name}}ID
+	proto, _ := protopb.ProtoFactory.RequireWithSourceProto(protoID, v)
+	return &message{protoID: protoID, proto: proto}
+}
+{{end}}{{end}}`))
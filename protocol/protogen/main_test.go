@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testSchemaClose = `{"name": "S2CClose", "id": 501, "direction": "s2c",
+		"fields": [{"name": "Reason", "type": "int8", "json": "reason", "num": 1}]}`
+	testSchemaKick   = `{"name": "S2CKick", "id": 501, "direction": "s2c", "fields": []}`
+	testSchemaClose2 = `{"name": "S2CClose", "id": 502, "direction": "s2c", "fields": []}`
+	testSchemaAuth   = `{"name": "C2SAuth", "id": 1, "direction": "c2s",
+		"fields": [{"name": "UID", "type": "int64", "json": "uid", "num": 1},
+			{"name": "Token", "type": "string", "json": "token", "num": 1}]}`
+)
+
+func TestLoadSchemas(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string // part of the error, empty means no error
+	}{
+		{"ok", map[string]string{"S2CClose.json": testSchemaClose}, ""},
+		{"no schema", nil, "no schema"},
+		{"duplicate id", map[string]string{"S2CClose.json": testSchemaClose, "S2CKick.json": testSchemaKick},
+			"id 501 of S2CKick is used by S2CClose"},
+		{"duplicate name", map[string]string{"S2CClose.json": testSchemaClose, "S2CClose2.json": testSchemaClose2},
+			"duplicate message name S2CClose"},
+		{"duplicate num", map[string]string{"C2SAuth.json": testSchemaAuth}, "duplicate field Token or num 1 of C2SAuth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			msgs, err := loadSchemas(dir)
+			if tt.err == "" {
+				if err != nil || len(msgs) != len(tt.files) {
+					t.Fatalf("%v messages, %v", len(msgs), err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestSchemas checks the schema files in the repository.
+func TestSchemas(t *testing.T) {
+	if _, err := loadSchemas("../schema"); err != nil {
+		t.Fatal(err)
+	}
+}
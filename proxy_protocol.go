@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol, see https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+var errProxyHeaderInvalid = errors.New("invalid proxy protocol header")
+var errProxyNotTrusted = errors.New("proxy not trusted")
+
+const (
+	proxyV1MaxLen = 107
+	proxyV2SigLen = 12
+)
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var trustedProxyNets []*net.IPNet
+
+// parseTrustedProxies parses trustedProxies(CIDR or single ip) into trustedProxyNets.
+func parseTrustedProxies() error {
+	nets := make([]*net.IPNet, 0, len(trustedProxies))
+	for _, s := range trustedProxies {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	trustedProxyNets = nets
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns ip of a net.Addr, or nil.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from conn.
+// It reads exactly the header, so conn could be used as if there is no header.
+// It returns nil addr if the header carries no address, for example LOCAL or UNKNOWN.
+func readProxyHeader(conn net.Conn) (net.Addr, error) {
+	buf := make([]byte, proxyV2SigLen, proxyV1MaxLen)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(buf, proxyV2Sig) {
+		return readProxyV2(conn)
+	}
+	if bytes.HasPrefix(buf, proxyV1Prefix) {
+		return readProxyV1(conn, buf)
+	}
+	return nil, errProxyHeaderInvalid
+}
+
+func readProxyV1(conn net.Conn, buf []byte) (net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= proxyV1MaxLen {
+			return nil, errProxyHeaderInvalid
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+	}
+
+	// PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n
+	fields := strings.Fields(string(buf[:len(buf)-2]))
+	if len(fields) < 2 {
+		return nil, errProxyHeaderInvalid
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, errProxyHeaderInvalid
+		}
+		ip := parseProxyV1IP(fields[1], fields[2])
+		port, err := strconv.Atoi(fields[4])
+		if ip == nil || parseProxyV1IP(fields[1], fields[3]) == nil || err != nil || port < 0 || port > 65535 {
+			return nil, errProxyHeaderInvalid
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	return nil, errProxyHeaderInvalid
+}
+
+// parseProxyV1IP returns nil if s is not an address of the family of proto, "TCP4" or "TCP6".
+func parseProxyV1IP(proto string, s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil || (proto == "TCP4") == strings.Contains(s, ":") {
+		return nil
+	}
+	return ip
+}
+
+func readProxyV2(conn net.Conn) (net.Addr, error) {
+	var h [4]byte
+	if _, err := io.ReadFull(conn, h[:]); err != nil {
+		return nil, err
+	}
+	if h[0]>>4 != 2 {
+		return nil, errProxyHeaderInvalid
+	}
+	cmd := h[0] & 0x0F
+	fam := h[1] >> 4
+	length := int(binary.BigEndian.Uint16(h[2:]))
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, err
+	}
+
+	if cmd == 0 { // LOCAL, for example health check of the proxy itself
+		return nil, nil
+	}
+	if cmd != 1 {
+		return nil, errProxyHeaderInvalid
+	}
+
+	switch fam {
+	case 1: // AF_INET
+		if length < 12 {
+			return nil, errProxyHeaderInvalid
+		}
+		ip := net.IP(append([]byte(nil), data[0:4]...))
+		port := int(binary.BigEndian.Uint16(data[8:]))
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case 2: // AF_INET6
+		if length < 36 {
+			return nil, errProxyHeaderInvalid
+		}
+		ip := net.IP(append([]byte(nil), data[0:16]...))
+		port := int(binary.BigEndian.Uint16(data[32:]))
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	return nil, nil
+}
+
+// forwardedAddr returns the real client address of a http request.
+// X-Forwarded-For and X-Real-IP are honoured only if the request comes from a trusted proxy.
+// X-Real-IP is used only if there is no X-Forwarded-For. If an address of X-Forwarded-For
+// is invalid, the hops left of it can not be trusted, so the address of the peer is used.
+func forwardedAddr(r *http.Request) net.Addr {
+	host, portStr, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(portStr)
+	remote := &net.TCPAddr{IP: net.ParseIP(host), Port: port}
+	if !isTrustedProxy(remote.IP) {
+		return remote
+	}
+
+	// the right-most address which is not a trusted proxy is the client,
+	// a proxy may append its hop to the last X-Forwarded-For line or in a new line
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		ips := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(ips[i]))
+			if ip == nil {
+				return remote
+			}
+			if !isTrustedProxy(ip) || i == 0 {
+				return &net.IPAddr{IP: ip}
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return &net.IPAddr{IP: ip}
+	}
+	return remote
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func proxyV2Header(cmd byte, fam byte, addr []byte) []byte {
+	h := append([]byte(nil), proxyV2Sig...)
+	h = append(h, 0x20|cmd, fam<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(h[len(h)-2:], uint16(len(addr)))
+	return append(h, addr...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x1f, 0x90, 0x00, 0x50}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6[32:], 8080)
+
+	tests := []struct {
+		name   string
+		header string
+		addr   string // empty means no address
+		err    error
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 10.0.0.1 8080 80\r\n", "192.0.2.1:8080", nil},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 ::1 8080 80\r\n", "[2001:db8::1]:8080", nil},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", nil},
+		{"v1 bad ip", "PROXY TCP4 192.0.2 10.0.0.1 8080 80\r\n", "", errProxyHeaderInvalid},
+		{"v1 tcp4 of ipv6", "PROXY TCP4 2001:db8::1 ::1 8080 80\r\n", "", errProxyHeaderInvalid},
+		{"v1 tcp6 of ipv4", "PROXY TCP6 192.0.2.1 10.0.0.1 8080 80\r\n", "", errProxyHeaderInvalid},
+		{"v1 mixed families", "PROXY TCP4 192.0.2.1 ::1 8080 80\r\n", "", errProxyHeaderInvalid},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 10.0.0.1 65536 80\r\n", "", errProxyHeaderInvalid},
+		{"v1 missing fields", "PROXY TCP4 192.0.2.1\r\n", "", errProxyHeaderInvalid},
+		{"v1 too long", "PROXY TCP4 " + string(make([]byte, proxyV1MaxLen)), "", errProxyHeaderInvalid},
+		{"v2 tcp4", string(proxyV2Header(1, 1, v4)), "192.0.2.1:8080", nil},
+		{"v2 tcp6", string(proxyV2Header(1, 2, v6)), "[2001:db8::1]:8080", nil},
+		{"v2 local", string(proxyV2Header(0, 1, v4)), "", nil},
+		{"v2 unspec", string(proxyV2Header(1, 0, nil)), "", nil},
+		{"v2 short address", string(proxyV2Header(1, 1, v4[:8])), "", errProxyHeaderInvalid},
+		{"v2 bad command", string(proxyV2Header(2, 1, v4)), "", errProxyHeaderInvalid},
+		{"v2 bad version", string(append(append([]byte(nil), proxyV2Sig...), 0x11, 0x11, 0, 0)), "", errProxyHeaderInvalid},
+		{"no header", "GET / HTTP/1.1\r\n", "", errProxyHeaderInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			go func() {
+				c.Write([]byte(tt.header + "BBLO"))
+			}()
+
+			addr, err := readProxyHeader(s)
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if (addr == nil && tt.addr != "") || (addr != nil && addr.String() != tt.addr) {
+				t.Fatalf("got %v, want %q", addr, tt.addr)
+			}
+			// the header is read exactly
+			rest := make([]byte, 4)
+			if _, err := io.ReadFull(s, rest); err != nil || string(rest) != "BBLO" {
+				t.Fatalf("data after header: %q %v", rest, err)
+			}
+		})
+	}
+}
+
+func TestForwardedAddr(t *testing.T) {
+	old := trustedProxies
+	defer func() {
+		trustedProxies = old
+		parseTrustedProxies()
+	}()
+	trustedProxies = []string{"10.0.0.0/8", "192.0.2.9", "2001:db8::9"}
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string // lines
+		realIP string
+		want   string
+	}{
+		{"direct", "198.51.100.1:1234", nil, "", "198.51.100.1:1234"},
+		{"untrusted forwarder", "198.51.100.1:1234", []string{"203.0.113.7"}, "203.0.113.8", "198.51.100.1:1234"},
+		{"trusted forwarder", "10.0.0.1:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"trusted single ip", "192.0.2.9:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"trusted ipv6", "[2001:db8::9]:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"chain of proxies", "10.0.0.1:1234", []string{"203.0.113.7, 198.51.100.2, 10.0.0.2"}, "", "198.51.100.2"},
+		{"spoofed left-most", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.7"}, "", "203.0.113.7"},
+		{"all trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"real ip", "10.0.0.1:1234", nil, "203.0.113.8", "203.0.113.8"},
+		{"invalid xff", "10.0.0.1:1234", []string{"unknown"}, "203.0.113.8", "10.0.0.1:1234"},
+		{"invalid hop", "10.0.0.1:1234", []string{"203.0.113.7, unknown, 10.0.0.2"}, "", "10.0.0.1:1234"},
+		{"second line", "10.0.0.1:1234", []string{"1.2.3.4", "203.0.113.7"}, "", "203.0.113.7"},
+		{"second line of proxies", "10.0.0.1:1234", []string{"1.2.3.4", "203.0.113.7, 10.0.0.2"}, "", "203.0.113.7"},
+		{"nothing forwarded", "10.0.0.1:1234", nil, "", "10.0.0.1:1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := forwardedAddr(r); got == nil || got.String() != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := forwardedAddr(&http.Request{RemoteAddr: "bad"}); got != nil {
+		t.Fatalf("got %v for an invalid RemoteAddr", got)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	old := trustedProxies
+	defer func() {
+		trustedProxies = old
+		parseTrustedProxies()
+	}()
+
+	trustedProxies = []string{"10.0.0.0/33"}
+	if err := parseTrustedProxies(); err == nil {
+		t.Fatal("invalid CIDR accepted")
+	}
+	trustedProxies = []string{"not an ip"}
+	if err := parseTrustedProxies(); err == nil {
+		t.Fatal("invalid ip accepted")
+	}
+	if isTrustedProxy(nil) {
+		t.Fatal("nil ip trusted")
+	}
+}
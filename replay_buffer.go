@@ -0,0 +1,203 @@
+package main
+
+import (
+	proto "biblio/protocol"
+	"time"
+)
+
+// ackProtocolVersion is the first protocol version whose clients get numbered messages and ack them by C2SAck.
+const ackProtocolVersion = 5
+
+// replayBuffer keeps copies of the last messages a player sent, so that they can be sent
+// again to a client resuming the session(see resume.go). Messages sent since the last bind
+// are numbered from 1, the buffer keeps the last replayBufferSize of them.
+//
+// If the client acks(protocol version not less than ackProtocolVersion), acked messages are
+// dropped, and the buffer is the unacked window. Critical messages pushed out of the window
+// unacked are kept aside, up to ackMaxPendingCritical of them, and all critical messages unacked
+// are sent again after the player is binded by another client of the same ProtoFactory.
+// With size 0 nothing is kept for resuming, but critical messages are still kept aside until acked.
+//
+// It is only accessed by the goroutine running the player, or binding it.
+type replayBuffer struct {
+	factory proto.ProtoFactory // of the copies
+	acking  bool               // the client acks messages
+
+	entries []*replayEntry // ring, entries[start] is the oldest
+	start   int
+	n       int
+	lastSeq uint32 // number of the last message sent
+	acked   uint32 // number of the last message acked
+
+	pending []*replayEntry // critical messages pushed out of the window unacked
+}
+
+type replayEntry struct {
+	msg      *message // a copy, numbered
+	critical bool
+	sentAt   time.Time
+}
+
+func newReplayBuffer(size int, factory proto.ProtoFactory) *replayBuffer {
+	return &replayBuffer{
+		factory: factory,
+		entries: make([]*replayEntry, size),
+	}
+}
+
+// reset drops all copies, and makes the next message number 1.
+// It returns critical messages unacked if factory is not changed, which should be sent again.
+func (b *replayBuffer) reset(factory proto.ProtoFactory, acking bool) []*message {
+	var resend []*message
+	keep := func(e *replayEntry) {
+		if !b.acking || !e.critical || e.msg.seq <= b.acked {
+			b.factory.Release(e.msg.protoID, e.msg.proto)
+			return
+		}
+		if factory != b.factory {
+			b.factory.Release(e.msg.protoID, e.msg.proto)
+			addAckStats(&ackStats.criticalDropped, 1)
+			return
+		}
+		resend = append(resend, &message{protoID: e.msg.protoID, proto: e.msg.proto})
+	}
+
+	for _, e := range b.pending {
+		keep(e)
+	}
+	for i := 0; i < b.n; i++ {
+		j := (b.start + i) % len(b.entries)
+		keep(b.entries[j])
+		b.entries[j] = nil
+	}
+
+	b.pending = nil
+	b.start = 0
+	b.n = 0
+	b.lastSeq = 0
+	b.acked = 0
+	b.factory = factory
+	b.acking = acking
+	return resend
+}
+
+func (b *replayBuffer) dropOldest() *replayEntry {
+	e := b.entries[b.start]
+	b.entries[b.start] = nil
+	b.start = (b.start + 1) % len(b.entries)
+	b.n--
+	return e
+}
+
+// pushOut drops the oldest message for a new one.
+func (b *replayBuffer) pushOut() {
+	e := b.dropOldest()
+	if !b.acking || e.msg.seq <= b.acked {
+		b.factory.Release(e.msg.protoID, e.msg.proto)
+		return
+	}
+
+	addAckStats(&ackStats.windowOverflows, 1)
+	if !e.critical {
+		b.factory.Release(e.msg.protoID, e.msg.proto)
+		return
+	}
+	b.keepPending(e)
+}
+
+// keepPending keeps a critical message aside, dropping the oldest one if there are too many.
+func (b *replayBuffer) keepPending(e *replayEntry) {
+	if len(b.pending) >= ackMaxPendingCritical {
+		old := b.pending[0]
+		b.pending = b.pending[1:]
+		b.factory.Release(old.msg.protoID, old.msg.proto)
+		addAckStats(&ackStats.criticalDropped, 1)
+	}
+	b.pending = append(b.pending, e)
+}
+
+// add numbers msg and keeps a copy of it. MUST be called before msg is sent,
+// as the proto of msg is released after it is packed.
+func (b *replayBuffer) add(msg *message, critical bool) error {
+	b.lastSeq++
+	msg.seq = b.lastSeq
+	noWindow := len(b.entries) == 0
+	if noWindow && !(b.acking && critical) {
+		return nil
+	}
+
+	c, err := b.factory.RequireWithSourceProto(msg.protoID, msg.proto)
+	if err != nil {
+		// keeps the numbers, but the messages before can not be replayed
+		for b.n > 0 {
+			e := b.dropOldest()
+			b.factory.Release(e.msg.protoID, e.msg.proto)
+		}
+		return err
+	}
+	e := &replayEntry{
+		msg:      &message{protoID: msg.protoID, proto: c, seq: b.lastSeq},
+		critical: critical,
+		sentAt:   time.Now(),
+	}
+	if noWindow {
+		b.keepPending(e)
+		return nil
+	}
+	if b.n == len(b.entries) {
+		b.pushOut()
+	}
+	b.entries[(b.start+b.n)%len(b.entries)] = e
+	b.n++
+	return nil
+}
+
+// ack drops messages not after seq. It returns false if seq is not sent yet.
+func (b *replayBuffer) ack(seq uint32) bool {
+	if seq > b.lastSeq {
+		return false
+	}
+	if seq <= b.acked {
+		return true
+	}
+	b.acked = seq
+
+	now := time.Now()
+	drop := func(e *replayEntry) {
+		observeAckLatency(now.Sub(e.sentAt))
+		b.factory.Release(e.msg.protoID, e.msg.proto)
+	}
+	for len(b.pending) > 0 && b.pending[0].msg.seq <= seq {
+		drop(b.pending[0])
+		b.pending = b.pending[1:]
+	}
+	for b.n > 0 && b.entries[b.start].msg.seq <= seq {
+		drop(b.dropOldest())
+	}
+	return true
+}
+
+// covers returns true if all messages after the first received ones are kept.
+func (b *replayBuffer) covers(received uint32) bool {
+	if received > b.lastSeq {
+		return false
+	}
+	return received == b.lastSeq || (b.n > 0 && received+1 >= b.entries[b.start].msg.seq)
+}
+
+// after returns copies of messages after the first received ones. covers(received) MUST be true.
+func (b *replayBuffer) after(received uint32) []*message {
+	var msgs []*message
+	for i := 0; i < b.n; i++ {
+		e := b.entries[(b.start+i)%len(b.entries)]
+		if e.msg.seq <= received {
+			continue
+		}
+		c, err := b.factory.RequireWithSourceProto(e.msg.protoID, e.msg.proto)
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, &message{protoID: e.msg.protoID, proto: c, seq: e.msg.seq})
+	}
+	return msgs
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	proto "biblio/protocol"
+	protojson "biblio/protocol/json"
+	"biblio/util"
+	"testing"
+)
+
+// testReplayMessage returns a message of suite, which could be copied by its factory.
+func testReplayMessage(suite *codecSuite, reason int8) *message {
+	return suite.creater.createS2CClose(reason)
+}
+
+func testReplaySeqs(msgs []*message) []uint32 {
+	seqs := make([]uint32, 0, len(msgs))
+	for _, m := range msgs {
+		seqs = append(seqs, m.seq)
+	}
+	return seqs
+}
+
+func TestReplayBufferWindow(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		sent     int
+		acked    uint32 // 0 means no ack
+		received uint32
+		covers   bool
+		after    []uint32
+	}{
+		{"all kept", 4, 3, 0, 1, true, []uint32{2, 3}},
+		{"nothing missed", 4, 3, 0, 3, true, []uint32{}},
+		{"pushed out", 4, 6, 0, 1, false, nil},
+		{"oldest kept", 4, 6, 0, 2, true, []uint32{3, 4, 5, 6}},
+		{"not sent", 4, 3, 0, 4, false, nil},
+		{"acked dropped", 4, 4, 2, 2, true, []uint32{3, 4}},
+		{"no window", 0, 3, 0, 1, false, nil},
+		{"no window nothing missed", 0, 3, 0, 3, true, []uint32{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suite := defaultCodecSuite
+			b := newReplayBuffer(tt.size, suite.factory)
+			b.reset(suite.factory, tt.acked != 0)
+			for i := 0; i < tt.sent; i++ {
+				msg := testReplayMessage(suite, util.InvalidReason)
+				if err := b.add(msg, false); err != nil {
+					t.Fatal(err)
+				}
+				if msg.seq != uint32(i+1) {
+					t.Fatalf("message numbered %v, want %v", msg.seq, i+1)
+				}
+			}
+			if tt.acked != 0 && !b.ack(tt.acked) {
+				t.Fatal("ack refused")
+			}
+
+			if got := b.covers(tt.received); got != tt.covers {
+				t.Fatalf("covers %v, want %v", got, tt.covers)
+			}
+			if !tt.covers {
+				return
+			}
+			if got := testReplaySeqs(b.after(tt.received)); !equalSeqs(got, tt.after) {
+				t.Fatalf("after %v, want %v", got, tt.after)
+			}
+		})
+	}
+}
+
+func TestReplayBufferAck(t *testing.T) {
+	suite := defaultCodecSuite
+	b := newReplayBuffer(4, suite.factory)
+	b.reset(suite.factory, true)
+	for i := 0; i < 3; i++ {
+		b.add(testReplayMessage(suite, util.InvalidReason), false)
+	}
+
+	tests := []struct {
+		seq uint32
+		ok  bool
+		n   int // messages kept after the ack
+	}{
+		{4, false, 3},
+		{1, true, 2},
+		{1, true, 2},
+		{0, true, 2},
+		{3, true, 0},
+	}
+	for _, tt := range tests {
+		if ok := b.ack(tt.seq); ok != tt.ok || b.n != tt.n {
+			t.Fatalf("ack %v: got %v and %v kept, want %v and %v", tt.seq, ok, b.n, tt.ok, tt.n)
+		}
+	}
+}
+
+func TestReplayBufferCritical(t *testing.T) {
+	setGlobal(t, &ackMaxPendingCritical, 2)
+
+	suite := defaultCodecSuite
+	other, err := getCodecSuite(codecNamePB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		size     int
+		acking   bool
+		critical []bool // of each message sent
+		acked    uint32
+		factory  proto.ProtoFactory // of the next client
+		resend   int
+	}{
+		{"in window", 4, true, []bool{true, false, true}, 0, suite.factory, 2},
+		{"pushed out", 2, true, []bool{true, false, false, false}, 0, suite.factory, 1},
+		{"pending bounded", 1, true, []bool{true, true, true, true}, 0, suite.factory, 3},
+		{"no window", 0, true, []bool{true, false, true}, 0, suite.factory, 2},
+		{"no window bounded", 0, true, []bool{true, true, true}, 0, suite.factory, 2},
+		{"acked", 2, true, []bool{true, false, true, false}, 3, suite.factory, 0},
+		{"no window acked", 0, true, []bool{true, true, true}, 2, suite.factory, 1},
+		{"not acking", 4, false, []bool{true, true}, 0, suite.factory, 0},
+		{"other factory", 4, true, []bool{true, true}, 0, other.factory, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReplayBuffer(tt.size, suite.factory)
+			b.reset(suite.factory, tt.acking)
+			for _, critical := range tt.critical {
+				if err := b.add(testReplayMessage(suite, util.InvalidReason), critical); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.acked != 0 {
+				b.ack(tt.acked)
+			}
+
+			resend := b.reset(tt.factory, true)
+			if len(resend) != tt.resend {
+				t.Fatalf("resend %v, want %v", len(resend), tt.resend)
+			}
+			for _, m := range resend {
+				if m.seq != 0 || m.protoID != proto.S2CCloseID {
+					t.Fatalf("resend %v of seq %v", m.protoID, m.seq)
+				}
+			}
+			if b.lastSeq != 0 || b.n != 0 || len(b.pending) != 0 {
+				t.Fatal("not reset")
+			}
+		})
+	}
+}
+
+// TestPlayerCriticalRedelivery sends critical messages to a client which does not ack them,
+// and checks they are sent again to the next client.
+func TestPlayerCriticalRedelivery(t *testing.T) {
+	for _, size := range []int{0, 1, 4} {
+		old := replayBufferSize
+		replayBufferSize = size
+		p := newPlayer(newMessageChannel(), newMessageChannel())
+		replayBufferSize = old
+		first := newMessageChannel()
+		p.switchClient(&bindReqToPlayer{recverForPlayer: newMessageChannel(), senderForPlayer: first, suite: p.suite, acking: true})
+
+		critical := p.suite.creater.createS2CQueuePosition(7, 0)
+		p.sendCriticalProto(critical.protoID, critical.proto)
+		for i := 0; i < 3; i++ {
+			m := testReplayMessage(p.suite, util.InvalidReason)
+			p.sendProto(m.protoID, m.proto)
+		}
+		if n := len(first.inCh); n != 4 {
+			t.Fatalf("size %v: first client got %v messages, want 4", size, n)
+		}
+
+		next := newMessageChannel()
+		p.switchClient(&bindReqToPlayer{recverForPlayer: newMessageChannel(), senderForPlayer: next, suite: p.suite, acking: true})
+		if n := len(next.inCh); n != 1 {
+			t.Fatalf("size %v: next client got %v messages, want 1", size, n)
+		}
+		m := <-next.inCh
+		pos, ok := m.proto.(*protojson.S2CQueuePosition)
+		if m.protoID != proto.S2CQueuePositionID || !ok || pos.Position != 7 || m.seq != 1 {
+			t.Fatalf("size %v: got %v seq %v, want the critical message numbered 1", size, m.protoID, m.seq)
+		}
+
+		// acked by the next client, nothing is sent again
+		p.replay.ack(1)
+		last := newMessageChannel()
+		p.switchClient(&bindReqToPlayer{recverForPlayer: newMessageChannel(), senderForPlayer: last, suite: p.suite, acking: true})
+		if n := len(last.inCh); n != 0 {
+			t.Fatalf("size %v: acked message sent again", size)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	protojson "biblio/protocol/json"
+	protopb "biblio/protocol/pb"
+	"biblio/util"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net"
+	atom "sync/atomic"
+	"time"
+)
+
+// Session resume.
+//
+// S2CAuth passed carries a resume token. If the connection drops, the client may connect again
+// and send C2SResume with the token instead of C2SAuth, while its player is still online
+// (before the player is kicked by heartbeat timeout). Received is the number of messages from
+// the player it has received since S2CAuth, S2CAuth and S2CClose not counted. It is the seq of the
+// last message received for a client of ackProtocolVersion, and acks the messages.
+// The client MUST NOT send anything else before S2CAuth of C2SResume.
+//
+// The player takes the new client in its own goroutine, and never leaves online state. It sends
+// S2CAuth with a new resume token and LastSeq, the sequence number of the last message from the
+// client it has handled, then sends again the messages after the first Received ones, kept by its
+// replayBuffer. Frames from the new connection continue the sequence numbers after LastSeq, so
+// the client sends again its messages after LastSeq.
+//
+// A resumed client takes a slot of the login queue without waiting(see login_queue.go).
+//
+// Resume fails with S2CAuth not passed if the player is not online, the token or codec does not
+// match, or the messages are not kept any more. The client should send C2SAuth then.
+
+const resumeTokenLen = 16
+
+func newResumeToken() string {
+	b := make([]byte, resumeTokenLen)
+	if _, err := rand.Read(b); err != nil {
+		log.Println(err)
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// ackRequest extracts seq of C2SAck of any codec.
+func ackRequest(proto interface{}) (seq uint32, ok bool) {
+	switch req := proto.(type) {
+	case *protojson.C2SAck:
+		return req.Seq, true
+	case *protopb.C2SAck:
+		return req.Seq, true
+	}
+	return 0, false
+}
+
+// resumeRequest extracts fields of C2SResume of any codec.
+func resumeRequest(proto interface{}) (uid int64, token string, received uint32, ok bool) {
+	switch req := proto.(type) {
+	case *protojson.C2SResume:
+		return req.UID, req.ResumeToken, req.Received, true
+	case *protopb.C2SResume:
+		return req.UID, req.ResumeToken, req.Received, true
+	}
+	return 0, "", 0, false
+}
+
+type resumeReqToPlayer struct {
+	token           string
+	received        uint32
+	recverForPlayer messageMediator
+	senderForPlayer messageMediator
+	remoteAddr      net.Addr
+	suite           *codecSuite
+	acking          bool
+
+	state int32 // 0 waiting, 1 taken by the player, -1 given up by the client
+	done  chan resumeResult
+}
+
+type resumeResult struct {
+	ok      bool
+	lastSeq uint32
+}
+
+func newResumeReqToPlayer(c *Client, token string, received uint32) *resumeReqToPlayer {
+	return &resumeReqToPlayer{
+		token:           token,
+		received:        received,
+		recverForPlayer: c.sender,
+		senderForPlayer: c.recver,
+		remoteAddr:      c.getRemoteAddr(),
+		suite:           c.suite,
+		acking:          c.protocolVersion >= ackProtocolVersion,
+		done:            make(chan resumeResult, 1),
+	}
+}
+
+// handleResume resumes the session of C2SResume. It blocks until the player takes the client.
+func (c *Client) handleResume(msg *message) {
+	defer func() { c.resuming = false }()
+
+	uid, token, received, ok := resumeRequest(msg.proto)
+	if !ok {
+		c.close()
+		return
+	}
+
+	c.onBind()
+	result := serverInst.resume(uid, newResumeReqToPlayer(c, token, received))
+	if !result.ok {
+		log.Printf("client[%v] uid[%v] resume failed\n", c.id, uid)
+		c.sender.notifyClose()
+		c.recver.addMessage(c.suite.creater.createS2CAuth(false, "", 0))
+		c.recver.notifyClose()
+		return
+	}
+	serverInst.loginQueue.take(c)
+	c.setLastSeq(result.lastSeq)
+}
+
+// resume hands req to the online player of uid, and waits for the result.
+func (b *Server) resume(uid int64, req *resumeReqToPlayer) resumeResult {
+	b.muxp.Lock()
+	p, ok := b.players[uid]
+	b.muxp.Unlock()
+	if !ok || !p.reqResume(req) {
+		return resumeResult{}
+	}
+
+	t := time.NewTimer(bindProcessMaxTime)
+	defer t.Stop()
+	select {
+	case r := <-req.done:
+		return r
+	case <-t.C:
+		if atom.CompareAndSwapInt32(&req.state, 0, -1) {
+			return resumeResult{}
+		}
+		// the player has taken it
+		return <-req.done
+	}
+}
+
+func (p *Player) reqResume(req *resumeReqToPlayer) bool {
+	select {
+	case p.resumeReqs <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// resume takes the client of req if the session can be resumed. It is called by handleMsg.
+func (p *Player) resume(req *resumeReqToPlayer) {
+	if !atom.CompareAndSwapInt32(&req.state, 0, 1) {
+		return
+	}
+	if !p.isOnline() || req.suite != p.suite || req.acking != p.replay.acking || p.resumeToken == "" ||
+		subtle.ConstantTimeCompare([]byte(req.token), []byte(p.resumeToken)) != 1 {
+		req.done <- resumeResult{}
+		return
+	}
+	if p.replay.acking && !p.replay.ack(req.received) {
+		req.done <- resumeResult{}
+		return
+	}
+	if !p.replay.covers(req.received) {
+		req.done <- resumeResult{}
+		return
+	}
+
+	p.recver.notifyClose()
+	p.sendMessageAnyway(p.suite.creater.createS2CClose(util.AnotherClientConnected))
+	p.sender.notifyClose()
+
+	p.recver = req.recverForPlayer
+	p.sender = req.senderForPlayer
+	p.remote = req.remoteAddr
+	p.resumeToken = newResumeToken()
+
+	lastSeq := p.getLastInSeq()
+	p.sender.addMessage(p.suite.creater.createS2CAuth(true, p.resumeToken, lastSeq))
+	resend := p.replay.after(req.received)
+	for _, msg := range resend {
+		p.sender.addMessage(msg)
+	}
+	addAckStats(&ackStats.retransmits, len(resend))
+	p.notifyBindSuccess()
+	p.onHeartbeat()
+	req.done <- resumeResult{ok: true, lastSeq: lastSeq}
+}
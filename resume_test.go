@@ -0,0 +1,113 @@
+package main
+
+import (
+	proto "biblio/protocol"
+	protojson "biblio/protocol/json"
+	"biblio/util"
+	"testing"
+)
+
+// TestPlayerResume resumes a player which has sent 4 messages numbered 1~4 to its client,
+// the first one critical, and the client acks none of them.
+func TestPlayerResume(t *testing.T) {
+	const token = "0123456789abcdef"
+	tests := []struct {
+		name     string
+		token    string
+		received uint32
+		offline  bool // kicked by heartbeat timeout
+		resumes  int  // resumed before by token
+		ok       bool
+		resend   []uint32
+	}{
+		{"valid token", token, 2, false, 0, true, []uint32{3, 4}},
+		{"unacked critical message", token, 0, false, 0, true, []uint32{1, 2, 3, 4}},
+		{"all received", token, 4, false, 0, true, nil},
+		{"wrong token", "fedcba9876543210", 2, false, 0, false, nil},
+		{"empty token", "", 2, false, 0, false, nil},
+		{"expired token", token, 2, false, 1, false, nil},
+		{"player offline", token, 2, true, 0, false, nil},
+		{"received not sent", token, 5, false, 0, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPlayer(nil, nil)
+			attached := newMessageChannel() // the client which is still attached
+			p.switchClient(&bindReqToPlayer{recverForPlayer: newMessageChannel(), senderForPlayer: attached,
+				suite: p.suite, resumeToken: token, acking: true})
+			if !tt.offline {
+				p.setState(newPlayerStateOnline(p))
+			}
+			critical := p.suite.creater.createS2CQueuePosition(7, 0)
+			p.sendCriticalProto(critical.protoID, critical.proto)
+			for i := 0; i < 3; i++ {
+				m := testReplayMessage(p.suite, util.InvalidReason)
+				p.sendProto(m.protoID, m.proto)
+			}
+			before := len(attached.inCh)
+			for i := 0; i < tt.resumes; i++ {
+				req := newResumeReqToPlayer(newClient(), token, 0)
+				req.acking = true
+				p.resume(req)
+				if !(<-req.done).ok {
+					t.Fatal("first resume failed")
+				}
+				attached = req.senderForPlayer.(*messageChannel)
+				before = len(attached.inCh)
+			}
+
+			client := newClient()
+			req := newResumeReqToPlayer(client, tt.token, tt.received)
+			req.acking = true
+			p.resume(req)
+			result := <-req.done
+			if result.ok != tt.ok {
+				t.Fatalf("resumed %v, want %v", result.ok, tt.ok)
+			}
+			inCh := client.recver.(*messageChannel).inCh
+			if !tt.ok {
+				if len(inCh) != 0 || len(attached.inCh) != before || attached.shouldClose() {
+					t.Fatal("client switched by a failed resume")
+				}
+				return
+			}
+
+			// the attached client is told and closed
+			if len(attached.inCh) != before+1 || !attached.shouldClose() {
+				t.Fatal("attached client not closed")
+			}
+			for len(attached.inCh) > 1 {
+				<-attached.inCh
+			}
+			if m := <-attached.inCh; m.protoID != proto.S2CCloseID ||
+				m.proto.(*protojson.S2CClose).Reason != util.AnotherClientConnected {
+				t.Fatalf("attached client got %v", m.protoID)
+			}
+
+			m := <-inCh
+			auth, ok := m.proto.(*protojson.S2CAuth)
+			if !ok || !auth.Passed || auth.ResumeToken == "" || auth.ResumeToken == token {
+				t.Fatalf("got %+v, want S2CAuth passed with a new token", m.proto)
+			}
+			var seqs []uint32
+			for len(inCh) > 0 {
+				seqs = append(seqs, (<-inCh).seq)
+			}
+			if !equalSeqs(seqs, tt.resend) {
+				t.Fatalf("resend %v, want %v", seqs, tt.resend)
+			}
+		})
+	}
+}
+
+func TestClientResumeNotOnline(t *testing.T) {
+	client := newClient()
+	client.resuming = true
+	client.handleResume(&message{protoID: proto.C2SResumeID,
+		proto: &protojson.C2SResume{UID: -1, ResumeToken: "0123456789abcdef"}})
+
+	m := <-client.recver.(*messageChannel).inCh
+	if auth, ok := m.proto.(*protojson.S2CAuth); !ok || auth.Passed || client.resuming || !client.sender.shouldClose() {
+		t.Fatalf("got %+v, want S2CAuth not passed", m.proto)
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	atom "sync/atomic"
+	"time"
+)
+
+// rudp is a reliable, ordered ARQ session layer over udp, which is similar to KCP.
+// It works in stream mode: bytes written to a session are read from the peer in order,
+// so that the Codec framing is the same as tcp.
+//
+// Segment layout(big endian):
+// [uint32 conv][uint8 cmd][uint16 wnd][uint32 ts][uint32 sn][uint32 una][uint16 len][data]
+// A datagram contains one or more segments.
+//
+// The client numbers its data segments from 0. The server numbers its own from a random sn,
+// the client takes the sn of the first data segment it receives as the next one to receive.
+// So an ack of server data proves that the peer receives datagrams sent to its address.
+// For the same reason, a fin is accepted only from the remote address, and only if its una acks
+// server data, so it is not enough to know or guess the conv to close a session.
+
+const (
+	rudpCmdPush = 81 // data
+	rudpCmdAck  = 82 // ack of a data segment
+	rudpCmdFin  = 83 // session closed
+
+	rudpHeaderLen = 21
+	rudpMTU       = 1400
+	rudpMSS       = rudpMTU - rudpHeaderLen
+	rudpWndSize   = 128
+
+	rudpInterval   = 10 * time.Millisecond // interval of session update
+	rudpRTODefault = 200                   // ms
+	rudpRTOMin     = 30                    // ms
+	rudpRTOMax     = 5000                  // ms
+	rudpFastResend = 2                     // resend a segment when it is skipped by so many acks
+	rudpDeadLink   = 20                    // max transmission count of a segment
+
+	// Max bytes waiting to be sent. A client which can not receive data
+	// quickly enough is closed, instead of using up server memory.
+	rudpMaxWaitSnd = 4 * 1024 * 1024
+	// Max bytes received but not read. Data beyond it is dropped without ack
+	// until the application reads, and the peer resends it.
+	rudpMaxRcvQueue = rudpWndSize * rudpMSS
+)
+
+var rudpIdleTimeout = 30 * time.Second
+
+var errRUDPClosed = errors.New("rudp session closed")
+var errRUDPSendBufferFull = errors.New("rudp send buffer full")
+var errRUDPInvalidSegment = errors.New("rudp invalid segment")
+
+var rudpEpoch = time.Now()
+
+// rudpNow returns milliseconds since rudpEpoch.
+func rudpNow() uint32 {
+	return uint32(time.Now().Sub(rudpEpoch) / time.Millisecond)
+}
+
+// rudpTimeDiff returns later-earlier, it works even if the clock wraps.
+func rudpTimeDiff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+type rudpSegment struct {
+	cmd  uint8
+	wnd  uint16
+	ts   uint32
+	sn   uint32
+	una  uint32
+	data []byte
+
+	resendts uint32 // when to resend
+	rto      uint32
+	fastack  int
+	xmit     int
+}
+
+func (seg *rudpSegment) encode(conv uint32, b []byte) []byte {
+	var h [rudpHeaderLen]byte
+	binary.BigEndian.PutUint32(h[0:], conv)
+	h[4] = seg.cmd
+	binary.BigEndian.PutUint16(h[5:], seg.wnd)
+	binary.BigEndian.PutUint32(h[7:], seg.ts)
+	binary.BigEndian.PutUint32(h[11:], seg.sn)
+	binary.BigEndian.PutUint32(h[15:], seg.una)
+	binary.BigEndian.PutUint16(h[19:], uint16(len(seg.data)))
+	b = append(b, h[:]...)
+	return append(b, seg.data...)
+}
+
+// rudpPeekHeader returns conv, cmd and sn of the first segment in a datagram.
+func rudpPeekHeader(b []byte) (conv uint32, cmd uint8, sn uint32, ok bool) {
+	if len(b) < rudpHeaderLen {
+		return 0, 0, 0, false
+	}
+	return binary.BigEndian.Uint32(b[0:]), b[4], binary.BigEndian.Uint32(b[11:]), true
+}
+
+type rudpAck struct {
+	sn uint32
+	ts uint32
+}
+
+// rudpSession is one reliable session with a remote udp address.
+type rudpSession struct {
+	conv   uint32
+	remote *net.UDPAddr
+	output func(b []byte, addr *net.UDPAddr) error
+
+	mux sync.Mutex
+
+	isn      uint32 // first sn to send, random
+	sndUna   uint32 // first unacknowledged sn
+	sndNxt   uint32 // next sn to send
+	rcvNxt   uint32 // next sn to receive
+	rmtWnd   uint16
+	sndQueue [][]byte       // data waiting to be sent
+	waitSnd  int            // bytes in sndQueue and sndBuf
+	sndBuf   []*rudpSegment // segments sent but not acknowledged
+	rcvBuf   map[uint32][]byte
+	rcvQueue []byte // ordered data which is not read
+	acklist  []rudpAck
+
+	srtt   int32
+	rttvar int32
+	rto    uint32
+
+	outBuf []byte // datagram being built by update, reused
+
+	lastRecv time.Time
+
+	dataReady chan bool
+
+	closeGuard int32
+	closed     chan bool
+}
+
+func newRUDPSession(conv uint32, remote *net.UDPAddr, output func([]byte, *net.UDPAddr) error) *rudpSession {
+	var b [4]byte
+	rand.Read(b[:])
+	isn := binary.BigEndian.Uint32(b[:])
+	return &rudpSession{
+		conv:      conv,
+		isn:       isn,
+		sndUna:    isn,
+		sndNxt:    isn,
+		remote:    remote,
+		output:    output,
+		rmtWnd:    rudpWndSize,
+		rcvBuf:    make(map[uint32][]byte, rudpWndSize),
+		rto:       rudpRTODefault,
+		outBuf:    make([]byte, 0, rudpMTU),
+		lastRecv:  time.Now(),
+		dataReady: make(chan bool, 1),
+		closed:    make(chan bool),
+	}
+}
+
+// @public
+func (s *rudpSession) close() {
+	if atom.CompareAndSwapInt32(&s.closeGuard, 0, 1) {
+		close(s.closed)
+	}
+}
+
+// @public
+func (s *rudpSession) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *rudpSession) notifyDataReady() {
+	select {
+	case s.dataReady <- true:
+	default:
+	}
+}
+
+// @public
+// read reads ordered data. It waits for data until timer fires, in which case it returns 0, nil.
+func (s *rudpSession) read(buf []byte, timer *time.Timer) (int, error) {
+	for {
+		s.mux.Lock()
+		if len(s.rcvQueue) > 0 {
+			n := copy(buf, s.rcvQueue)
+			s.rcvQueue = s.rcvQueue[n:]
+			s.mux.Unlock()
+			return n, nil
+		}
+		s.mux.Unlock()
+
+		if s.isClosed() {
+			return 0, errRUDPClosed
+		}
+
+		select {
+		case <-s.dataReady:
+		case <-s.closed:
+		case <-timer.C:
+			return 0, nil
+		}
+	}
+}
+
+// @public
+// write queues data to send. The data is copied.
+func (s *rudpSession) write(data []byte) error {
+	if s.isClosed() {
+		return errRUDPClosed
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.waitSnd+len(data) > rudpMaxWaitSnd {
+		return errRUDPSendBufferFull
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > rudpMSS {
+			n = rudpMSS
+		}
+		b := make([]byte, n)
+		copy(b, data[:n])
+		s.sndQueue = append(s.sndQueue, b)
+		s.waitSnd += n
+		data = data[n:]
+	}
+	return nil
+}
+
+// @public
+// pendingBytes returns count of bytes which are not acknowledged by the peer.
+func (s *rudpSession) pendingBytes() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.waitSnd
+}
+
+// @public
+// input handles a datagram from the peer, from is its source address.
+func (s *rudpSession) input(b []byte, from *net.UDPAddr) error {
+	now := rudpNow()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.lastRecv = time.Now()
+	var dataAdded bool
+	var maxAck uint32
+	var hasAck bool
+
+	for len(b) > 0 {
+		if len(b) < rudpHeaderLen {
+			return errRUDPInvalidSegment
+		}
+		conv := binary.BigEndian.Uint32(b[0:])
+		cmd := b[4]
+		wnd := binary.BigEndian.Uint16(b[5:])
+		ts := binary.BigEndian.Uint32(b[7:])
+		sn := binary.BigEndian.Uint32(b[11:])
+		una := binary.BigEndian.Uint32(b[15:])
+		length := int(binary.BigEndian.Uint16(b[19:]))
+		b = b[rudpHeaderLen:]
+		if conv != s.conv || length > len(b) {
+			return errRUDPInvalidSegment
+		}
+		data := b[:length]
+		b = b[length:]
+
+		s.rmtWnd = wnd
+		s.parseUna(una)
+
+		switch cmd {
+		case rudpCmdAck:
+			if rtt := rudpTimeDiff(now, ts); rtt >= 0 {
+				s.updateRTT(rtt)
+			}
+			s.parseAck(sn)
+			if !hasAck || rudpTimeDiff(sn, maxAck) > 0 {
+				maxAck = sn
+				hasAck = true
+			}
+		case rudpCmdPush:
+			if rudpTimeDiff(sn, s.rcvNxt+rudpWndSize) >= 0 || len(s.rcvQueue) >= rudpMaxRcvQueue {
+				// out of receive window, or not read, drop it without ack
+				break
+			}
+			s.acklist = append(s.acklist, rudpAck{sn, ts})
+			if rudpTimeDiff(sn, s.rcvNxt) >= 0 {
+				if _, ok := s.rcvBuf[sn]; !ok {
+					d := make([]byte, len(data))
+					copy(d, data)
+					s.rcvBuf[sn] = d
+				}
+				dataAdded = s.moveToRcvQueue() || dataAdded
+			}
+		case rudpCmdFin:
+			if s.acceptFin(una, from) {
+				s.close()
+			}
+		default:
+			return errRUDPInvalidSegment
+		}
+	}
+
+	if hasAck {
+		s.parseFastack(maxAck)
+	}
+	if dataAdded {
+		s.notifyDataReady()
+	}
+	return nil
+}
+
+// acceptFin returns true if a fin of una from the address is from the peer.
+func (s *rudpSession) acceptFin(una uint32, from *net.UDPAddr) bool {
+	if from == nil || !from.IP.Equal(s.remote.IP) || from.Port != s.remote.Port {
+		return false
+	}
+	return rudpTimeDiff(una, s.isn) > 0 && rudpTimeDiff(una, s.sndNxt) <= 0
+}
+
+func (s *rudpSession) moveToRcvQueue() bool {
+	var moved bool
+	for len(s.rcvQueue) < rudpMaxRcvQueue {
+		d, ok := s.rcvBuf[s.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(s.rcvBuf, s.rcvNxt)
+		s.rcvQueue = append(s.rcvQueue, d...)
+		s.rcvNxt++
+		moved = true
+	}
+	return moved
+}
+
+func (s *rudpSession) updateRTT(rtt int32) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+	} else {
+		delta := rtt - s.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rttvar = (3*s.rttvar + delta) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+		if s.srtt < 1 {
+			s.srtt = 1
+		}
+	}
+
+	v := 4 * s.rttvar
+	if interval := int32(rudpInterval / time.Millisecond); v < interval {
+		v = interval
+	}
+	rto := s.srtt + v
+	if rto < rudpRTOMin {
+		rto = rudpRTOMin
+	} else if rto > rudpRTOMax {
+		rto = rudpRTOMax
+	}
+	s.rto = uint32(rto)
+}
+
+func (s *rudpSession) removeSndBuf(i int) {
+	s.waitSnd -= len(s.sndBuf[i].data)
+	copy(s.sndBuf[i:], s.sndBuf[i+1:])
+	s.sndBuf[len(s.sndBuf)-1] = nil
+	s.sndBuf = s.sndBuf[:len(s.sndBuf)-1]
+}
+
+func (s *rudpSession) parseUna(una uint32) {
+	// una beyond the data sent is forged, or the peer has not received any data yet
+	if rudpTimeDiff(una, s.sndNxt) > 0 {
+		return
+	}
+	for len(s.sndBuf) > 0 && rudpTimeDiff(una, s.sndBuf[0].sn) > 0 {
+		s.removeSndBuf(0)
+	}
+	if rudpTimeDiff(una, s.sndUna) > 0 {
+		s.sndUna = una
+	}
+}
+
+func (s *rudpSession) parseAck(sn uint32) {
+	for i, seg := range s.sndBuf {
+		if seg.sn == sn {
+			s.removeSndBuf(i)
+			break
+		}
+		if rudpTimeDiff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+	if len(s.sndBuf) > 0 {
+		s.sndUna = s.sndBuf[0].sn
+	} else {
+		s.sndUna = s.sndNxt
+	}
+}
+
+func (s *rudpSession) parseFastack(sn uint32) {
+	for _, seg := range s.sndBuf {
+		if rudpTimeDiff(sn, seg.sn) <= 0 {
+			break
+		}
+		seg.fastack++
+	}
+}
+
+func (s *rudpSession) wndUnused() uint16 {
+	used := len(s.rcvBuf) + len(s.rcvQueue)/rudpMSS
+	if used >= rudpWndSize {
+		return 0
+	}
+	return uint16(rudpWndSize - used)
+}
+
+// @public
+// confirmed returns true if the peer has acked data of the session, so that the peer
+// does receive datagrams sent to the remote address.
+func (s *rudpSession) confirmed() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.sndUna != s.isn
+}
+
+// @public
+// update sends acks, new segments and retransmissions. It returns false if the session is dead.
+func (s *rudpSession) update() bool {
+	if s.isClosed() {
+		return false
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if time.Now().Sub(s.lastRecv) > rudpIdleTimeout {
+		s.close()
+		return false
+	}
+
+	if len(s.acklist) == 0 && len(s.sndQueue) == 0 && len(s.sndBuf) == 0 {
+		return true
+	}
+
+	now := rudpNow()
+	wnd := s.wndUnused()
+	buf := s.outBuf[:0]
+
+	// output sends buf before it returns, so that buf can be reused
+	flush := func() {
+		if len(buf) > 0 {
+			s.output(buf, s.remote)
+			buf = buf[:0]
+		}
+	}
+	add := func(seg *rudpSegment) {
+		if len(buf)+rudpHeaderLen+len(seg.data) > rudpMTU {
+			flush()
+		}
+		buf = seg.encode(s.conv, buf)
+	}
+
+	for _, ack := range s.acklist {
+		add(&rudpSegment{cmd: rudpCmdAck, wnd: wnd, ts: ack.ts, sn: ack.sn, una: s.rcvNxt})
+	}
+	s.acklist = s.acklist[:0]
+
+	// move data from sndQueue to sndBuf, but no more than the window
+	cwnd := uint32(rudpWndSize)
+	if uint32(s.rmtWnd) < cwnd {
+		cwnd = uint32(s.rmtWnd)
+	}
+	if cwnd == 0 {
+		cwnd = 1 // probe the remote window
+	}
+	for len(s.sndQueue) > 0 && rudpTimeDiff(s.sndNxt, s.sndUna+cwnd) < 0 {
+		seg := &rudpSegment{
+			cmd:  rudpCmdPush,
+			sn:   s.sndNxt,
+			data: s.sndQueue[0],
+			rto:  s.rto,
+		}
+		s.sndQueue[0] = nil
+		s.sndQueue = s.sndQueue[1:]
+		s.sndBuf = append(s.sndBuf, seg)
+		s.sndNxt++
+	}
+
+	for _, seg := range s.sndBuf {
+		var send bool
+		if seg.xmit == 0 {
+			send = true
+		} else if rudpTimeDiff(now, seg.resendts) >= 0 {
+			send = true
+			seg.rto += seg.rto / 2
+			if seg.rto > rudpRTOMax {
+				seg.rto = rudpRTOMax
+			}
+		} else if seg.fastack >= rudpFastResend {
+			send = true
+			seg.fastack = 0
+		}
+
+		if send {
+			if seg.xmit >= rudpDeadLink {
+				s.close()
+				return false
+			}
+			seg.xmit++
+			seg.ts = now
+			seg.wnd = wnd
+			seg.una = s.rcvNxt
+			seg.resendts = now + seg.rto
+			add(seg)
+		}
+	}
+
+	flush()
+	s.outBuf = buf
+	return true
+}
+
+// @public
+// sendFin tells the peer that the session is closed. It is not reliable.
+func (s *rudpSession) sendFin() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	seg := &rudpSegment{cmd: rudpCmdFin, una: s.rcvNxt}
+	s.output(seg.encode(s.conv, nil), s.remote)
+}
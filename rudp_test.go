@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestRUDPPair returns a server session and the client session of it, connected directly.
+// drop tells whether the n-th datagram(from 0, both directions) is lost.
+func newTestRUDPPair(drop func(n int) bool) (server *rudpSession, client *rudpSession) {
+	var n int
+	deliver := func(to **rudpSession) func([]byte, *net.UDPAddr) error {
+		return func(b []byte, addr *net.UDPAddr) error {
+			n++
+			if drop != nil && drop(n-1) {
+				return nil
+			}
+			return (*to).input(append([]byte(nil), b...), addr)
+		}
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+	server = newRUDPSession(1, addr, deliver(&client))
+	client = newRUDPSession(1, addr, deliver(&server))
+	// the client numbers its data from 0, and takes the first sn of server
+	client.isn, client.sndUna, client.sndNxt = 0, 0, 0
+	client.rcvNxt = server.isn
+	return server, client
+}
+
+// takeAll returns data received by s.
+func (s *rudpSession) takeAll() []byte {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	b := s.rcvQueue
+	s.rcvQueue = nil
+	return b
+}
+
+// pumpRUDP updates both sessions until want is received by to, or timeout.
+func pumpRUDP(t *testing.T, a, b, to *rudpSession, want int) []byte {
+	var got []byte
+	deadline := time.Now().Add(10 * time.Second)
+	for len(got) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %v of %v bytes", len(got), want)
+		}
+		if !a.update() || !b.update() {
+			t.Fatal("session dead")
+		}
+		got = append(got, to.takeAll()...)
+		time.Sleep(time.Millisecond)
+	}
+	return got
+}
+
+func TestRUDPRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		drop func(n int) bool
+	}{
+		{"one byte", 1, nil},
+		{"one segment", rudpMSS, nil},
+		{"segments", 3*rudpMSS + 7, nil},
+		{"beyond window", (rudpWndSize + 10) * rudpMSS, nil},
+		{"lossy", 20 * rudpMSS, func(n int) bool { return n%4 == 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newTestRUDPPair(tt.drop)
+			data := make([]byte, tt.size)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+
+			if err := client.write(data); err != nil {
+				t.Fatal(err)
+			}
+			if got := pumpRUDP(t, client, server, server, len(data)); !bytes.Equal(got, data) {
+				t.Fatal("c2s data not match")
+			}
+			if err := server.write(data); err != nil {
+				t.Fatal(err)
+			}
+			if got := pumpRUDP(t, server, client, client, len(data)); !bytes.Equal(got, data) {
+				t.Fatal("s2c data not match")
+			}
+			if !server.confirmed() {
+				t.Fatal("server session not confirmed after its data is acked")
+			}
+		})
+	}
+}
+
+func TestRUDPSendBufferFull(t *testing.T) {
+	server, _ := newTestRUDPPair(nil)
+	if err := server.write(make([]byte, rudpMaxWaitSnd)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.write([]byte{1}); err != errRUDPSendBufferFull {
+		t.Fatalf("got %v, want %v", err, errRUDPSendBufferFull)
+	}
+}
+
+func testRUDPSegment(conv uint32, cmd uint8, sn uint32, una uint32, data []byte) []byte {
+	seg := &rudpSegment{cmd: cmd, wnd: rudpWndSize, sn: sn, una: una, data: data}
+	return seg.encode(conv, nil)
+}
+
+func TestRUDPForgedUna(t *testing.T) {
+	var sent int
+	s := newRUDPSession(1, &net.UDPAddr{}, func([]byte, *net.UDPAddr) error {
+		sent++
+		return nil
+	})
+
+	// nothing is sent, any una is forged
+	for _, una := range []uint32{s.isn + 1, s.isn + 1000, 0} {
+		if err := s.input(testRUDPSegment(1, rudpCmdAck, s.isn, una, nil), nil); err != nil {
+			t.Fatal(err)
+		}
+		if s.confirmed() {
+			t.Fatalf("confirmed by una %v", una-s.isn)
+		}
+	}
+
+	if err := s.write(make([]byte, 3*rudpMSS)); err != nil {
+		t.Fatal(err)
+	}
+	s.update()
+	if sent == 0 {
+		t.Fatal("nothing sent")
+	}
+	if err := s.input(testRUDPSegment(1, rudpCmdPush, 0, s.sndNxt+100, []byte{1}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.sndBuf) != 3 || s.confirmed() {
+		t.Fatalf("una beyond data sent drops %v segments", 3-len(s.sndBuf))
+	}
+
+	if err := s.input(testRUDPSegment(1, rudpCmdPush, 1, s.isn+2, []byte{2}), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.sndBuf) != 1 || !s.confirmed() {
+		t.Fatalf("una of data sent: %v segments left", len(s.sndBuf))
+	}
+}
+
+func TestRUDPIdleUpdate(t *testing.T) {
+	var sent int
+	s := newRUDPSession(1, &net.UDPAddr{}, func([]byte, *net.UDPAddr) error {
+		sent++
+		return nil
+	})
+	for i := 0; i < 10; i++ {
+		if !s.update() {
+			t.Fatal("session dead")
+		}
+	}
+	if sent != 0 {
+		t.Fatalf("idle session sends %v datagrams", sent)
+	}
+
+	s.write([]byte{1, 2, 3})
+	s.update()
+	if sent != 1 {
+		t.Fatalf("sends %v datagrams, want 1", sent)
+	}
+}
+
+func TestRUDPInvalidSegment(t *testing.T) {
+	s := newRUDPSession(1, &net.UDPAddr{}, func([]byte, *net.UDPAddr) error { return nil })
+	push := testRUDPSegment(1, rudpCmdPush, 0, 0, []byte{1, 2, 3})
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short header", push[:rudpHeaderLen-1]},
+		{"truncated data", push[:len(push)-1]},
+		{"other conv", testRUDPSegment(2, rudpCmdPush, 0, 0, nil)},
+		{"unknown cmd", testRUDPSegment(1, 99, 0, 0, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.input(tt.data, nil); err != errRUDPInvalidSegment {
+				t.Fatalf("got %v, want %v", err, errRUDPInvalidSegment)
+			}
+		})
+	}
+}
+
+func TestUDPAcceptorNewConv(t *testing.T) {
+	ln, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a := &udpAcceptor{
+		ln:       ln,
+		sessions: make(map[string]*rudpSession),
+		pending:  make(map[string]*rudpSession),
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	key := addr.String()
+
+	handshake := []byte(handshakeMagic + "\x06\x02pb\x00")
+	a.dispatch(serverInst, testRUDPSegment(1, rudpCmdPush, 0, 0, handshake), addr)
+	live := a.sessions[key]
+	if live == nil {
+		t.Fatal("session not created")
+	}
+	defer live.close()
+
+	// a datagram of another conv, which could be forged
+	a.dispatch(serverInst, testRUDPSegment(2, rudpCmdPush, 0, 0, handshake), addr)
+	pending := a.pending[key]
+	if pending == nil || a.sessions[key] != live || live.isClosed() {
+		t.Fatal("session replaced by an unconfirmed one")
+	}
+	defer pending.close()
+
+	// the handshake reply of the pending session is sent to the address
+	deadline := time.Now().Add(5 * time.Second)
+	for pending.pendingBytes() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no handshake reply")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	a.update()
+
+	// an ack guessing the sn is not a confirmation
+	a.dispatch(serverInst, testRUDPSegment(2, rudpCmdAck, 0, 1, nil), addr)
+	if a.sessions[key] != live {
+		t.Fatal("session replaced by a forged ack")
+	}
+
+	a.dispatch(serverInst, testRUDPSegment(2, rudpCmdAck, pending.isn, pending.isn+1, nil), addr)
+	if a.sessions[key] != pending || a.pending[key] != nil || !live.isClosed() {
+		t.Fatal("session not replaced by the confirmed one")
+	}
+}
+
+func TestRUDPFin(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10000}
+	tests := []struct {
+		name  string
+		from  *net.UDPAddr
+		una   func(s *rudpSession) uint32
+		close bool
+	}{
+		{"from other address", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 10000},
+			func(s *rudpSession) uint32 { return s.isn + 1 }, false},
+		{"from other port", &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 10001},
+			func(s *rudpSession) uint32 { return s.isn + 1 }, false},
+		{"no data acked", remote, func(s *rudpSession) uint32 { return s.isn }, false},
+		{"una beyond data sent", remote, func(s *rudpSession) uint32 { return s.sndNxt + 1 }, false},
+		{"guessed una", remote, func(s *rudpSession) uint32 { return 1 }, false},
+		{"from peer", remote, func(s *rudpSession) uint32 { return s.isn + 1 }, true},
+		{"from peer, all acked", remote, func(s *rudpSession) uint32 { return s.sndNxt }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRUDPSession(1, remote, func([]byte, *net.UDPAddr) error { return nil })
+			s.isn, s.sndUna, s.sndNxt = 1000, 1000, 1000 // so that "guessed una" is a wrong guess
+			s.write(make([]byte, 3*rudpMSS))
+			s.update()
+
+			if err := s.input(testRUDPSegment(1, rudpCmdFin, 0, tt.una(s), nil), tt.from); err != nil {
+				t.Fatal(err)
+			}
+			if s.isClosed() != tt.close {
+				t.Fatalf("closed %v, want %v", s.isClosed(), tt.close)
+			}
+		})
+	}
+}
+
+func TestRUDPRcvQueueLimit(t *testing.T) {
+	s := newRUDPSession(1, &net.UDPAddr{}, func([]byte, *net.UDPAddr) error { return nil })
+	data := make([]byte, rudpMSS)
+	n := uint32(rudpMaxRcvQueue / rudpMSS)
+	for sn := uint32(0); sn < n; sn++ {
+		s.input(testRUDPSegment(1, rudpCmdPush, sn, 0, data), nil)
+	}
+	if len(s.rcvQueue) != rudpMaxRcvQueue || len(s.acklist) != int(n) || s.wndUnused() != 0 {
+		t.Fatalf("rcvQueue %v bytes, %v acks", len(s.rcvQueue), len(s.acklist))
+	}
+
+	// not read, so it is dropped without ack
+	s.input(testRUDPSegment(1, rudpCmdPush, n, 0, data), nil)
+	if len(s.rcvQueue) != rudpMaxRcvQueue || len(s.acklist) != int(n) {
+		t.Fatalf("rcvQueue %v bytes, %v acks after the limit", len(s.rcvQueue), len(s.acklist))
+	}
+
+	buf := make([]byte, rudpMaxRcvQueue)
+	if got, err := s.read(buf, time.NewTimer(time.Second)); err != nil || got != rudpMaxRcvQueue {
+		t.Fatalf("read %v, %v", got, err)
+	}
+	// resent by the peer
+	s.input(testRUDPSegment(1, rudpCmdPush, n, 0, data), nil)
+	if len(s.rcvQueue) != rudpMSS || len(s.acklist) != int(n)+1 {
+		t.Fatalf("rcvQueue %v bytes, %v acks after read", len(s.rcvQueue), len(s.acklist))
+	}
+}
@@ -1,18 +1,120 @@
 package main
 
 import (
-	proto "biblio/protocol"
-	protojson "biblio/protocol/json"
 	twmm "github.com/ZhangGuangxu/timingwheelmm"
 	"log"
+	"os"
 	"sync"
 	"time"
 )
 
 var maxConnectionCount int
+var maxConnectionPerIP int // zero means no limit
+
+// Authenticated clients beyond playerCapacity wait in the login queue(see login_queue.go), zero means no limit.
+// loginQueueLanes is the number of priority lanes, vip levels above loginQueueLanes-1 share the highest one.
+// A client waiting longer than loginQueueMaxWait is closed.
+var playerCapacity int
+var loginQueueLanes int
+var loginQueueUpdateInterval time.Duration
+var loginQueueMaxWait time.Duration
+
+// accept rate limits(connections per second), zero means no limit
+var acceptRateGlobal float64
+var acceptBurstGlobal int
+var acceptRatePerIP float64
+var acceptBurstPerIP int
+
 var serverAddress string // "ip:port", for example: "127.0.0.1:10001", or ":10001"
-var protoFactory proto.ProtoFactory
 var wsAddress string
+var udpAddress string     // rudp listener, empty means disabled
+var unixSocketPath string // unix domain socket listener, empty means disabled
+var unixSocketMode os.FileMode
+var adminAddress string // admin http api, never expose it to the public network
+var adminSecret string  // required by admin requests changing the state, see adminAcceptor
+var webAddress string   // web-server(account server) registers login tokens here
+var webSecret string    // shared secret to sign web-server requests
+var serverID string     // signed login tokens are for this server only
+var gatewayAddress string
+var gatewayWSAddress string // empty means derived from wsAddress when the ws listener starts, see wsAcceptor
+
+// authMethod selects the Authenticator of C2SAuth(see authenticator.go): "memory", "signed" or "http".
+// Tokens of "signed" are signed by authSecret(authTokenAlg "hmac-sha256"), or by the private key
+// of authPublicKey(authTokenAlg "ed25519", base64). authHTTPURL is the account service of "http",
+// requests to it are signed by authHTTPSecret, which is never shared with the web-server.
+var authMethod string
+var authTokenAlg string
+var authSecret string
+var authPublicKey string
+var authTokenMaxLifetime time.Duration
+var authHTTPURL string
+var authHTTPTimeout time.Duration
+var authHTTPSecret string
+
+// wsSubprotocols is in order of preference, each one selects a codec and protocol version(see wsSubprotocolPrefix).
+var wsSubprotocols []string
+
+// handshakeRequired rejects stream connections which send no handshake(see handshake.go).
+var handshakeRequired bool
+
+// wsAllowedOrigins is a list of allowed Origin headers of websocket handshakes, for example
+// "https://game.example.com". If it is empty, the Origin host must be the same as the Host header.
+var wsAllowedOrigins []string
+
+// permessage-deflate of websocket. Messages smaller than wsCompressionThreshold
+// are not compressed, for example S2CAuth and S2CClose.
+var wsCompression bool
+var wsCompressionLevel int // -2(huffman only) ~ 9, see compress/flate
+var wsCompressionThreshold int
+
+// encryptionRequired rejects stream connections which are neither TLS nor encrypted(see frame_cipher.go).
+// handshakeKey signs key exchanges of encrypted sessions, base64 of an Ed25519 seed, empty disables encryption.
+var encryptionRequired bool
+var handshakeKey string
+
+// replayProtectionRequired closes clients which send messages not in idempotentMsgs to player
+// on connections open to replay, that is neither TLS nor encrypted(see frame.go).
+var replayProtectionRequired bool
+
+// Messages to a client are packed in batches(see out_batch.go), a batch is packed and written
+// when it has batchMaxMessages messages or its first message has waited batchMaxDelay.
+// Payload of a batch frame is up to batchMaxBytes. batchMaxMessages 1 disables batching.
+var batchMaxMessages int
+var batchMaxDelay time.Duration
+var batchMaxBytes int
+
+// messageBudgetBinded is the max bytes of a fragmented or compressed message from a binded client,
+// after reassembly and decompression. Clients not binded can send neither.
+var messageBudgetBinded int
+
+// replayBufferSize is the number of messages a player keeps for a client resuming the session(see resume.go),
+// it is also the unacked window of a client which acks. ackMaxPendingCritical is the max number of critical
+// messages kept unacked out of the window(see replay_buffer.go), they are kept even if replayBufferSize is 0.
+var replayBufferSize int
+var ackMaxPendingCritical int
+
+// Compression of v2 frames(see frame.go). Payloads smaller than frameCompressThreshold
+// are not compressed, 0 disables compression. frameCompressAlgo is "snappy" or "flate".
+var frameCompressThreshold int
+var frameCompressAlgo string
+
+// Default checksums of frames of listeners(see frame_checksum.go), a client of protocol version
+// not less than 4 may choose another one. frameChecksumDefault is of tcp, unix and rudp.
+var frameChecksumDefault string
+var frameChecksumTLS string
+var wsFrameChecksum string
+
+// Set serverProxyProtocol if the tcp listener is behind a load balancer sending PROXY protocol headers.
+// Only connections from trustedProxies are accepted then. For websocket, X-Forwarded-For and X-Real-IP
+// are honoured if the request comes from trustedProxies.
+var serverProxyProtocol bool
+var trustedProxies []string // CIDR or ip, for example "10.0.0.0/8"
+
+// certificate/key pairs, empty means no tls. Send SIGHUP to reload them.
+var serverCertFile string
+var serverKeyFile string
+var wsCertFile string
+var wsKeyFile string
 
 var clientWaitAuthMaxTime = 5 * time.Second // 等待接收客户端的auth消息的最大时长
 var bindProcessMaxTime = 5 * time.Second    // 收到客户端的auth请求后，要把client bind到player，多久后未完成认为处理超时
@@ -23,9 +125,55 @@ var playerUnloadTime = 10 * time.Minute
 
 func init() {
 	maxConnectionCount = 2000
+	maxConnectionPerIP = 20
+	playerCapacity = 1500
+	loginQueueLanes = 4
+	loginQueueUpdateInterval = 5 * time.Second
+	loginQueueMaxWait = 10 * time.Minute
+	acceptRateGlobal = 200
+	acceptBurstGlobal = 400
+	acceptRatePerIP = 5
+	acceptBurstPerIP = 10
 	serverAddress = "127.0.0.1:59632"
-	protoFactory = protojson.ProtoFactory
 	wsAddress = "127.0.0.1:59631"
+	wsSubprotocols = wsSubprotocolsOf([]string{codecNamePB, codecNameMsgpack, codecNameJSON})
+	wsCompression = true
+	wsCompressionLevel = 1
+	wsCompressionThreshold = 512
+	frameCompressThreshold = 1024
+	messageBudgetBinded = 1024 * 1024
+	replayBufferSize = 256
+	ackMaxPendingCritical = 1024
+	batchMaxMessages = 64
+	batchMaxDelay = 10 * time.Millisecond
+	batchMaxBytes = 8 * 1024
+	frameCompressAlgo = compressSnappy
+	frameChecksumDefault = checksumCRC32C
+	frameChecksumTLS = checksumNone
+	wsFrameChecksum = checksumNone
+	udpAddress = "127.0.0.1:59632"
+	unixSocketPath = ""
+	unixSocketMode = 0660
+	adminAddress = "127.0.0.1:59630"
+	adminSecret = os.Getenv("BIBLIO_ADMIN_SECRET")
+	webAddress = "127.0.0.1:59629"
+	webSecret = os.Getenv("BIBLIO_WEB_SECRET")
+	authMethod = authMethodMemory
+	authTokenAlg = authTokenAlgHMAC
+	authSecret = os.Getenv("BIBLIO_AUTH_SECRET")
+	authPublicKey = os.Getenv("BIBLIO_AUTH_PUBLIC_KEY")
+	handshakeKey = os.Getenv("BIBLIO_HANDSHAKE_KEY")
+	replayProtectionRequired = true
+	authTokenMaxLifetime = 5 * time.Minute
+	authHTTPURL = ""
+	authHTTPTimeout = 3 * time.Second
+	authHTTPSecret = os.Getenv("BIBLIO_AUTH_HTTP_SECRET")
+	// the address returned to web-server, which player-clients connect to
+	gatewayAddress = serverAddress
+	serverID = os.Getenv("BIBLIO_SERVER_ID")
+	if serverID == "" {
+		serverID = gatewayAddress
+	}
 }
 
 // Server wrap a server
@@ -39,7 +187,14 @@ type Server struct {
 	muxc    sync.Mutex
 	clients map[*Client]bool
 
+	admission *admission
+
+	loginQueue *loginQueue
+
+	authenticator Authenticator
+
 	twClient        *twmm.TimingWheel // 用于处理“auth消息在指定超时时间前未收到”
+	twClientQueued  *twmm.TimingWheel // 用于处理“client在登录队列中等待超时”
 	twClientBinding *twmm.TimingWheel // 用于处理“client bind到player的过程超时的情况”
 	// 用于处理指定时间内未收到客户端消息的情况。
 	// 主要考虑到player的逻辑处理协程可能发生死循环，同时player处于binding/kicking的状态。
@@ -57,6 +212,10 @@ type Server struct {
 
 	playerAcceptor *playerAcceptor
 	wsAcceptor     *wsAcceptor
+	udpAcceptor    *udpAcceptor
+	unixAcceptor   *unixAcceptor
+	adminAcceptor  *adminAcceptor
+	webAcceptor    *webAcceptor
 }
 
 // NewServer returns a server instance.
@@ -65,18 +224,39 @@ func NewServer() (*Server, error) {
 	s := &Server{
 		players:        make(map[int64]*Player, 100),
 		clients:        make(map[*Client]bool, 100),
+		admission:      newAdmission(),
+		loginQueue:     newLoginQueue(),
 		xBindReqs:      make(map[int64]interface{}, 100),
 		newXBindReqAdd: make(chan bool, 1),
 		wg:             &sync.WaitGroup{},
 		playerAcceptor: &playerAcceptor{},
 		wsAcceptor:     &wsAcceptor{},
+		udpAcceptor:    &udpAcceptor{},
+		unixAcceptor:   &unixAcceptor{},
+		adminAcceptor:  &adminAcceptor{},
+		webAcceptor:    newWebAcceptor(),
+	}
+
+	if err := loadHandshakeKey(); err != nil {
+		return nil, err
+	}
+	if handshakeSigner == nil {
+		log.Println("handshakeKey is empty, encrypted sessions are not available")
 	}
 
 	var err error
+	s.authenticator, err = newAuthenticator(authMethod)
+	if err != nil {
+		return nil, err
+	}
 	s.twClient, err = twmm.NewTimingWheel(clientWaitAuthMaxTime, 50)
 	if err != nil {
 		return nil, err
 	}
+	s.twClientQueued, err = twmm.NewTimingWheel(loginQueueMaxWait, 600)
+	if err != nil {
+		return nil, err
+	}
 	s.twClientBinding, err = twmm.NewTimingWheel(bindProcessMaxTime*2, 100)
 	if err != nil {
 		return nil, err
@@ -106,6 +286,34 @@ func (b *Server) addPlayer(uid int64, p *Player) {
 	b.players[uid] = p
 }
 
+// playerList returns a snapshot of players.
+func (b *Server) playerList() []*Player {
+	b.muxp.Lock()
+	defer b.muxp.Unlock()
+	players := make([]*Player, 0, len(b.players))
+	for _, p := range b.players {
+		players = append(players, p)
+	}
+	return players
+}
+
+func (b *Server) isPlayerOnline(uid int64) bool {
+	b.muxp.Lock()
+	p, ok := b.players[uid]
+	b.muxp.Unlock()
+	return ok && p.isOnline()
+}
+
+func (b *Server) onlinePlayerCount() int {
+	var n int
+	for _, p := range b.playerList() {
+		if p.isOnline() {
+			n++
+		}
+	}
+	return n
+}
+
 func (b *Server) addPlayerToKick(item *playerKickItem) {
 	b.twPlayerKick.AddItem(item)
 }
@@ -142,6 +350,14 @@ func (b *Server) stopWaitAuth(item *clientAuthTimeoutItem) {
 	b.twClient.DelItem(item)
 }
 
+func (b *Server) waitInQueue(item *clientQueuedTimeoutItem) {
+	b.twClientQueued.AddItem(item)
+}
+
+func (b *Server) stopWaitInQueue(item *clientQueuedTimeoutItem) {
+	b.twClientQueued.DelItem(item)
+}
+
 func (b *Server) waitClientBinding(item *clientBindingTimeoutItem) {
 	b.twClientBinding.AddItem(item)
 }
@@ -158,10 +374,35 @@ func (b *Server) stopWaitClientTimeout(item *clientBindedTimeoutItem) {
 	b.twClientBinded.DelItem(item)
 }
 
+// removeClient is invoked by both handleRead and handleWrite goroutines of a client.
 func (b *Server) removeClient(c *Client) {
 	b.muxc.Lock()
-	defer b.muxc.Unlock()
+	_, ok := b.clients[c]
 	delete(b.clients, c)
+	b.muxc.Unlock()
+
+	if ok {
+		b.admission.releaseIP(addrIP(c.getRemoteAddr()))
+		// after c is deleted, so that c can not enter the login queue again
+		b.loginQueue.leave(c)
+	}
+}
+
+// clientList returns a snapshot of clients.
+func (b *Server) clientList() []*Client {
+	b.muxc.Lock()
+	defer b.muxc.Unlock()
+	clients := make([]*Client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (b *Server) hasClient(c *Client) bool {
+	b.muxc.Lock()
+	defer b.muxc.Unlock()
+	return b.clients[c]
 }
 
 func (b *Server) clientCount() int {
@@ -179,9 +420,20 @@ func (b *Server) run(wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer log.Println("Server.run() quit")
 
+	if err := parseTrustedProxies(); err != nil {
+		log.Println(err)
+		setQuit()
+		return
+	}
+
 	b.startDoBind()
+	b.startDrainWatcher()
+	// in case no listener is inherited from the parent process
+	reportReady()
+	b.startLoginQueue()
 
 	b.startClientTimingWheel()
+	b.startClientQueuedTimingWheel()
 	b.startClientBindingTimingWheel()
 	b.startClientBindedTimingWheel()
 
@@ -190,10 +442,13 @@ func (b *Server) run(wg *sync.WaitGroup) {
 
 	b.playerAcceptor.start(b)
 	b.wsAcceptor.start(b)
+	b.udpAcceptor.start(b)
+	b.unixAcceptor.start(b)
+	b.adminAcceptor.start(b)
 
 	auther.startTimingWheel()
 
-	// TODO: 监听web-server的请求
+	b.webAcceptor.start(b)
 
 	b.wg.Wait()
 }
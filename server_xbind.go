@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"net"
 	"time"
 )
 
@@ -22,13 +23,21 @@ func newBindReq(uid int64, c *Client) *bindReq {
 type bindReqToPlayer struct {
 	recverForPlayer messageMediator
 	senderForPlayer messageMediator
+	remoteAddr      net.Addr
+	suite           *codecSuite
+	resumeToken     string
+	acking          bool // the client acks messages
 	endTime         time.Time
 }
 
-func newBindReqToPlayer(rP messageMediator, sP messageMediator, beginTime time.Time) *bindReqToPlayer {
+func newBindReqToPlayer(c *Client, beginTime time.Time) *bindReqToPlayer {
 	return &bindReqToPlayer{
-		recverForPlayer: rP,
-		senderForPlayer: sP,
+		recverForPlayer: c.sender,
+		senderForPlayer: c.recver,
+		remoteAddr:      c.getRemoteAddr(),
+		suite:           c.suite,
+		resumeToken:     c.resumeToken,
+		acking:          c.protocolVersion >= ackProtocolVersion,
 		endTime:         beginTime.Add(bindProcessMaxTime),
 	}
 }
@@ -73,30 +82,39 @@ func (b *Server) doReqBind(uid int64, c *Client) bool {
 	return false
 }
 
-func (b *Server) kickPlayer(uid int64) {
-	if b.doKickPlayer(uid) {
+// kickPlayer returns false if there is no player of uid.
+func (b *Server) kickPlayer(uid int64) bool {
+	found, added := b.doKickPlayer(uid)
+	if added {
 		b.setNewXBindReqAdded()
 	}
+	return found
 }
 
-func (b *Server) doKickPlayer(uid int64) bool {
+func (b *Server) doKickPlayer(uid int64) (found bool, added bool) {
 	b.muxx.Lock()
 	defer b.muxx.Unlock()
 
-	if v, ok := b.xBindReqs[uid]; ok {
-		if v == nil {
-			b.xBindReqs[uid] = newUnbindReq(uid)
-			return true
-		}
+	b.muxp.Lock()
+	_, found = b.players[uid]
+	b.muxp.Unlock()
+	if !found {
+		return false, false
+	}
 
-		if _, ok := v.(*bindReq); ok {
-			// do nothing
-		} else if _, ok := v.(*unbindReq); ok {
-			// do nothing
-		}
+	v, ok := b.xBindReqs[uid]
+	if !ok || v == nil {
+		b.xBindReqs[uid] = newUnbindReq(uid)
+		return true, true
 	}
 
-	return false
+	if _, ok := v.(*bindReq); ok {
+		// do nothing
+	} else if _, ok := v.(*unbindReq); ok {
+		// do nothing
+	}
+
+	return true, false
 }
 
 func (b *Server) setNewXBindReqAdded() {
@@ -198,7 +216,7 @@ func (b *Server) bind(req *bindReq) bool {
 		return true
 	}
 
-	return p.reqBind(newBindReqToPlayer(req.client.sender, req.client.recver, req.createTime))
+	return p.reqBind(newBindReqToPlayer(req.client, req.createTime))
 }
 
 func (b *Server) unbind(req *unbindReq) bool {
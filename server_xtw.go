@@ -21,6 +21,23 @@ func (b *Server) startClientTimingWheel() {
 	})
 }
 
+// 用于处理“client在登录队列中等待超时”
+type clientQueuedTimeoutItem struct {
+	c *Client
+}
+
+func (item *clientQueuedTimeoutItem) Release() {
+	item.c.onTimeout()
+}
+
+func (b *Server) startClientQueuedTimingWheel() {
+	b.wgAddOne()
+	go b.twClientQueued.Run(getQuit, func() {
+		log.Println("client queued timingwheel quit")
+		b.wgDone()
+	})
+}
+
 type clientBindingTimeoutItem struct {
 	c *Client
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"sync"
+)
+
+// certReloader holds a certificate/key pair which can be reloaded at runtime.
+// New handshakes use the latest certificate, established connections are not affected.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mux  sync.Mutex
+	cert *tls.Certificate
+}
+
+var muxCertReloaders sync.Mutex
+var certReloaders []*certReloader
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	muxCertReloaders.Lock()
+	defer muxCertReloaders.Unlock()
+	certReloaders = append(certReloaders, r)
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// reloadCertificates reloads all certificates, for example on SIGHUP.
+// If a reload fails, the old certificate is kept.
+func reloadCertificates() {
+	muxCertReloaders.Lock()
+	defer muxCertReloaders.Unlock()
+
+	for _, r := range certReloaders {
+		if err := r.reload(); err != nil {
+			log.Printf("reload certificate [%v] error [%v]\n", r.certFile, err)
+		} else {
+			log.Printf("certificate [%v] reloaded\n", r.certFile)
+		}
+	}
+}
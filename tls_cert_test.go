@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed certificate of 127.0.0.1 named name, and its key, in PEM.
+func newTestCert(t *testing.T, name string) (certPEM []byte, keyPEM []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	write := func(name string) {
+		certPEM, keyPEM := newTestCert(t, name)
+		os.WriteFile(certFile, certPEM, 0600)
+		os.WriteFile(keyFile, keyPEM, 0600)
+	}
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Fatal("missing certificate loaded")
+	}
+
+	write("first")
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		muxCertReloaders.Lock()
+		certReloaders = certReloaders[:len(certReloaders)-1]
+		muxCertReloaders.Unlock()
+	}()
+	name := func() string {
+		cert, _ := r.tlsConfig().GetCertificate(nil)
+		c, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Subject.CommonName
+	}
+	if got := name(); got != "first" {
+		t.Fatalf("got %v, want first", got)
+	}
+
+	write("second")
+	reloadCertificates()
+	if got := name(); got != "second" {
+		t.Fatalf("got %v, want second", got)
+	}
+
+	// a broken pair keeps the old certificate
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	reloadCertificates()
+	if got := name(); got != "second" {
+		t.Fatalf("got %v after a failed reload, want second", got)
+	}
+}
@@ -3,8 +3,16 @@ package util
 
 // Reasons of closing client
 const (
-	InvalidReason          = 0
-	HeartbeatTimeout       = 1 // 心跳包超时
-	AnotherClientConnected = 2 // 账号在其它客户端登录
-	ServerClosed           = 3 // 服务器关闭
+	InvalidReason              = 0
+	HeartbeatTimeout           = 1  // 心跳包超时
+	AnotherClientConnected     = 2  // 账号在其它客户端登录
+	ServerClosed               = 3  // 服务器关闭
+	InvalidHandshake           = 4  // 握手数据无效
+	UnsupportedCodec           = 5  // 不支持客户端指定的编码
+	UnsupportedProtocolVersion = 6  // 不支持客户端的协议版本
+	EncryptionRequired         = 7  // 非TLS连接必须加密
+	InvalidSequence            = 8  // 消息序号重复或乱序
+	UnsupportedChecksum        = 9  // 不支持客户端指定的校验算法
+	EncryptionUnavailable      = 10 // 服务器未配置握手签名密钥，不支持加密
+	ReplayProtectionRequired   = 11 // 非TLS且未加密的连接只能发送幂等消息
 )
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	atom "sync/atomic"
+)
+
+// wsCompressStats counts messages sent with permessage-deflate.
+// bytesBefore is the size of payloads, bytesAfter is the size written to the connection,
+// including websocket frame headers, and TLS record overhead if the listener is TLS.
+// So bytesBefore-bytesAfter is the bandwidth saved.
+var wsCompressStats struct {
+	messages    int64
+	bytesBefore int64
+	bytesAfter  int64
+}
+
+func addWSCompressStats(before int, after int64) {
+	atom.AddInt64(&wsCompressStats.messages, 1)
+	atom.AddInt64(&wsCompressStats.bytesBefore, int64(before))
+	atom.AddInt64(&wsCompressStats.bytesAfter, after)
+}
+
+func wsCompressStatsSnapshot() map[string]int64 {
+	return map[string]int64{
+		"messages":    atom.LoadInt64(&wsCompressStats.messages),
+		"bytesBefore": atom.LoadInt64(&wsCompressStats.bytesBefore),
+		"bytesAfter":  atom.LoadInt64(&wsCompressStats.bytesAfter),
+	}
+}
+
+// wsOffersDeflate returns true if the client offers permessage-deflate.
+func wsOffersDeflate(r *http.Request) bool {
+	for _, v := range r.Header["Sec-Websocket-Extensions"] {
+		if strings.Contains(strings.ToLower(v), "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingListener wraps accepted connections with countingConn.
+type countingListener struct {
+	net.Listener
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c}, nil
+}
+
+// countingConn counts bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atom.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) writtenBytes() int64 {
+	return atom.LoadInt64(&c.written)
+}
+
+// countingConnOf returns the countingConn under c, which could be a *tls.Conn over it, or nil.
+func countingConnOf(c net.Conn) *countingConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	cc, _ := c.(*countingConn)
+	return cc
+}
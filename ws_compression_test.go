@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCountingListenerBelowTLS serves https the way wsAcceptor does.
+func TestCountingListenerBelowTLS(t *testing.T) {
+	tcpln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := newTestCert(t, "127.0.0.1")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := tls.NewListener(&countingListener{tcpln}, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	conns := make(chan net.Conn, 1)
+	secure := make(chan bool, 1)
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secure <- r.TLS != nil
+			w.Write([]byte("hello"))
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			conns <- c
+			return ctx
+		},
+	}
+	go httpServer.Serve(ln)
+	defer httpServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + tcpln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !<-secure {
+		t.Fatal("r.TLS is nil")
+	}
+	cc := countingConnOf(<-conns)
+	if cc == nil {
+		t.Fatal("countingConn not found under *tls.Conn")
+	}
+	if cc.writtenBytes() == 0 {
+		t.Fatal("bytes written not counted")
+	}
+}
+
+func TestCountingConnOf(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	cc := &countingConn{Conn: c}
+
+	tests := []struct {
+		name string
+		conn net.Conn
+		want *countingConn
+	}{
+		{"counting", cc, cc},
+		{"tls over counting", tls.Server(cc, &tls.Config{}), cc},
+		{"plain", c, nil},
+		{"tls over plain", tls.Server(c, &tls.Config{}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countingConnOf(tt.conn); got != tt.want {
+				t.Fatalf("got %p, want %p", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWSOffersDeflate(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		want       bool
+	}{
+		{"none", nil, false},
+		{"deflate", []string{"permessage-deflate; client_max_window_bits"}, true},
+		{"upper case", []string{"PerMessage-Deflate"}, true},
+		{"second header", []string{"x-webkit-deflate-frame", "permessage-deflate"}, true},
+		{"other", []string{"x-webkit-deflate-frame"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, v := range tt.extensions {
+				r.Header.Add("Sec-WebSocket-Extensions", v)
+			}
+			if got := wsOffersDeflate(r); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountingConn(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go io.Copy(ioutil.Discard, s)
+
+	cc := &countingConn{Conn: c}
+	for _, n := range []int{1, 10, 100} {
+		if _, err := cc.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cc.writtenBytes() != 111 {
+		t.Fatalf("%v bytes counted, want 111", cc.writtenBytes())
+	}
+}